@@ -6,69 +6,204 @@ import (
 	"sync"
 	"time"
 
+	"github.com/chinaboard/coral/stats"
 	"github.com/chinaboard/coral/utils"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/juju/errors"
+	"golang.org/x/sync/singleflight"
 )
 
 type Cache struct {
-	data sync.Map
-	ttl  time.Duration
+	data   sync.Map
+	ttl    time.Duration
+	flight singleflight.Group
+	sem    chan struct{}
+	lookup LookupFunc
+	// Policy combines the decisions of the addresses of a host
+	Policy string
+	// NegativeTTL is how long a failed lookup is cached, counted from the
+	// lookup, zero caches none
+	NegativeTTL time.Duration
 }
+
+// policies combining the addresses of a host, with PolicyAll a host is
+// direct when all of its addresses are, with PolicyAny when one is.
+const (
+	PolicyAll = "all"
+	PolicyAny = "any"
+)
+
+// LookupFunc returns the addresses of a host.
+type LookupFunc func(host string) ([]net.IP, error)
 type kv struct {
-	value bool
-	ttl   time.Time
+	value    bool
+	resolved bool
+	ttl      time.Time
+}
+
+// Decision is the classification of a host and where it came from.
+type Decision struct {
+	Direct bool
+	// Hit is set when the decision was cached
+	Hit bool
+	// Resolved is set when the lookup behind the decision succeeded, a failed
+	// one always means proxy
+	Resolved bool
 }
 
-func NewCache(ttl time.Duration) *Cache {
-	cache := &Cache{ttl: ttl}
-	cache.init()
-	return cache
+// NewCache returns a cache whose DNS lookups run at most maxLookups at a
+// time, zero means unlimited. A zero ttl caches nothing, a nil lookup is
+// net.LookupIP.
+func NewCache(ttl time.Duration, maxLookups int, lookup LookupFunc) *Cache {
+	if lookup == nil {
+		lookup = net.LookupIP
+	}
+	c := &Cache{ttl: ttl, lookup: lookup}
+	if maxLookups > 0 {
+		c.sem = make(chan struct{}, maxLookups)
+	}
+	return c
 }
 
-func (c *Cache) init() {
-	go func(ch <-chan time.Time) {
-		for range ch {
-			c.data.Range(func(key, value interface{}) bool {
-				if time.Since(value.(kv).ttl) > c.ttl {
-					c.data.Delete(key)
-				}
-				return true
-			})
+// Sweep removes expired entries, it is meant to be called periodically.
+func (c *Cache) Sweep() {
+	c.data.Range(func(key, value interface{}) bool {
+		if c.expired(value.(kv)) {
+			c.data.Delete(key)
 		}
-	}(time.Tick(time.Second))
+		return true
+	})
 }
 
 func (c *Cache) Set(key string, value bool) {
-	c.data.Store(key, kv{value: value, ttl: time.Now()})
+	if c.ttl <= 0 {
+		return
+	}
+	c.data.Store(key, kv{value: value, resolved: true, ttl: time.Now()})
 }
 
 func (c *Cache) Exist(key string) (bool, error) {
+	v, ok := c.load(key)
+	if !ok {
+		return false, errors.New("not found")
+	}
+	return v.value, nil
+}
+
+// load returns the entry for key, refreshing the age of a resolved one. A
+// failed lookup is not refreshed, so the host is looked up again once it
+// expires however often it is requested.
+func (c *Cache) load(key string) (kv, bool) {
 	v, ok := c.data.Load(key)
-	if ok {
-		c.Set(key, v.(kv).value)
-		return v.(kv).value, nil
+	// expired entries may linger until the next sweep
+	if !ok || c.expired(v.(kv)) {
+		return kv{}, false
+	}
+	entry := v.(kv)
+	if entry.resolved {
+		entry.ttl = time.Now()
+		c.data.Store(key, entry)
+	}
+	return entry, true
+}
+
+// expired reports whether entry is older than its TTL, the negative one for
+// a failed lookup.
+func (c *Cache) expired(entry kv) bool {
+	ttl := c.ttl
+	if !entry.resolved {
+		ttl = c.NegativeTTL
 	}
-	return false, errors.New("not found")
+	return time.Since(entry.ttl) > ttl
 }
 
 func (c *Cache) ShouldDirect(key string) bool {
-	d, notFound := c.Exist(key)
-	if notFound != nil {
-		host, _, _ := net.SplitHostPort(key)
-		if strings.TrimSpace(host) == "" {
-			host = key
+	return c.Classify(key).Direct
+}
+
+// Classify decides whether key, a host:port, is reached directly.
+func (c *Cache) Classify(key string) Decision {
+	if entry, ok := c.load(key); ok {
+		stats.Global.AddCacheHit()
+		return Decision{Direct: entry.value, Hit: true, Resolved: entry.resolved}
+	}
+	stats.Global.AddCacheMiss()
+
+	// a burst of requests for the same new key shares one lookup and one
+	// cache write, lookup failures are shared as the proxy decision. Without
+	// a ttl nothing is written, the lookup is still shared.
+	v, _, _ := c.flight.Do(key, func() (interface{}, error) {
+		if entry, ok := c.load(key); ok {
+			return Decision{Direct: entry.value, Resolved: entry.resolved}, nil
 		}
-		ips, err := net.LookupIP(host)
-		if err != nil {
-			log.Warningln(err, host, "force use Proxy")
-			d = false
-		} else {
-			ip := ips[0].String()
-			d = utils.ShouldDirect(ip)
+		d := c.count(c.classify(key))
+		if c.ttl > 0 && (d.Resolved || c.NegativeTTL > 0) {
+			c.data.Store(key, kv{value: d.Direct, resolved: d.Resolved, ttl: time.Now()})
 		}
-		c.Set(key, d)
+		return d, nil
+	})
+	return v.(Decision)
+}
+
+// Peek tells how key would be classified without changing anything: a
+// miss is looked up but not stored, a hit isn't refreshed, and neither is
+// counted.
+func (c *Cache) Peek(key string) Decision {
+	if v, ok := c.data.Load(key); ok && !c.expired(v.(kv)) {
+		entry := v.(kv)
+		return Decision{Direct: entry.value, Hit: true, Resolved: entry.resolved}
+	}
+	return c.classify(key)
+}
+
+func (c *Cache) classify(key string) Decision {
+	host, _, _ := net.SplitHostPort(key)
+	if strings.TrimSpace(host) == "" {
+		host = key
+	}
+	ips, err := c.lookupIP(host)
+	if err != nil {
+		log.Warningln(err, host, "force use Proxy")
+		return Decision{}
+	}
+	// every address is judged, so the decision doesn't depend on the order
+	// of the DNS answer. Without China IPv6 ranges a dual-stack host is
+	// judged by its IPv4 addresses alone.
+	if v4 := ipv4Only(ips); len(v4) > 0 {
+		ips = v4
+	}
+	anyDirect := c.Policy == PolicyAny
+	for _, ip := range ips {
+		if utils.ShouldDirect(ip.String()) == anyDirect {
+			return Decision{Direct: anyDirect, Resolved: true}
+		}
+	}
+	return Decision{Direct: !anyDirect, Resolved: true}
+}
+
+// count records a lookup failure behind d.
+func (c *Cache) count(d Decision) Decision {
+	if !d.Resolved {
+		stats.Global.AddLookupFailure()
 	}
 	return d
 }
+
+func (c *Cache) lookupIP(host string) ([]net.IP, error) {
+	if c.sem != nil {
+		c.sem <- struct{}{}
+		defer func() { <-c.sem }()
+	}
+	return c.lookup(host)
+}
+
+func ipv4Only(ips []net.IP) []net.IP {
+	var v4 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		}
+	}
+	return v4
+}
@@ -0,0 +1,219 @@
+package cache
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chinaboard/coral/stats"
+)
+
+func TestSweep(t *testing.T) {
+	c := NewCache(time.Hour, 0, nil)
+	c.Set("live:443", true)
+	c.Set("stale:443", false)
+	v, _ := c.data.Load("stale:443")
+	entry := v.(kv)
+	entry.ttl = time.Now().Add(-2 * time.Hour)
+	c.data.Store("stale:443", entry)
+
+	c.Sweep()
+	if _, ok := c.data.Load("stale:443"); ok {
+		t.Error("expired entry kept")
+	}
+	if _, ok := c.data.Load("live:443"); !ok {
+		t.Error("live entry swept")
+	}
+}
+
+func TestClassifyAddresses(t *testing.T) {
+	const (
+		cn      = "114.114.114.114"
+		foreign = "8.8.8.8"
+		v6      = "2001:4860:4860::8888"
+	)
+	tests := []struct {
+		policy string
+		ips    []string
+		direct bool
+	}{
+		{PolicyAll, []string{cn}, true},
+		{PolicyAll, []string{foreign}, false},
+		{PolicyAll, []string{cn, foreign}, false},
+		{PolicyAll, []string{foreign, cn}, false},
+		{PolicyAny, []string{foreign, cn}, true},
+		{PolicyAny, []string{foreign, foreign}, false},
+		// IPv6 addresses are left to the IPv4 ones of a dual-stack host
+		{PolicyAll, []string{v6, cn}, true},
+		{PolicyAll, []string{v6}, false},
+		{PolicyAll, []string{"::1"}, true},
+	}
+	for _, tt := range tests {
+		var ips []net.IP
+		for _, ip := range tt.ips {
+			ips = append(ips, net.ParseIP(ip))
+		}
+		c := NewCache(0, 0, func(string) ([]net.IP, error) { return ips, nil })
+		c.Policy = tt.policy
+		if d := c.Classify("example.com:443"); d.Direct != tt.direct || !d.Resolved {
+			t.Errorf("policy %s, addresses %v: direct %v, want %v", tt.policy, tt.ips, d.Direct, tt.direct)
+		}
+	}
+}
+
+func TestMaxLookups(t *testing.T) {
+	var running, peak int32
+	lookup := func(string) ([]net.IP, error) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return []net.IP{net.ParseIP("8.8.8.8")}, nil
+	}
+	c := NewCache(time.Hour, 2, lookup)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.Classify("host" + strconv.Itoa(i) + ".example.com:443")
+		}(i)
+	}
+	wg.Wait()
+	if peak > 2 {
+		t.Errorf("%d lookups at a time, want at most 2", peak)
+	}
+}
+
+func TestConcurrentLookupsShared(t *testing.T) {
+	// without a ttl nothing is cached, but a burst still shares the lookup
+	for _, ttl := range []time.Duration{time.Hour, 0} {
+		var lookups int32
+		release := make(chan struct{})
+		c := NewCache(ttl, 0, func(string) ([]net.IP, error) {
+			atomic.AddInt32(&lookups, 1)
+			<-release
+			return []net.IP{net.ParseIP("114.114.114.114")}, nil
+		})
+		const n = 50
+		var wg sync.WaitGroup
+		decisions := make(chan Decision, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				decisions <- c.Classify("example.com:443")
+			}()
+		}
+		// let the requests pile up on the first lookup
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		wg.Wait()
+		close(decisions)
+		if lookups != 1 {
+			t.Errorf("ttl %v: %d concurrent requests made %d lookups, want 1", ttl, n, lookups)
+		}
+		for d := range decisions {
+			if !d.Direct || !d.Resolved {
+				t.Errorf("ttl %v: shared decision %+v, want direct", ttl, d)
+			}
+		}
+		if ttl == 0 && len(c.Entries()) != 0 {
+			t.Errorf("ttl 0: cached %v", c.Entries())
+		}
+	}
+}
+
+func TestConcurrentFailuresShared(t *testing.T) {
+	var lookups int32
+	release := make(chan struct{})
+	c := NewCache(time.Hour, 0, func(string) ([]net.IP, error) {
+		atomic.AddInt32(&lookups, 1)
+		<-release
+		return nil, errors.New("no such host")
+	})
+	const n = 50
+	var wg sync.WaitGroup
+	decisions := make(chan Decision, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			decisions <- c.Classify("example.com:443")
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(decisions)
+	if lookups != 1 {
+		t.Errorf("%d concurrent requests made %d lookups, want 1", n, lookups)
+	}
+	for d := range decisions {
+		if d.Direct || d.Resolved {
+			t.Errorf("shared failure %+v, want an unresolved proxy decision", d)
+		}
+	}
+
+	// without a negative TTL the failure is neither cached nor kept by the
+	// group, the next request looks the host up again
+	release = make(chan struct{})
+	close(release)
+	c.Classify("example.com:443")
+	if lookups != 2 {
+		t.Errorf("request after the failure made %d lookups in total, want 2", lookups)
+	}
+}
+
+func TestBurstCachedOnce(t *testing.T) {
+	var lookups int32
+	c := NewCache(time.Hour, 0, func(string) ([]net.IP, error) {
+		atomic.AddInt32(&lookups, 1)
+		time.Sleep(20 * time.Millisecond)
+		return []net.IP{net.ParseIP("8.8.8.8")}, nil
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Classify("example.com:443")
+		}()
+	}
+	wg.Wait()
+	if d := c.Classify("example.com:443"); !d.Hit || d.Direct {
+		t.Errorf("decision after the burst %+v, want a cached proxy decision", d)
+	}
+	if lookups != 1 {
+		t.Errorf("burst made %d lookups, want 1", lookups)
+	}
+}
+
+func TestHitMissCounts(t *testing.T) {
+	c := NewCache(time.Hour, 0, func(string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("114.114.114.114")}, nil
+	})
+	before := stats.Global.Snapshot()
+	first := c.Classify("example.com:443")
+	second := c.Classify("example.com:443")
+	after := stats.Global.Snapshot()
+
+	if first.Hit || !second.Hit {
+		t.Errorf("hits %v then %v, want a miss then a hit", first.Hit, second.Hit)
+	}
+	if hits, misses := after.CacheHits-before.CacheHits, after.CacheMisses-before.CacheMisses; hits != 1 || misses != 1 {
+		t.Errorf("counted %d hits and %d misses, want 1 and 1", hits, misses)
+	}
+	if fails := after.LookupFails - before.LookupFails; fails != 0 {
+		t.Errorf("counted %d lookup failures", fails)
+	}
+}
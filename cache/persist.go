@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Entry is the saved form of a cached decision.
+type Entry struct {
+	Direct   bool      `json:"direct"`
+	Resolved bool      `json:"resolved"`
+	Used     time.Time `json:"used"`
+}
+
+// Entries returns the live entries by host:port.
+func (c *Cache) Entries() map[string]Entry {
+	entries := map[string]Entry{}
+	c.data.Range(func(key, value interface{}) bool {
+		v := value.(kv)
+		if !c.expired(v) {
+			entries[key.(string)] = Entry{Direct: v.value, Resolved: v.resolved, Used: v.ttl}
+		}
+		return true
+	})
+	return entries
+}
+
+// Save writes the live entries to path. The file is replaced in one step, so
+// a crash while saving leaves the previous one intact.
+func (c *Cache) Save(path string) error {
+	buf, err := json.Marshal(c.Entries())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return errors.Trace(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp.Name(), path))
+}
+
+// Load adds the entries saved in path that haven't expired, and returns how
+// many. A missing file loads nothing.
+func (c *Cache) Load(path string) (int, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	entries := map[string]Entry{}
+	if err := json.Unmarshal(buf, &entries); err != nil {
+		return 0, errors.Annotatef(err, "cache file %s", path)
+	}
+	n := 0
+	for key, e := range entries {
+		v := kv{value: e.Direct, resolved: e.Resolved, ttl: e.Used}
+		if c.expired(v) {
+			continue
+		}
+		c.data.Store(key, v)
+		n++
+	}
+	return n, nil
+}
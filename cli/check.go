@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/chinaboard/coral/config"
+	"github.com/chinaboard/coral/core"
+	"github.com/chinaboard/coral/core/tlsclient"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkConfig builds every server and the listener of conf the way a start
+// would, without binding or serving, and reports each to w. SIP003 plugins
+// are looked up but not started. It returns whether everything is valid.
+func checkConfig(w io.Writer, conf *config.CoralConfig) bool {
+	// the report replaces the log of the construction
+	log.SetLevel(log.ErrorLevel)
+	ok := true
+	report := func(what string, err error) {
+		if err != nil {
+			ok = false
+			fmt.Fprintf(w, "%s: %v\n", what, err)
+		} else {
+			fmt.Fprintf(w, "%s: ok\n", what)
+		}
+	}
+
+	names := make([]string, 0, len(conf.Servers))
+	for name := range conf.Servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		server := conf.Servers[name]
+		report(fmt.Sprintf("server %s (%s %s)", name, server.Type, server.Address()), checkServer(server, conf.Common))
+		server.Plugin, server.PluginOpts = "", ""
+		conf.Servers[name] = server
+	}
+
+	addr := strings.Join(conf.Common.Addresses(), ", ")
+	if conf.Common.UnixSocket != "" {
+		addr = conf.Common.UnixSocket
+	}
+	_, err := core.NewHttpListener(conf)
+	report("listener "+addr, err)
+	return ok
+}
+
+func checkServer(server config.CoralServer, common config.CoralConfigCommon) error {
+	if err := tlsclient.Validate(server.Fingerprint); err != nil {
+		return err
+	}
+	if server.Plugin != "" {
+		if _, err := exec.LookPath(server.Plugin); err != nil {
+			return errors.Annotate(err, "plugin")
+		}
+		server.Plugin, server.PluginOpts = "", ""
+	}
+	_, err := core.GenerateProxy(server, common)
+	return err
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/chinaboard/coral/config"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// setupLog sends the log to the configured file or syslog instead of
+// stderr. It runs before the listener is created, whose access and deny
+// loggers follow the standard one.
+func setupLog(common config.CoralConfigCommon) error {
+	if common.Syslog != "" {
+		if err := addSyslogHook(common.Syslog); err != nil {
+			return errors.Annotate(err, "syslog")
+		}
+		log.SetOutput(ioutil.Discard)
+		return nil
+	}
+	if common.LogFile == "" {
+		return nil
+	}
+	// the rotating writer opens the file on the first write, fail now instead
+	if err := os.MkdirAll(filepath.Dir(common.LogFile), 0755); err != nil {
+		return errors.Annotate(err, "log file")
+	}
+	file, err := os.OpenFile(common.LogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Annotate(err, "log file")
+	}
+	file.Close()
+	log.SetOutput(&lumberjack.Logger{
+		Filename:   common.LogFile,
+		MaxSize:    common.LogMaxSize,
+		MaxAge:     common.LogMaxAge,
+		MaxBackups: common.LogMaxBackups,
+	})
+	return nil
+}
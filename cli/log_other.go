@@ -0,0 +1,12 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"github.com/juju/errors"
+)
+
+func addSyslogHook(addr string) error {
+	return errors.New("not supported on this platform")
+}
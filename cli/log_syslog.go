@@ -0,0 +1,31 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"log/syslog"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+	lsyslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+// addSyslogHook logs to the local syslog daemon for "local", or to a remote
+// one at udp://host:port or tcp://host:port, keeping the level of entries.
+func addSyslogHook(addr string) error {
+	network, raddr := "", ""
+	if addr != "local" {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return err
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	hook, err := lsyslog.NewSyslogHook(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, "coral")
+	if err != nil {
+		return err
+	}
+	log.AddHook(hook)
+	return nil
+}
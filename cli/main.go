@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/chinaboard/coral/config"
 	"github.com/chinaboard/coral/core"
+	"github.com/chinaboard/coral/stats"
 
 	_ "github.com/chinaboard/coral/utils/version"
 	log "github.com/sirupsen/logrus"
@@ -13,21 +20,91 @@ import (
 
 func main() {
 	configFile := ""
+	testConfig := false
 	flag.StringVar(&configFile, "config", "", "Configuration filename")
+	flag.BoolVar(&testConfig, "t", false, "Check the configuration and exit")
+	flag.BoolVar(&testConfig, "test-config", false, "Check the configuration and exit")
 	flag.Parse()
 
 	conf, err := config.ParseFileConfig(configFile)
+	if testConfig {
+		if err == nil && checkConfig(os.Stdout, conf) {
+			fmt.Println("configuration ok")
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+		fmt.Println("configuration test failed")
+		os.Exit(1)
+	}
 	if err != nil {
 		log.Fatalln(err)
 		return
 	}
+	if err := setupLog(conf.Common); err != nil {
+		log.Fatalln(err)
+	}
 
-	http, err := core.NewHttpListener(conf)
+	listener, err := core.NewHttpListener(conf)
 	if err != nil {
 		log.Fatalln(err)
 		os.Exit(128)
 	}
 
-	log.Infof("listen on %s", conf.Common.Address())
-	log.Fatalln(http.ListenAndServe())
+	if conf.Common.StatsdAddress != "" {
+		emitter, err := stats.NewStatsdEmitter(conf.Common.StatsdAddress, conf.Common.StatsdInterval, stats.Global)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		emitter.Start()
+		log.Infof("statsd to %s every %s", conf.Common.StatsdAddress, conf.Common.StatsdInterval)
+	}
+
+	if conf.Common.MetricsAddress != "" {
+		exporter := stats.NewPrometheusExporter(conf.Common.MetricsAddress, stats.Global)
+		exporter.Start()
+		log.Infof("prometheus metrics on http://%s/metrics", conf.Common.MetricsAddress)
+	}
+
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			conf, err := config.ParseFileConfig(configFile)
+			if err == nil {
+				err = listener.Reload(conf)
+			}
+			if err != nil {
+				log.Errorln("reload, keep the current config:", err)
+			}
+		}
+	}()
+
+	drained := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 2)
+		signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+		<-sigs
+		log.Infof("shutting down, drain for at most %s", conf.Common.DrainTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), conf.Common.DrainTimeout)
+		go func() {
+			<-sigs
+			log.Warnln("second signal, shut down now")
+			cancel()
+		}()
+		listener.Shutdown(ctx)
+		cancel()
+		close(drained)
+	}()
+
+	if conf.Common.UnixSocket != "" {
+		log.Infof("listen on unix socket %s", conf.Common.UnixSocket)
+	} else {
+		log.Infof("listen on %s", strings.Join(conf.Common.Addresses(), ", "))
+	}
+	if err := listener.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatalln(err)
+	}
+	<-drained
 }
@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os/user"
 	"reflect"
 	"strconv"
@@ -18,37 +20,178 @@ import (
 )
 
 type CoralConfig struct {
-	Common  CoralConfigCommon
-	Servers map[string]CoralServer
+	Common    CoralConfigCommon
+	Servers   map[string]CoralServer
+	PacGroups map[string]PacGroup
 }
 
+// PacGroup customizes the PAC file served to some clients, its sections are
+// named "pac:<group>".
+type PacGroup struct {
+	Name    string   `json:"name"`
+	Clients []string `json:"clients"`
+	Direct  []string `json:"direct"`
+	Proxy   []string `json:"proxy"`
+}
+
+const pacSectionPrefix = "pac:"
+
 type CoralServer struct {
-	Name          string        `json:"name"`
-	Type          string        `json:"type"`
-	Host          string        `json:"host"`
-	Port          string        `json:"port"`
-	Method        string        `json:"method"`
-	Password      string        `json:"password"`
-	Obfs          string        `json:"obfs"`
-	ObfsParam     string        `json:"obfsParam"`
-	Protocol      string        `json:"protocol"`
-	ProtocolParam string        `json:"protocolParam"`
-	ReadTimeout   time.Duration `json:"readTimeout"`
+	Name            string        `json:"name"`
+	Type            string        `json:"type"`
+	Host            string        `json:"host"`
+	Port            string        `json:"port"`
+	Method          string        `json:"method"`
+	Password        string        `json:"password"`
+	Obfs            string        `json:"obfs"`
+	ObfsParam       string        `json:"obfsParam"`
+	Protocol        string        `json:"protocol"`
+	ProtocolParam   string        `json:"protocolParam"`
+	UUID            string        `json:"uuid"`
+	AlterID         int           `json:"alterId"`
+	Security        string        `json:"security"`
+	Tos             int           `json:"tos"`
+	ReadTimeout     time.Duration `json:"readTimeout"`
+	ResponseTimeout time.Duration `json:"responseTimeout"`
+	Fingerprint     string        `json:"fingerprint"`
+	SourcePorts     PortRange     `json:"sourcePorts"`
+	Username        string        `json:"username"`
+	Plugin          string        `json:"plugin"`
+	PluginOpts      string        `json:"pluginOpts"`
+	Weight          int           `json:"weight"`
+	SourceAddress   string        `json:"sourceAddress"`
 }
 
+// Rules maps host patterns to an action: "direct", "reject" or the name of
+// a server.
+type Rules map[string]string
+
+// PortRange is an inclusive range of ports, the zero value is no range.
+type PortRange struct {
+	Low  int `json:"low"`
+	High int `json:"high"`
+}
+
+// Address joins host and port, IPv6 literals are bracketed exactly once
+// whether or not the config already wrote them with brackets.
 func (c CoralServer) Address() string {
-	return fmt.Sprintf("%s:%s", c.Host, c.Port)
+	return net.JoinHostPort(strings.Trim(c.Host, "[]"), c.Port)
 }
 
 type CoralConfigCommon struct {
-	Host          string          `json:"address"`
-	Port          int             `json:"port"`
-	DirectTimeout time.Duration   `json:"directTimeout"`
-	Whitelist     map[string]bool `json:"whitelist"`
+	Host                string          `json:"address"`
+	Port                int             `json:"port"`
+	DirectTimeout       time.Duration   `json:"directTimeout"`
+	Whitelist           map[string]bool `json:"whitelist"`
+	StatsdAddress       string          `json:"statsdAddress"`
+	StatsdInterval      time.Duration   `json:"statsdInterval"`
+	Acceptors           int             `json:"acceptors"`
+	Backlog             int             `json:"backlog"`
+	DirectTos           int             `json:"directTos"`
+	InterceptHosts      []string        `json:"interceptHosts"`
+	MitmCert            string          `json:"mitmCert"`
+	MitmKey             string          `json:"mitmKey"`
+	DenyLog             string          `json:"denyLog"`
+	ReadBuffer          int             `json:"readBuffer"`
+	WriteBuffer         int             `json:"writeBuffer"`
+	Canary              string          `json:"canary"`
+	CanaryPercent       int             `json:"canaryPercent"`
+	CanaryErrorPercent  int             `json:"canaryErrorPercent"`
+	JanitorInterval     time.Duration   `json:"janitorInterval"`
+	ViaHeader           bool            `json:"viaHeader"`
+	NoProxy             string          `json:"noProxy"`
+	MaxLookups          int             `json:"maxLookups"`
+	RouteOverride       string          `json:"routeOverride"`
+	AllowedSchemes      []string        `json:"allowedSchemes"`
+	LogRedirects        bool            `json:"logRedirects"`
+	BlockLocalRedirects bool            `json:"blockLocalRedirects"`
+	Webhook             string          `json:"webhook"`
+	ProbePath           string          `json:"probePath"`
+	ProbeResponse       string          `json:"probeResponse"`
+	LoadBalance         string          `json:"loadBalance"`
+	PacDirect           []string        `json:"pacDirect"`
+	PacProxy            []string        `json:"pacProxy"`
+	SniffSni            bool            `json:"sniffSni"`
+	PreReadTimeout      time.Duration   `json:"preReadTimeout"`
+	MaxHops             int             `json:"maxHops"`
+	DirectParallel      int             `json:"directParallel"`
+	Fallback            string          `json:"fallback"`
+	FallbackTTL         time.Duration   `json:"fallbackTTL"`
+	RestartLimit        int             `json:"restartLimit"`
+	AdminAddress        string          `json:"adminAddress"`
+	DrainTimeout        time.Duration   `json:"drainTimeout"`
+	DirectOnly          bool            `json:"directOnly"`
+	SourcePorts         PortRange       `json:"sourcePorts"`
+	LatencyTarget       string          `json:"latencyTarget"`
+	LatencyInterval     time.Duration   `json:"latencyInterval"`
+	HealthThreshold     int             `json:"healthThreshold"`
+	HealthInterval      time.Duration   `json:"healthInterval"`
+	CacheTTL            time.Duration   `json:"cacheTTL"`
+	CacheFile           string          `json:"cacheFile"`
+	PacPath             string          `json:"pacPath"`
+	AddrInPac           string          `json:"addrInPAC"`
+	AllowedClients      []string        `json:"allowedClients"`
+	UserPasswd          string          `json:"userPasswd"`
+	UserPasswdFile      string          `json:"userPasswdFile"`
+	TunnelAllowed       bool            `json:"tunnelAllowed"`
+	TunnelAllowedPort   []int           `json:"tunnelAllowedPort"`
+	MetricsAddress      string          `json:"metricsAddress"`
+	DialAttempts        int             `json:"dialAttempts"`
+	DnsServer           string          `json:"dnsServer"`
+	DnsTimeout          time.Duration   `json:"dnsTimeout"`
+	DirectPolicy        string          `json:"directPolicy"`
+	SocksAddress        string          `json:"socksAddress"`
+	HttpErrorCode       int             `json:"httpErrorCode"`
+	RejectDomains       []string        `json:"rejectDomains"`
+	RejectStatus        int             `json:"rejectStatus"`
+	ProxyDomains        []string        `json:"proxyDomains"`
+	ProxyDomainURL      string          `json:"proxyDomainURL"`
+	ProxyDomainFile     string          `json:"proxyDomainFile"`
+	ProxyDomainInterval time.Duration   `json:"proxyDomainInterval"`
+	IdleTimeout         time.Duration   `json:"idleTimeout"`
+	DialTimeout         time.Duration   `json:"dialTimeout"`
+	BreakerThreshold    int             `json:"breakerThreshold"`
+	BreakerWindow       time.Duration   `json:"breakerWindow"`
+	BreakerCooldown     time.Duration   `json:"breakerCooldown"`
+	RateLimit           int             `json:"rateLimit"`
+	MaxConns            int             `json:"maxConns"`
+	MaxConnsPerClient   int             `json:"maxConnsPerClient"`
+	AccessLog           string          `json:"accessLog"`
+	LogFile             string          `json:"logFile"`
+	LogMaxSize          int             `json:"logMaxSize"`
+	LogMaxAge           int             `json:"logMaxAge"`
+	LogMaxBackups       int             `json:"logMaxBackups"`
+	Syslog              string          `json:"syslog"`
+	FallbackDirect      bool            `json:"fallbackDirect"`
+	NegativeCacheTTL    time.Duration   `json:"negativeCacheTTL"`
+	UnixSocket          string          `json:"unixSocket"`
+	TransparentAddress  string          `json:"transparentAddress"`
+	SourceAddress       string          `json:"sourceAddress"`
+	SoMark              int             `json:"soMark"`
+	TcpKeepAlive        time.Duration   `json:"tcpKeepAlive"`
+	TcpNoDelay          bool            `json:"tcpNoDelay"`
+	Listen              []string        `json:"listen"`
+	ListenNoAuth        []string        `json:"listenNoAuth"`
+	ProxyProtocol       bool            `json:"proxyProtocol"`
+	Rules               Rules           `json:"rules"`
+	DirectPorts         []int           `json:"directPort"`
+	ProxyPorts          []int           `json:"proxyPort"`
+	DeniedLocal         bool            `json:"deniedLocal"`
+	AllowedLocal        string          `json:"allowedLocal"`
+	ProxyProtocolFrom   []string        `json:"proxyProtocolFrom"`
 }
 
 func (c CoralConfigCommon) Address() string {
-	return fmt.Sprintf("%s:%d", c.Host, c.Port)
+	return net.JoinHostPort(strings.Trim(c.Host, "[]"), strconv.Itoa(c.Port))
+}
+
+// Addresses returns the addresses of the HTTP listener, those of listen or
+// else host and port.
+func (c CoralConfigCommon) Addresses() []string {
+	if len(c.Listen) > 0 {
+		return c.Listen
+	}
+	return []string{c.Address()}
 }
 
 func init() {
@@ -118,6 +261,53 @@ func ParseIniConfig(str string) (*CoralConfig, error) {
 		cfg.Common.Port = v
 	}
 
+	if tmpStr, ok = conf.Get("common", "listen"); ok {
+		if err := json.Unmarshal([]byte(tmpStr), &cfg.Common.Listen); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid listen")
+		}
+		for _, addr := range cfg.Common.Listen {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return nil, errors.Errorf("Parse conf error: invalid listen %s", addr)
+			}
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "listenNoAuth"); ok {
+		if err := json.Unmarshal([]byte(tmpStr), &cfg.Common.ListenNoAuth); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid listenNoAuth")
+		}
+		listen := map[string]bool{}
+		for _, addr := range cfg.Common.Addresses() {
+			listen[addr] = true
+		}
+		for _, addr := range cfg.Common.ListenNoAuth {
+			if !listen[addr] {
+				return nil, errors.Errorf("Parse conf error: invalid listenNoAuth, %s is not a listen address", addr)
+			}
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "proxyProtocol"); ok {
+		cfg.Common.ProxyProtocol, err = strconv.ParseBool(tmpStr)
+		if err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid proxyProtocol")
+		}
+	}
+
+	// a header from anyone else would let a client pick its own address
+	if tmpStr, ok = conf.Get("common", "proxyProtocolFrom"); ok {
+		if err := json.Unmarshal([]byte(tmpStr), &cfg.Common.ProxyProtocolFrom); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid proxyProtocolFrom")
+		}
+	}
+	if cfg.Common.ProxyProtocol && len(cfg.Common.ProxyProtocolFrom) == 0 {
+		return nil, errors.Errorf("Parse conf error: proxyProtocol needs proxyProtocolFrom")
+	}
+
+	if tmpStr, ok = conf.Get("common", "unixSocket"); ok {
+		cfg.Common.UnixSocket = tmpStr
+	}
+
 	if tmpStr, ok = conf.Get("common", "directTimeout"); ok {
 		v, err = strconv.Atoi(tmpStr)
 		if err != nil {
@@ -141,11 +331,683 @@ func ParseIniConfig(str string) (*CoralConfig, error) {
 		}
 	}
 
+	if tmpStr, ok = conf.Get("common", "statsdAddress"); ok {
+		cfg.Common.StatsdAddress = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "statsdInterval"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v <= 0 {
+			err = errors.Errorf("Parse conf error: invalid statsdInterval")
+			return nil, err
+		}
+		cfg.Common.StatsdInterval = time.Duration(v) * time.Second
+	}
+
+	if tmpStr, ok = conf.Get("common", "acceptors"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 1 {
+			err = errors.Errorf("Parse conf error: invalid acceptors")
+			return nil, err
+		}
+		cfg.Common.Acceptors = v
+	}
+
+	if tmpStr, ok = conf.Get("common", "backlog"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 0 {
+			err = errors.Errorf("Parse conf error: invalid backlog")
+			return nil, err
+		}
+		cfg.Common.Backlog = v
+	}
+
+	if tmpStr, ok = conf.Get("common", "directTos"); ok {
+		if cfg.Common.DirectTos, err = parseTos(tmpStr); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid directTos")
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "interceptHosts"); ok {
+		if err := json.Unmarshal([]byte(tmpStr), &cfg.Common.InterceptHosts); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid interceptHosts")
+		}
+		if cfg.Common.MitmCert, ok = conf.Get("common", "mitmCert"); !ok {
+			return nil, errors.NotFoundf("Parse conf error: mitmCert")
+		}
+		if cfg.Common.MitmKey, ok = conf.Get("common", "mitmKey"); !ok {
+			return nil, errors.NotFoundf("Parse conf error: mitmKey")
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "denyLog"); ok {
+		cfg.Common.DenyLog = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "logFile"); ok {
+		cfg.Common.LogFile = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "logMaxSize"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v <= 0 {
+			return nil, errors.Errorf("Parse conf error: invalid logMaxSize")
+		}
+		cfg.Common.LogMaxSize = v
+	}
+
+	if tmpStr, ok = conf.Get("common", "logMaxAge"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 0 {
+			return nil, errors.Errorf("Parse conf error: invalid logMaxAge")
+		}
+		cfg.Common.LogMaxAge = v
+	}
+
+	if tmpStr, ok = conf.Get("common", "logMaxBackups"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 0 {
+			return nil, errors.Errorf("Parse conf error: invalid logMaxBackups")
+		}
+		cfg.Common.LogMaxBackups = v
+	}
+
+	if tmpStr, ok = conf.Get("common", "syslog"); ok && tmpStr != "" {
+		if tmpStr != "local" {
+			if u, err := url.Parse(tmpStr); err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Port() == "" {
+				return nil, errors.Errorf("Parse conf error: invalid syslog")
+			}
+		}
+		cfg.Common.Syslog = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "accessLog"); ok {
+		switch tmpStr {
+		case "text", "json":
+			cfg.Common.AccessLog = tmpStr
+		default:
+			return nil, errors.Errorf("Parse conf error: invalid accessLog")
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "readBuffer"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 0 {
+			err = errors.Errorf("Parse conf error: invalid readBuffer")
+			return nil, err
+		}
+		cfg.Common.ReadBuffer = v
+	}
+
+	if tmpStr, ok = conf.Get("common", "writeBuffer"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 0 {
+			err = errors.Errorf("Parse conf error: invalid writeBuffer")
+			return nil, err
+		}
+		cfg.Common.WriteBuffer = v
+	}
+
+	if tmpStr, ok = conf.Get("common", "canary"); ok {
+		cfg.Common.Canary = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "canaryPercent"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 0 || v > 100 {
+			err = errors.Errorf("Parse conf error: invalid canaryPercent")
+			return nil, err
+		}
+		cfg.Common.CanaryPercent = v
+	}
+
+	if tmpStr, ok = conf.Get("common", "canaryErrorPercent"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 0 || v > 100 {
+			err = errors.Errorf("Parse conf error: invalid canaryErrorPercent")
+			return nil, err
+		}
+		cfg.Common.CanaryErrorPercent = v
+	}
+
+	if tmpStr, ok = conf.Get("common", "janitorInterval"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v <= 0 {
+			err = errors.Errorf("Parse conf error: invalid janitorInterval")
+			return nil, err
+		}
+		cfg.Common.JanitorInterval = time.Duration(v) * time.Second
+	}
+
+	if tmpStr, ok = conf.Get("common", "viaHeader"); ok {
+		cfg.Common.ViaHeader, err = strconv.ParseBool(tmpStr)
+		if err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid viaHeader")
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "noProxy"); ok {
+		cfg.Common.NoProxy = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "deniedLocal"); ok {
+		cfg.Common.DeniedLocal, err = strconv.ParseBool(tmpStr)
+		if err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid deniedLocal")
+		}
+	}
+
+	// only addresses, a name could be pointed anywhere
+	if tmpStr, ok = conf.Get("common", "allowedLocal"); ok {
+		for _, item := range strings.Split(tmpStr, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(item); err != nil && net.ParseIP(item) == nil {
+				return nil, errors.Errorf("Parse conf error: invalid allowedLocal")
+			}
+		}
+		cfg.Common.AllowedLocal = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "maxLookups"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 0 {
+			err = errors.Errorf("Parse conf error: invalid maxLookups")
+			return nil, err
+		}
+		cfg.Common.MaxLookups = v
+	}
+
+	if tmpStr, ok = conf.Get("common", "routeOverride"); ok {
+		cfg.Common.RouteOverride = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "allowedSchemes"); ok {
+		var schemes []string
+		if err := json.Unmarshal([]byte(tmpStr), &schemes); err != nil || len(schemes) == 0 {
+			return nil, errors.Errorf("Parse conf error: invalid allowedSchemes")
+		}
+		cfg.Common.AllowedSchemes = schemes
+	}
+
+	if tmpStr, ok = conf.Get("common", "logRedirects"); ok {
+		cfg.Common.LogRedirects, err = strconv.ParseBool(tmpStr)
+		if err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid logRedirects")
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "blockLocalRedirects"); ok {
+		cfg.Common.BlockLocalRedirects, err = strconv.ParseBool(tmpStr)
+		if err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid blockLocalRedirects")
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "webhook"); ok && tmpStr != "" {
+		if u, err := url.Parse(tmpStr); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.Errorf("Parse conf error: invalid webhook")
+		}
+		cfg.Common.Webhook = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "probePath"); ok && tmpStr != "" {
+		if !strings.HasPrefix(tmpStr, "/") {
+			return nil, errors.Errorf("Parse conf error: invalid probePath")
+		}
+		cfg.Common.ProbePath = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "probeResponse"); ok {
+		cfg.Common.ProbeResponse = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "loadBalance"); ok {
+		switch tmpStr {
+		case "first", "leastconn", "backup", "latency", "weighted":
+			cfg.Common.LoadBalance = tmpStr
+		default:
+			return nil, errors.Errorf("Parse conf error: invalid loadBalance")
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "pacDirect"); ok {
+		if err := json.Unmarshal([]byte(tmpStr), &cfg.Common.PacDirect); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid pacDirect")
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "pacProxy"); ok {
+		if err := json.Unmarshal([]byte(tmpStr), &cfg.Common.PacProxy); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid pacProxy")
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "sniffSni"); ok {
+		cfg.Common.SniffSni, err = strconv.ParseBool(tmpStr)
+		if err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid sniffSni")
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "preReadTimeout"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v <= 0 {
+			return nil, errors.Errorf("Parse conf error: invalid preReadTimeout")
+		}
+		cfg.Common.PreReadTimeout = time.Duration(v) * time.Second
+	}
+
+	if tmpStr, ok = conf.Get("common", "maxHops"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 0 {
+			return nil, errors.Errorf("Parse conf error: invalid maxHops")
+		}
+		cfg.Common.MaxHops = v
+	}
+
+	if tmpStr, ok = conf.Get("common", "directParallel"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 1 {
+			return nil, errors.Errorf("Parse conf error: invalid directParallel")
+		}
+		cfg.Common.DirectParallel = v
+	}
+
+	if tmpStr, ok = conf.Get("common", "fallback"); ok {
+		cfg.Common.Fallback = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "fallbackTTL"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v <= 0 {
+			return nil, errors.Errorf("Parse conf error: invalid fallbackTTL")
+		}
+		cfg.Common.FallbackTTL = time.Duration(v) * time.Second
+	}
+
+	if tmpStr, ok = conf.Get("common", "fallbackDirect"); ok {
+		cfg.Common.FallbackDirect, err = strconv.ParseBool(tmpStr)
+		if err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid fallbackDirect")
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "restartLimit"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 0 {
+			return nil, errors.Errorf("Parse conf error: invalid restartLimit")
+		}
+		cfg.Common.RestartLimit = v
+	}
+
+	if tmpStr, ok = conf.Get("common", "adminAddress"); ok && tmpStr != "" {
+		if _, _, err := net.SplitHostPort(tmpStr); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid adminAddress")
+		}
+		cfg.Common.AdminAddress = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "drainTimeout"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 0 {
+			return nil, errors.Errorf("Parse conf error: invalid drainTimeout")
+		}
+		cfg.Common.DrainTimeout = time.Duration(v) * time.Second
+	}
+
+	if tmpStr, ok = conf.Get("common", "directOnly"); ok {
+		cfg.Common.DirectOnly, err = strconv.ParseBool(tmpStr)
+		if err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid directOnly")
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "sourcePorts"); ok && tmpStr != "" {
+		if cfg.Common.SourcePorts, err = parsePortRange(tmpStr); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid sourcePorts")
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "sourceAddress"); ok && tmpStr != "" {
+		if cfg.Common.SourceAddress, err = parseSourceAddress(tmpStr); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid sourceAddress, %v", err)
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "soMark"); ok {
+		// decimal or 0x hex like ip rule
+		mark, err := strconv.ParseUint(tmpStr, 0, 32)
+		if err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid soMark")
+		}
+		cfg.Common.SoMark = int(mark)
+	}
+
+	if tmpStr, ok = conf.Get("common", "tcpKeepAlive"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 0 {
+			return nil, errors.Errorf("Parse conf error: invalid tcpKeepAlive")
+		}
+		cfg.Common.TcpKeepAlive = time.Duration(v) * time.Second
+	}
+
+	if tmpStr, ok = conf.Get("common", "tcpNoDelay"); ok {
+		cfg.Common.TcpNoDelay, err = strconv.ParseBool(tmpStr)
+		if err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid tcpNoDelay")
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "latencyTarget"); ok {
+		if _, _, err := net.SplitHostPort(tmpStr); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid latencyTarget")
+		}
+		cfg.Common.LatencyTarget = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "latencyInterval"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v <= 0 {
+			return nil, errors.Errorf("Parse conf error: invalid latencyInterval")
+		}
+		cfg.Common.LatencyInterval = time.Duration(v) * time.Second
+	}
+
+	if tmpStr, ok = conf.Get("common", "healthThreshold"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 0 {
+			return nil, errors.Errorf("Parse conf error: invalid healthThreshold")
+		}
+		cfg.Common.HealthThreshold = v
+	}
+
+	if tmpStr, ok = conf.Get("common", "healthInterval"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v <= 0 {
+			return nil, errors.Errorf("Parse conf error: invalid healthInterval")
+		}
+		cfg.Common.HealthInterval = time.Duration(v) * time.Second
+	}
+
+	if tmpStr, ok = conf.Get("common", "breakerThreshold"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 0 {
+			return nil, errors.Errorf("Parse conf error: invalid breakerThreshold")
+		}
+		cfg.Common.BreakerThreshold = v
+	}
+
+	if tmpStr, ok = conf.Get("common", "breakerWindow"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v <= 0 {
+			return nil, errors.Errorf("Parse conf error: invalid breakerWindow")
+		}
+		cfg.Common.BreakerWindow = time.Duration(v) * time.Second
+	}
+
+	if tmpStr, ok = conf.Get("common", "breakerCooldown"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v <= 0 {
+			return nil, errors.Errorf("Parse conf error: invalid breakerCooldown")
+		}
+		cfg.Common.BreakerCooldown = time.Duration(v) * time.Second
+	}
+
+	if tmpStr, ok = conf.Get("common", "cacheTTL"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 0 {
+			return nil, errors.Errorf("Parse conf error: invalid cacheTTL")
+		}
+		cfg.Common.CacheTTL = time.Duration(v) * time.Second
+	}
+
+	if tmpStr, ok = conf.Get("common", "negativeCacheTTL"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 0 {
+			return nil, errors.Errorf("Parse conf error: invalid negativeCacheTTL")
+		}
+		cfg.Common.NegativeCacheTTL = time.Duration(v) * time.Second
+	}
+
+	if tmpStr, ok = conf.Get("common", "cacheFile"); ok {
+		cfg.Common.CacheFile = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "pacPath"); ok {
+		if !strings.HasPrefix(tmpStr, "/") {
+			return nil, errors.Errorf("Parse conf error: invalid pacPath")
+		}
+		cfg.Common.PacPath = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "addrInPAC"); ok && tmpStr != "" {
+		if _, _, err := net.SplitHostPort(tmpStr); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid addrInPAC")
+		}
+		cfg.Common.AddrInPac = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "allowedClients"); ok {
+		if err := json.Unmarshal([]byte(tmpStr), &cfg.Common.AllowedClients); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid allowedClients")
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "userPasswd"); ok {
+		cfg.Common.UserPasswd = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "userPasswdFile"); ok {
+		cfg.Common.UserPasswdFile = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "tunnelAllowed"); ok {
+		cfg.Common.TunnelAllowed, err = strconv.ParseBool(tmpStr)
+		if err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid tunnelAllowed")
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "tunnelAllowedPort"); ok {
+		var ports []int
+		if err := json.Unmarshal([]byte(tmpStr), &ports); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid tunnelAllowedPort")
+		}
+		for _, port := range ports {
+			if port < 1 || port > 65535 {
+				return nil, errors.Errorf("Parse conf error: invalid tunnelAllowedPort")
+			}
+		}
+		cfg.Common.TunnelAllowedPort = ports
+	}
+
+	if tmpStr, ok = conf.Get("common", "metricsAddress"); ok && tmpStr != "" {
+		if _, _, err := net.SplitHostPort(tmpStr); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid metricsAddress")
+		}
+		cfg.Common.MetricsAddress = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "dialAttempts"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 1 {
+			return nil, errors.Errorf("Parse conf error: invalid dialAttempts")
+		}
+		cfg.Common.DialAttempts = v
+	}
+
+	if tmpStr, ok = conf.Get("common", "dialTimeout"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 1 {
+			return nil, errors.Errorf("Parse conf error: invalid dialTimeout")
+		}
+		cfg.Common.DialTimeout = time.Duration(v) * time.Second
+	}
+
+	if tmpStr, ok = conf.Get("common", "dnsServer"); ok {
+		cfg.Common.DnsServer = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "dnsTimeout"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v <= 0 {
+			return nil, errors.Errorf("Parse conf error: invalid dnsTimeout")
+		}
+		cfg.Common.DnsTimeout = time.Duration(v) * time.Second
+	}
+
+	if tmpStr, ok = conf.Get("common", "directPolicy"); ok {
+		switch tmpStr {
+		case "all", "any":
+			cfg.Common.DirectPolicy = tmpStr
+		default:
+			return nil, errors.Errorf("Parse conf error: invalid directPolicy")
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "socksAddress"); ok && tmpStr != "" {
+		if _, _, err := net.SplitHostPort(tmpStr); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid socksAddress")
+		}
+		cfg.Common.SocksAddress = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "transparentAddress"); ok && tmpStr != "" {
+		if _, _, err := net.SplitHostPort(tmpStr); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid transparentAddress")
+		}
+		cfg.Common.TransparentAddress = tmpStr
+	}
+
+	// a status outside 400-599 would tell the client it worked
+	if tmpStr, ok = conf.Get("common", "httpErrorCode"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v != 0 && (v < 400 || v > 599) {
+			return nil, errors.Errorf("Parse conf error: invalid httpErrorCode")
+		}
+		cfg.Common.HttpErrorCode = v
+	}
+
+	if tmpStr, ok = conf.Get("common", "rejectDomains"); ok {
+		if err := json.Unmarshal([]byte(tmpStr), &cfg.Common.RejectDomains); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid rejectDomains")
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "rules"); ok {
+		if err := json.Unmarshal([]byte(tmpStr), &cfg.Common.Rules); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid rules")
+		}
+		for _, action := range cfg.Common.Rules {
+			if action == "" {
+				return nil, errors.Errorf("Parse conf error: invalid rules")
+			}
+		}
+	}
+
+	// a destination is routed by the first of: rules, directPort and
+	// proxyPort, noProxy, proxyDomains, the IPs of the host. rejectDomains
+	// and reject rules refuse it before any of them
+	if tmpStr, ok = conf.Get("common", "directPort"); ok {
+		if cfg.Common.DirectPorts, err = parsePorts(tmpStr); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid directPort")
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "proxyPort"); ok {
+		if cfg.Common.ProxyPorts, err = parsePorts(tmpStr); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid proxyPort")
+		}
+		for _, port := range cfg.Common.ProxyPorts {
+			for _, direct := range cfg.Common.DirectPorts {
+				if port == direct {
+					return nil, errors.Errorf("Parse conf error: port %d in both directPort and proxyPort", port)
+				}
+			}
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "rejectStatus"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v != http.StatusForbidden && v != http.StatusNoContent {
+			return nil, errors.Errorf("Parse conf error: invalid rejectStatus")
+		}
+		cfg.Common.RejectStatus = v
+	}
+
+	if tmpStr, ok = conf.Get("common", "proxyDomains"); ok {
+		if err := json.Unmarshal([]byte(tmpStr), &cfg.Common.ProxyDomains); err != nil {
+			return nil, errors.Errorf("Parse conf error: invalid proxyDomains")
+		}
+	}
+
+	if tmpStr, ok = conf.Get("common", "proxyDomainURL"); ok && tmpStr != "" {
+		if u, err := url.Parse(tmpStr); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, errors.Errorf("Parse conf error: invalid proxyDomainURL")
+		}
+		cfg.Common.ProxyDomainURL = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "proxyDomainFile"); ok {
+		cfg.Common.ProxyDomainFile = tmpStr
+	}
+
+	if tmpStr, ok = conf.Get("common", "proxyDomainInterval"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v <= 0 {
+			return nil, errors.Errorf("Parse conf error: invalid proxyDomainInterval")
+		}
+		cfg.Common.ProxyDomainInterval = time.Duration(v) * time.Second
+	}
+
+	if tmpStr, ok = conf.Get("common", "idleTimeout"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 0 {
+			return nil, errors.Errorf("Parse conf error: invalid idleTimeout")
+		}
+		cfg.Common.IdleTimeout = time.Duration(v) * time.Second
+	}
+
+	if tmpStr, ok = conf.Get("common", "rateLimit"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 0 {
+			return nil, errors.Errorf("Parse conf error: invalid rateLimit")
+		}
+		cfg.Common.RateLimit = v
+	}
+
+	if tmpStr, ok = conf.Get("common", "maxConns"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 0 {
+			return nil, errors.Errorf("Parse conf error: invalid maxConns")
+		}
+		cfg.Common.MaxConns = v
+	}
+
+	if tmpStr, ok = conf.Get("common", "maxConnsPerClient"); ok {
+		v, err = strconv.Atoi(tmpStr)
+		if err != nil || v < 0 {
+			return nil, errors.Errorf("Parse conf error: invalid maxConnsPerClient")
+		}
+		cfg.Common.MaxConnsPerClient = v
+	}
+
 	for name, section := range conf {
 		if name == "common" {
 			continue
 		}
-		if value, err := UnmarshalServerFormSection(name, section); err != nil {
+		if strings.HasPrefix(name, pacSectionPrefix) {
+			group, err := UnmarshalPacGroupSection(strings.TrimPrefix(name, pacSectionPrefix), section, cfg.Common)
+			if err != nil {
+				return nil, err
+			}
+			cfg.PacGroups[group.Name] = group
+			continue
+		}
+		if value, err := ParseServer(name, section, cfg.Common); err != nil {
 			return nil, err
 		} else {
 			cfg.Servers[name] = value
@@ -155,6 +1017,22 @@ func ParseIniConfig(str string) (*CoralConfig, error) {
 	return &cfg, nil
 }
 
+// ParseServer reads the server section name, the options it leaves out are
+// taken from common.
+func ParseServer(name string, section ini.Section, common CoralConfigCommon) (CoralServer, error) {
+	value, err := UnmarshalServerFormSection(name, section)
+	if err != nil {
+		return value, err
+	}
+	if value.SourcePorts == (PortRange{}) {
+		value.SourcePorts = common.SourcePorts
+	}
+	if value.SourceAddress == "" {
+		value.SourceAddress = common.SourceAddress
+	}
+	return value, nil
+}
+
 func UnmarshalServerFormSection(name string, section ini.Section) (CoralServer, error) {
 	cfg := CoralServer{Name: name}
 	var (
@@ -171,6 +1049,43 @@ func UnmarshalServerFormSection(name string, section ini.Section) (CoralServer,
 			cfg.ReadTimeout = time.Second * time.Duration(v)
 		}
 	}
+	if tmpStr, ok = section["responseTimeout"]; ok {
+		if v, err := strconv.Atoi(tmpStr); err != nil || v < 0 {
+			return cfg, errors.New("Parse conf error: invalid responseTimeout")
+		} else {
+			cfg.ResponseTimeout = time.Second * time.Duration(v)
+		}
+	}
+	cfg.Fingerprint = section["fingerprint"]
+	cfg.Weight = 1
+	if tmpStr, ok = section["weight"]; ok {
+		if v, err := strconv.Atoi(tmpStr); err != nil || v < 0 {
+			return cfg, errors.New("Parse conf error: invalid weight")
+		} else {
+			cfg.Weight = v
+		}
+	}
+	if tmpStr, ok = section["sourcePorts"]; ok && tmpStr != "" {
+		if v, err := parsePortRange(tmpStr); err != nil {
+			return cfg, errors.New("Parse conf error: invalid sourcePorts")
+		} else {
+			cfg.SourcePorts = v
+		}
+	}
+	if tmpStr, ok = section["sourceAddress"]; ok && tmpStr != "" {
+		if v, err := parseSourceAddress(tmpStr); err != nil {
+			return cfg, errors.Errorf("Parse conf error: invalid sourceAddress, %v", err)
+		} else {
+			cfg.SourceAddress = v
+		}
+	}
+	if tmpStr, ok = section["tos"]; ok {
+		if v, err := parseTos(tmpStr); err != nil {
+			return cfg, errors.New("Parse conf error: invalid tos")
+		} else {
+			cfg.Tos = v
+		}
+	}
 	if tmpStr, ok = section["type"]; ok {
 		cfg.Type = tmpStr
 	} else {
@@ -181,44 +1096,242 @@ func UnmarshalServerFormSection(name string, section ini.Section) (CoralServer,
 	ss := []string{"Host", "Port", "Method", "Password"}
 	ssr := []string{"Obfs", "ObfsParam", "Protocol", "ProtocolParam"}
 
-	unmarshal := func(keyList []string, ccs *CoralServer) error {
+	// missing keys are reported together by Validate
+	unmarshal := func(keyList []string, ccs *CoralServer) {
 		value := reflect.ValueOf(ccs).Elem()
 		for _, name := range keyList {
 			key := strings.ToLower(string(name[0])) + name[1:]
 			if tmpStr, ok = section[key]; ok {
 				value.FieldByName(name).Set(reflect.ValueOf(tmpStr))
-			} else {
-				return errors.NotFoundf("Parse conf error: %s", key)
 			}
 		}
-		return nil
 	}
 
 	cfg.Type = strings.ToLower(cfg.Type)
 
 	switch cfg.Type {
 	case "ssr":
-		if err := unmarshal(append(ss, ssr...), &cfg); err != nil {
-			return cfg, err
-		}
+		unmarshal(append(ss, ssr...), &cfg)
 	case "ss":
-		if err := unmarshal(ss, &cfg); err != nil {
-			return cfg, err
+		unmarshal(ss, &cfg)
+		cfg.Plugin = section["plugin"]
+		cfg.PluginOpts = section["pluginOpts"]
+		if cfg.Plugin == "" && cfg.PluginOpts != "" {
+			return cfg, errors.New("Parse conf error: pluginOpts without plugin")
+		}
+	case "vmess":
+		unmarshal(ss[:2], &cfg)
+		cfg.UUID = section["uuid"]
+		if tmpStr, ok = section["alterId"]; ok {
+			if v, err := strconv.Atoi(tmpStr); err != nil || v < 0 {
+				return cfg, errors.New("Parse conf error: invalid alterId")
+			} else {
+				cfg.AlterID = v
+			}
+		}
+		cfg.Security = section["security"]
+	case "socks5", "http", "https":
+		unmarshal(ss[:2], &cfg)
+		cfg.Username = section["username"]
+		cfg.Password = section["password"]
+		if cfg.Username == "" && cfg.Password != "" {
+			return cfg, errors.New("Parse conf error: password without username")
 		}
 	default:
 		return cfg, errors.NotSupportedf(cfg.Type)
 	}
+
+	cfg.Host = strings.Trim(cfg.Host, "[]")
+	if err := cfg.Validate(); err != nil {
+		return cfg, err
+	}
 	return cfg, nil
 }
 
+// required fields of each server type
+var serverRequired = map[string][]string{
+	"ss":     {"Host", "Port", "Method", "Password"},
+	"ssr":    {"Host", "Port", "Method", "Password", "Obfs", "ObfsParam", "Protocol", "ProtocolParam"},
+	"vmess":  {"Host", "Port", "UUID"},
+	"socks5": {"Host", "Port"},
+	"http":   {"Host", "Port"},
+	"https":  {"Host", "Port"},
+}
+
+// Validate checks that the fields the server type needs are set, and
+// reports every problem at once.
+func (c CoralServer) Validate() error {
+	required, ok := serverRequired[c.Type]
+	if !ok {
+		return errors.NotSupportedf("Parse conf error: type %q of server %s", c.Type, c.Name)
+	}
+	var problems []string
+	value := reflect.ValueOf(c)
+	for _, name := range required {
+		if value.FieldByName(name).String() == "" {
+			key := strings.ToLower(string(name[0])) + name[1:]
+			if name == "UUID" {
+				key = "uuid"
+			}
+			problems = append(problems, "missing "+key)
+		}
+	}
+	if c.Port != "" {
+		if _, err := strconv.ParseUint(c.Port, 10, 16); err != nil {
+			problems = append(problems, "invalid port")
+		}
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("Parse conf error: server %s: %s", c.Name, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// UnmarshalPacGroupSection reads a PAC client group, lists it leaves out are
+// taken from common.
+func UnmarshalPacGroupSection(name string, section ini.Section, common CoralConfigCommon) (PacGroup, error) {
+	group := PacGroup{Name: name, Direct: common.PacDirect, Proxy: common.PacProxy}
+	if tmpStr, ok := section["clients"]; ok {
+		if err := json.Unmarshal([]byte(tmpStr), &group.Clients); err != nil {
+			return group, errors.Errorf("Parse conf error: invalid clients of pac group %s", name)
+		}
+	}
+	if len(group.Clients) == 0 {
+		return group, errors.NotFoundf("Parse conf error: clients of pac group %s", name)
+	}
+	if tmpStr, ok := section["direct"]; ok {
+		group.Direct = nil
+		if err := json.Unmarshal([]byte(tmpStr), &group.Direct); err != nil {
+			return group, errors.Errorf("Parse conf error: invalid direct of pac group %s", name)
+		}
+	}
+	if tmpStr, ok := section["proxy"]; ok {
+		group.Proxy = nil
+		if err := json.Unmarshal([]byte(tmpStr), &group.Proxy); err != nil {
+			return group, errors.Errorf("Parse conf error: invalid proxy of pac group %s", name)
+		}
+	}
+	return group, nil
+}
+
+// parseTos accepts the whole ToS byte, in decimal or 0x hex, DSCP is the
+// upper six bits.
+func parseTos(str string) (int, error) {
+	v, err := strconv.ParseInt(str, 0, 0)
+	if err != nil || v < 0 || v > 255 {
+		return 0, errors.NotValidf("tos %s", str)
+	}
+	return int(v), nil
+}
+
+// parsePortRange reads "low-high", a single port is a range of one.
+func parsePortRange(str string) (PortRange, error) {
+	low, high := str, str
+	if i := strings.IndexByte(str, '-'); i >= 0 {
+		low, high = str[:i], str[i+1:]
+	}
+	l, err := strconv.Atoi(strings.TrimSpace(low))
+	if err != nil {
+		return PortRange{}, errors.NotValidf("port range %s", str)
+	}
+	h, err := strconv.Atoi(strings.TrimSpace(high))
+	if err != nil || l < 1 || h > 65535 || l > h {
+		return PortRange{}, errors.NotValidf("port range %s", str)
+	}
+	return PortRange{Low: l, High: h}, nil
+}
+
+// parsePorts reads a comma separated list of ports.
+func parsePorts(str string) ([]int, error) {
+	var ports []int
+	for _, field := range strings.Split(str, ",") {
+		port, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || port < 1 || port > 65535 {
+			return nil, errors.NotValidf("port %s", field)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// parseSourceAddress returns the local IP of str, an IP or the name of an
+// interface whose first address is taken, IPv4 first. The address must be
+// one a socket can bind to.
+func parseSourceAddress(str string) (string, error) {
+	ip := net.ParseIP(str)
+	if ip == nil {
+		iface, err := net.InterfaceByName(str)
+		if err != nil {
+			return "", err
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return "", err
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if ok && (ip == nil || ip.To4() == nil && ipNet.IP.To4() != nil) {
+				ip = ipNet.IP
+			}
+		}
+		if ip == nil {
+			return "", errors.NotFoundf("address of interface %s", str)
+		}
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return "", err
+	}
+	ln.Close()
+	return ip.String(), nil
+}
+
 func GetDefaultConfig() CoralConfig {
 	return CoralConfig{
 		Common: CoralConfigCommon{
-			Host:          "127.0.0.1",
-			Port:          5438,
-			DirectTimeout: time.Second * 600,
-			Whitelist:     map[string]bool{"127.0.0.1": true},
+			Host:                "127.0.0.1",
+			Port:                5438,
+			DirectTimeout:       time.Second * 600,
+			Whitelist:           map[string]bool{"127.0.0.1": true},
+			DeniedLocal:         true,
+			StatsdInterval:      time.Second * 10,
+			Acceptors:           1,
+			CanaryPercent:       5,
+			CanaryErrorPercent:  20,
+			JanitorInterval:     time.Minute,
+			MaxLookups:          32,
+			AllowedSchemes:      []string{"http", "https", "ws", "wss"},
+			ProbeResponse:       "coral",
+			LoadBalance:         "first",
+			AccessLog:           "text",
+			LogMaxSize:          100,
+			PreReadTimeout:      time.Second * 2,
+			MaxHops:             8,
+			DirectParallel:      1,
+			FallbackTTL:         time.Minute * 30,
+			RestartLimit:        5,
+			DrainTimeout:        time.Second * 30,
+			LatencyTarget:       "www.google.com:443",
+			LatencyInterval:     time.Second * 30,
+			HealthThreshold:     5,
+			HealthInterval:      time.Second * 10,
+			BreakerWindow:       time.Minute,
+			BreakerCooldown:     time.Second * 30,
+			CacheTTL:            time.Minute * 30,
+			NegativeCacheTTL:    time.Second * 30,
+			TcpKeepAlive:        time.Second * 15,
+			TcpNoDelay:          true,
+			PacPath:             "/proxy.pac",
+			TunnelAllowed:       true,
+			DialAttempts:        2,
+			DialTimeout:         time.Second * 10,
+			DnsTimeout:          time.Second * 5,
+			DirectPolicy:        "all",
+			RejectStatus:        http.StatusForbidden,
+			ProxyDomainInterval: time.Hour * 24,
+			TunnelAllowedPort:   []int{22, 80, 443, 873, 993, 995, 5222, 5223, 5228, 8080, 8443, 9418},
 		},
-		Servers: map[string]CoralServer{},
+		Servers:   map[string]CoralServer{},
+		PacGroups: map[string]PacGroup{},
 	}
 }
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vaughan0/go-ini"
+)
+
+func TestUnmarshalServerMissingFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		section ini.Section
+		// the problems reported, empty when the server is valid
+		want string
+	}{
+		{"ss", ini.Section{"type": "ss", "host": "a", "port": "1", "method": "aes-256-gcm", "password": "p"}, ""},
+		{"ss-no-host", ini.Section{"type": "ss", "port": "1", "method": "aes-256-gcm", "password": "p"}, "missing host"},
+		{"ss-no-port", ini.Section{"type": "ss", "host": "a", "method": "aes-256-gcm", "password": "p"}, "missing port"},
+		{"ss-no-method", ini.Section{"type": "ss", "host": "a", "port": "1", "password": "p"}, "missing method"},
+		{"ss-no-password", ini.Section{"type": "ss", "host": "a", "port": "1", "method": "aes-256-gcm"}, "missing password"},
+		{"ss-bad-port", ini.Section{"type": "ss", "host": "a", "port": "x", "method": "aes-256-gcm", "password": "p"}, "invalid port"},
+		{"ss-all", ini.Section{"type": "ss"}, "missing host, missing port, missing method, missing password"},
+		{"ssr-no-obfs", ini.Section{"type": "ssr", "host": "a", "port": "1", "method": "m", "password": "p",
+			"obfsParam": "o", "protocol": "origin", "protocolParam": "q"}, "missing obfs"},
+		{"ssr-no-obfsParam", ini.Section{"type": "ssr", "host": "a", "port": "1", "method": "m", "password": "p",
+			"obfs": "plain", "protocol": "origin", "protocolParam": "q"}, "missing obfsParam"},
+		{"ssr-no-protocol", ini.Section{"type": "ssr", "host": "a", "port": "1", "method": "m", "password": "p",
+			"obfs": "plain", "obfsParam": "o", "protocolParam": "q"}, "missing protocol"},
+		{"ssr-no-protocolParam", ini.Section{"type": "ssr", "host": "a", "port": "1", "method": "m", "password": "p",
+			"obfs": "plain", "obfsParam": "o", "protocol": "origin"}, "missing protocolParam"},
+		{"vmess", ini.Section{"type": "vmess", "host": "a", "port": "1", "uuid": "u"}, ""},
+		{"vmess-no-uuid", ini.Section{"type": "vmess", "host": "a", "port": "1"}, "missing uuid"},
+		{"socks5-no-host", ini.Section{"type": "socks5", "port": "1"}, "missing host"},
+		{"http-no-port", ini.Section{"type": "http", "host": "a"}, "missing port"},
+		{"https-all", ini.Section{"type": "https"}, "missing host, missing port"},
+	}
+	for _, tt := range tests {
+		_, err := UnmarshalServerFormSection(tt.name, tt.section)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: no error, want %q", tt.name, tt.want)
+			continue
+		}
+		if want := "server " + tt.name + ": " + tt.want; !strings.HasSuffix(err.Error(), want) {
+			t.Errorf("%s: got %q, want %q", tt.name, err, want)
+		}
+	}
+}
+
+func TestUnmarshalServerErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		section ini.Section
+	}{
+		{"no-type", ini.Section{"host": "a", "port": "1"}},
+		{"unknown-type", ini.Section{"type": "trojan", "host": "a", "port": "1"}},
+		{"password-without-username", ini.Section{"type": "http", "host": "a", "port": "1", "password": "p"}},
+		{"pluginOpts-without-plugin", ini.Section{"type": "ss", "host": "a", "port": "1", "method": "m",
+			"password": "p", "pluginOpts": "o"}},
+	}
+	for _, tt := range tests {
+		if _, err := UnmarshalServerFormSection(tt.name, tt.section); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestServerAddressIPv6(t *testing.T) {
+	for _, host := range []string{"::1", "[::1]"} {
+		s, err := UnmarshalServerFormSection("v6", ini.Section{"type": "ss", "host": host, "port": "8388",
+			"method": "aes-256-gcm", "password": "p"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Address(); got != "[::1]:8388" {
+			t.Errorf("host %s: address %q, want [::1]:8388", host, got)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package core
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/chinaboard/coral/core/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// access log formats
+const (
+	AccessLogText = "text"
+	AccessLogJSON = "json"
+)
+
+// newAccessLogger returns the logger writing one JSON line per request, or
+// nil for the text format, where the routing decision is logged as it is
+// made.
+func newAccessLogger(format string) *log.Logger {
+	if format != AccessLogJSON {
+		return nil
+	}
+	logger := log.New()
+	logger.SetOutput(log.StandardLogger().Out)
+	logger.ReplaceHooks(log.StandardLogger().Hooks)
+	logger.SetFormatter(&log.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	return logger
+}
+
+// logAccess writes the access log line of a finished request, whose meta
+// holds the final upstream and the bytes relayed.
+func (this *httpListener) logAccess(method, host string, meta *RequestMeta) {
+	this.accessLog.WithFields(log.Fields{
+		"id":          meta.ID,
+		"client":      meta.Client,
+		"method":      method,
+		"host":        host,
+		"upstream":    meta.Upstream,
+		"direct":      meta.Direct,
+		"reason":      meta.Reason,
+		"cached":      meta.Cached,
+		"bytes_in":    atomic.LoadInt64(&meta.BytesIn),
+		"bytes_out":   atomic.LoadInt64(&meta.BytesOut),
+		"duration_ms": time.Since(meta.Start).Milliseconds(),
+	}).Info("access")
+}
+
+// logTunnel writes the summary of a closed tunnel in the text format, the
+// JSON line of logAccess already carries it.
+func (this *httpListener) logTunnel(p proxy.Proxy, addr string, d time.Duration, meta *RequestMeta) {
+	if meta == nil {
+		log.Infoln(p.Name(), addr, "tunnel closed after", d.Round(time.Millisecond))
+		return
+	}
+	log.Infof("%s %s %s tunnel closed after %s, %d bytes up, %d bytes down", p.Name(), meta.Client, addr,
+		d.Round(time.Millisecond), atomic.LoadInt64(&meta.BytesOut), atomic.LoadInt64(&meta.BytesIn))
+}
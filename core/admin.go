@@ -0,0 +1,294 @@
+package core
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/chinaboard/coral/config"
+	"github.com/chinaboard/coral/stats"
+	log "github.com/sirupsen/logrus"
+	"github.com/vaughan0/go-ini"
+)
+
+// RouteDecision is the answer of the admin /route endpoint.
+type RouteDecision struct {
+	Host     string `json:"host"`
+	Decision string `json:"decision"`
+	Upstream string `json:"upstream,omitempty"`
+	Reason   string `json:"reason"`
+	Cached   bool   `json:"cached"`
+	// the addresses of the host now, which may differ from those of the
+	// cached decision
+	IPs []string `json:"ips,omitempty"`
+}
+
+// ServerInfo is an upstream in the answer of the admin /servers endpoint.
+type ServerInfo struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Breaker string `json:"breaker"`
+	Weight  int    `json:"weight"`
+	Active  int64  `json:"active"`
+}
+
+// decisions of a RouteDecision
+const (
+	DecisionDirect = "direct"
+	DecisionProxy  = "proxy"
+	DecisionReject = "reject"
+)
+
+// ReasonOverride marks a route override file match.
+const ReasonOverride = "route override"
+
+// admin serves read-only introspection on its own address, never through
+// the proxy listener.
+type admin struct {
+	listener *httpListener
+	srv      *http.Server
+}
+
+func newAdmin(addr string, listener *httpListener) *admin {
+	a := &admin{listener: listener}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/route", a.route)
+	mux.HandleFunc("/stats", a.stats)
+	mux.HandleFunc("/cache", a.cache)
+	mux.HandleFunc("/servers", a.servers)
+	mux.HandleFunc("/servers/", a.server)
+	a.srv = &http.Server{Addr: addr, Handler: mux}
+	return a
+}
+
+func (a *admin) Start() {
+	if a == nil {
+		return
+	}
+	go func() {
+		if err := a.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorln("admin:", err)
+		}
+	}()
+}
+
+func (a *admin) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.srv.Close()
+}
+
+// route answers how a host would be routed now, running the same
+// classification and selection as a request without dialing. A host
+// without port is taken as a tunnel to port 443.
+func (a *admin) route(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	host := strings.TrimSpace(r.URL.Query().Get("host"))
+	if host == "" {
+		http.Error(w, "host is required.", http.StatusBadRequest)
+		return
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "443")
+	}
+	writeJSON(w, a.listener.explain(host))
+}
+
+// stats dumps the counters, including why each upstream was excluded from
+// the selection.
+func (a *admin) stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, stats.Global.Snapshot())
+}
+
+// cache dumps the classifications cached by host:port.
+func (a *admin) cache(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.listener.cache.Entries())
+}
+
+// maxServerBody bounds the JSON of a server added through the admin API.
+const maxServerBody = 64 << 10
+
+// servers lists the upstreams in selection order with their state, or adds
+// one.
+func (a *admin) servers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		a.addServer(w, r)
+		return
+	default:
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	this := a.listener
+	routes := this.routes()
+	list := []ServerInfo{}
+	for _, p := range routes.proxies {
+		if p.Direct() {
+			continue
+		}
+		list = append(list, ServerInfo{
+			Name:    p.Name(),
+			Healthy: this.health.Healthy(p.Name()),
+			Breaker: this.breaker.State(p.Name()),
+			Weight:  routes.weights[p.Name()],
+			Active:  stats.Global.Active(p.Name()),
+		})
+	}
+	writeJSON(w, list)
+}
+
+// addServer registers the server posted as a JSON object with the keys of
+// a server section and its name, e.g. {"name": "ss2", "type": "ss", ...}.
+// With ?check=host:port the server must connect there first.
+func (a *admin) addServer(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(w, r) {
+		return
+	}
+	var fields map[string]interface{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxServerBody)).Decode(&fields); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	section := ini.Section{}
+	for key, value := range fields {
+		switch v := value.(type) {
+		case string:
+			section[key] = v
+		case float64:
+			section[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			section[key] = strconv.FormatBool(v)
+		default:
+			// lists, the JSON of the config file
+			buf, _ := json.Marshal(v)
+			section[key] = string(buf)
+		}
+	}
+	name := section["name"]
+	delete(section, "name")
+	if name == "" || name == "common" {
+		http.Error(w, "name is required.", http.StatusBadRequest)
+		return
+	}
+
+	this := a.listener
+	server, err := config.ParseServer(name, section, this.routes().common)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p, err := this.NewServer(server)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if check := r.URL.Query().Get("check"); check != "" {
+		conn, _, err := dialContext(r.Context(), p, "tcp", check)
+		if err != nil {
+			http.Error(w, "check "+check+": "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn.Close()
+	}
+	if err := this.AddServer(p, server); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// server removes the server of DELETE /servers/{name}.
+func (a *admin) server(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.authorized(w, r) {
+		return
+	}
+	if err := a.listener.RemoveServer(strings.TrimPrefix(r.URL.Path, "/servers/")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorized checks the changes of the admin API like a proxy request:
+// the client must pass allowedClients and the whitelist, and give the HTTP
+// Basic credentials of an account not limited to a listener port. Without
+// accounts no change is allowed, a server added by anyone would see the
+// traffic sent through it.
+func (a *admin) authorized(w http.ResponseWriter, r *http.Request) bool {
+	this := a.listener
+	if !this.auth(w, r) {
+		return false
+	}
+	if len(this.users) == 0 {
+		http.Error(w, "Forbidden, changes need a userPasswd account.", http.StatusForbidden)
+		return false
+	}
+	name, passwd, ok := r.BasicAuth()
+	if ok && this.authUser(name, passwd, 0) {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", proxyRealm)
+	http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+	return false
+}
+
+// explain reports the route of addr.
+func (this *httpListener) explain(addr string) RouteDecision {
+	d := RouteDecision{Host: addr}
+	if this.routes().rejected(hostname(addr)) {
+		d.Decision, d.Reason = DecisionReject, DenyRejected
+		return d
+	}
+	if this.isSelf(addr) {
+		d.Decision, d.Reason = DecisionReject, DenyLoop
+		return d
+	}
+	if this.localDenied(addr) {
+		d.Decision, d.Reason = DecisionReject, DenyLocal
+		return d
+	}
+	c := this.peekClassify(addr)
+	d.Reason, d.Cached = c.reason, c.cached
+	if ips, err := this.resolver.LookupIP(hostname(addr)); err == nil {
+		for _, ip := range ips {
+			d.IPs = append(d.IPs, ip.String())
+		}
+	}
+	if name := this.overrides.Match(hostname(addr)); name != "" && c.reason != ReasonRule {
+		d.Reason = ReasonOverride
+	}
+	p, err := this.peekProxy(addr, this.routes().proxies, c)
+	if err != nil {
+		d.Decision, d.Reason = DecisionReject, err.Error()
+		return d
+	}
+	if this.directDenied(addr, p) {
+		d.Decision, d.Reason = DecisionReject, DenyLocal
+		return d
+	}
+	d.Upstream = p.Name()
+	d.Decision = DecisionProxy
+	if p.Direct() {
+		d.Decision = DecisionDirect
+	}
+	return d
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
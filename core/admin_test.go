@@ -0,0 +1,96 @@
+package core
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chinaboard/coral/cache"
+	"github.com/chinaboard/coral/stats"
+)
+
+// routeListener returns a listener with a server, whose classification
+// lookups only answer IP literals, and the admin API serving it.
+func routeListener(t *testing.T, conf string) (*httpListener, *httptest.Server) {
+	l := newTestListener(t, "directOnly = false\n"+conf+"\n[hk]\ntype = socks5\nhost = 127.0.0.1\nport = 1\n")
+	l.cache = cache.NewCache(time.Hour, 0, func(host string) ([]net.IP, error) {
+		if ip := net.ParseIP(host); ip != nil {
+			return []net.IP{ip}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	})
+	srv := httptest.NewServer(newAdmin("", l).srv.Handler)
+	t.Cleanup(srv.Close)
+	return l, srv
+}
+
+func getRoute(t *testing.T, srv *httptest.Server, host string) RouteDecision {
+	resp, err := http.Get(srv.URL + "/route?host=" + host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var d RouteDecision
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestRouteReadOnly(t *testing.T) {
+	l, srv := routeListener(t, "")
+	l.cache.Classify("8.8.8.8:443")
+	entries := l.cache.Entries()
+	before := stats.Global.Snapshot()
+	time.Sleep(10 * time.Millisecond)
+
+	for _, host := range []string{"8.8.8.8", "114.114.114.114", "unknown.invalid"} {
+		getRoute(t, srv, host)
+	}
+	if after := l.cache.Entries(); !reflect.DeepEqual(after, entries) {
+		t.Errorf("cache changed by /route: %v, was %v", after, entries)
+	}
+	after := stats.Global.Snapshot()
+	if after.CacheHits != before.CacheHits || after.CacheMisses != before.CacheMisses || after.LookupFails != before.LookupFails {
+		t.Errorf("cache counters changed by /route: hits %d->%d, misses %d->%d, lookup failures %d->%d",
+			before.CacheHits, after.CacheHits, before.CacheMisses, after.CacheMisses, before.LookupFails, after.LookupFails)
+	}
+}
+
+func TestRoute(t *testing.T) {
+	_, srv := routeListener(t, "rejectDomains = [\"ads.example.com\"]")
+	tests := []struct {
+		host     string
+		decision string
+		upstream string
+	}{
+		{"114.114.114.114", DecisionDirect, "DIRECT"},
+		{"8.8.8.8", DecisionProxy, "hk"},
+		{"ads.example.com", DecisionReject, ""},
+	}
+	for _, tt := range tests {
+		d := getRoute(t, srv, tt.host)
+		if d.Decision != tt.decision || d.Upstream != tt.upstream {
+			t.Errorf("route %s = %s via %q (%s), want %s via %q", tt.host, d.Decision, d.Upstream, d.Reason, tt.decision, tt.upstream)
+		}
+	}
+	if d := getRoute(t, srv, "ads.example.com"); d.Reason != DenyRejected {
+		t.Errorf("rejected reason = %q, want %q", d.Reason, DenyRejected)
+	}
+}
+
+func TestRouteNeedsHost(t *testing.T) {
+	_, srv := routeListener(t, "")
+	resp, err := http.Get(srv.URL + "/route?host=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("empty host status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
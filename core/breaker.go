@@ -0,0 +1,148 @@
+package core
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chinaboard/coral/core/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// states of a circuit
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// breaker opens the circuit of an upstream after threshold failures within
+// window, which leaves it out of the selection. After cooldown a single trial
+// request may use it: success closes the circuit, failure opens it again.
+type breaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	servers   sync.Map // name -> *circuit
+	webhook   *webhook
+}
+
+type circuit struct {
+	sync.Mutex
+	state string
+	// times of the failures within the window, oldest first
+	failures []time.Time
+	// when the circuit opened, or when the trial was let through
+	since time.Time
+}
+
+func newBreaker(threshold int, window, cooldown time.Duration, webhook *webhook) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &breaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		webhook:   webhook,
+	}
+}
+
+func (b *breaker) get(name string) *circuit {
+	if v, ok := b.servers.Load(name); ok {
+		return v.(*circuit)
+	}
+	v, _ := b.servers.LoadOrStore(name, &circuit{state: BreakerClosed})
+	return v.(*circuit)
+}
+
+// Report records the outcome of a dial through the upstream.
+func (b *breaker) Report(p proxy.Proxy, err error) {
+	if b == nil || p.Direct() {
+		return
+	}
+	c := b.get(p.Name())
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	if err == nil {
+		if c.state != BreakerClosed {
+			log.Infof("server %s breaker closed", p.Name())
+		}
+		c.state = BreakerClosed
+		c.failures = nil
+		return
+	}
+	switch c.state {
+	case BreakerHalfOpen:
+		log.Warnf("server %s breaker open again, trial failed: %v", p.Name(), err)
+		c.state = BreakerOpen
+		c.since = now
+	case BreakerClosed:
+		c.failures = append(c.failures, now)
+		for len(c.failures) > 0 && now.Sub(c.failures[0]) > b.window {
+			c.failures = c.failures[1:]
+		}
+		if len(c.failures) >= b.threshold {
+			log.Warnf("server %s breaker open after %d failures in %s: %v", p.Name(), len(c.failures), b.window, err)
+			c.state = BreakerOpen
+			c.since = now
+			c.failures = nil
+			b.webhook.Notify(p.Name(), ExcludeBreakerOpen)
+		}
+	}
+}
+
+// Exclude is the ExcludeFunc leaving upstreams with an open circuit out. Once
+// the cooldown is over it lets one request through, and another one should
+// that request not report back within a cooldown, e.g. because a different
+// server was chosen for it.
+func (b *breaker) Exclude(p proxy.Proxy) string {
+	c := b.get(p.Name())
+	c.Lock()
+	defer c.Unlock()
+	switch {
+	case c.state == BreakerClosed:
+		return ""
+	case time.Since(c.since) < b.cooldown:
+		return ExcludeBreakerOpen
+	}
+	c.state = BreakerHalfOpen
+	c.since = time.Now()
+	return ""
+}
+
+// Peek is Exclude leaving the circuit as it is: past the cooldown the trial
+// would be let through, which it doesn't use up.
+func (b *breaker) Peek(p proxy.Proxy) string {
+	c := b.get(p.Name())
+	c.Lock()
+	defer c.Unlock()
+	if c.state != BreakerClosed && time.Since(c.since) < b.cooldown {
+		return ExcludeBreakerOpen
+	}
+	return ""
+}
+
+// State returns the state of the circuit of the upstream name.
+func (b *breaker) State(name string) string {
+	if b == nil {
+		return BreakerClosed
+	}
+	c := b.get(name)
+	c.Lock()
+	defer c.Unlock()
+	return c.state
+}
+
+// BreakerStatus returns the circuit state of each upstream, every one is
+// closed when the breaker is off.
+func (this *httpListener) BreakerStatus() map[string]string {
+	proxies := this.routes().proxies
+	status := map[string]string{}
+	for _, p := range proxies {
+		if !p.Direct() {
+			status[p.Name()] = this.breaker.State(p.Name())
+		}
+	}
+	return status
+}
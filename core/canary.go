@@ -0,0 +1,56 @@
+package core
+
+import (
+	"math/rand"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// a canary is judged only after this many dials
+const canaryMinDials = 20
+
+// canary sends a fraction of the proxied traffic to one upstream and stops
+// doing so once its dial error rate is above the threshold.
+type canary struct {
+	name      string
+	percent   int
+	threshold int
+	dials     uint64
+	failures  uint64
+	stopped   int32
+	// intn draws the picks, rand.Intn
+	intn func(n int) int
+}
+
+func newCanary(name string, percent, threshold int) *canary {
+	if name == "" || percent <= 0 {
+		return nil
+	}
+	return &canary{name: name, percent: percent, threshold: threshold, intn: rand.Intn}
+}
+
+func (c *canary) Stopped() bool {
+	return atomic.LoadInt32(&c.stopped) != 0
+}
+
+func (c *canary) pick() bool {
+	return atomic.LoadInt32(&c.stopped) == 0 && c.intn(100) < c.percent
+}
+
+// report records a dial and returns true when it stops the canary.
+func (c *canary) report(err error) bool {
+	dials := atomic.AddUint64(&c.dials, 1)
+	failures := atomic.LoadUint64(&c.failures)
+	if err != nil {
+		failures = atomic.AddUint64(&c.failures, 1)
+	}
+	if dials < canaryMinDials || c.threshold <= 0 {
+		return false
+	}
+	if failures*100 > dials*uint64(c.threshold) && atomic.CompareAndSwapInt32(&c.stopped, 0, 1) {
+		log.Warnf("canary %s stopped, %d of %d dials failed", c.name, failures, dials)
+		return true
+	}
+	return false
+}
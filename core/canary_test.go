@@ -0,0 +1,59 @@
+package core
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestCanaryPick(t *testing.T) {
+	c := newCanary("hk", 10, 50)
+	c.intn = rand.New(rand.NewSource(1)).Intn
+	const n = 10000
+	picked := 0
+	for i := 0; i < n; i++ {
+		if c.pick() {
+			picked++
+		}
+	}
+	if picked < n*8/100 || picked > n*12/100 {
+		t.Errorf("picked %d of %d, want about 10%%", picked, n)
+	}
+}
+
+func TestCanaryStops(t *testing.T) {
+	c := newCanary("hk", 100, 50)
+	failed := errors.New("refused")
+	// failing from the start, it is judged only after canaryMinDials
+	for i := 1; i < canaryMinDials; i++ {
+		if c.report(failed) || c.Stopped() {
+			t.Fatalf("stopped after %d dials", i)
+		}
+	}
+	if !c.report(failed) {
+		t.Fatalf("not stopped after %d failed dials", canaryMinDials)
+	}
+	if c.pick() {
+		t.Error("a stopped canary is picked")
+	}
+	if c.report(failed) {
+		t.Error("stopped twice")
+	}
+}
+
+func TestCanaryBelowThreshold(t *testing.T) {
+	c := newCanary("hk", 100, 50)
+	for i := 0; i < 2*canaryMinDials; i++ {
+		var err error
+		// 40% failures
+		if i%5 < 2 {
+			err = errors.New("refused")
+		}
+		if c.report(err) {
+			t.Fatalf("stopped after %d dials below the threshold", i+1)
+		}
+	}
+	if !c.pick() {
+		t.Error("a running canary at 100% isn't picked")
+	}
+}
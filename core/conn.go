@@ -0,0 +1,244 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chinaboard/coral/stats"
+	log "github.com/sirupsen/logrus"
+)
+
+// firstByteConn reports the time from its creation until the first byte is
+// read from the wrapped connection.
+type firstByteConn struct {
+	net.Conn
+	once    sync.Once
+	start   time.Time
+	observe func(time.Duration)
+}
+
+func newFirstByteConn(conn net.Conn, observe func(time.Duration)) *firstByteConn {
+	return &firstByteConn{Conn: conn, start: time.Now(), observe: observe}
+}
+
+func (c *firstByteConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.once.Do(func() {
+			c.observe(time.Since(c.start))
+		})
+	}
+	return n, err
+}
+
+func (c *firstByteConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// meteredConn adds the bytes it carries to the upstream's counter as they
+// flow, so long tunnels show up before they close.
+type meteredConn struct {
+	net.Conn
+	name string
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	stats.Global.AddBytes(c.name, int64(n))
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	stats.Global.AddBytes(c.name, int64(n))
+	return n, err
+}
+
+func (c *meteredConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// wrappedConn is a conn wrapping another one, which Pipe may bypass for a
+// zero-copy relay, telling it the bytes it carried instead.
+type wrappedConn interface {
+	unwrap() net.Conn
+	count(n int64)
+}
+
+func (c *firstByteConn) unwrap() net.Conn {
+	return c.Conn
+}
+
+func (c *firstByteConn) count(n int64) {
+	if n > 0 {
+		c.once.Do(func() {
+			c.observe(time.Since(c.start))
+		})
+	}
+}
+
+func (c *meteredConn) unwrap() net.Conn {
+	return c.Conn
+}
+
+func (c *meteredConn) count(n int64) {
+	stats.Global.AddBytes(c.name, n)
+}
+
+// spliceChunk is how much a zero-copy relay moves before reporting to the
+// wrappers of its conns.
+const spliceChunk = 1 << 20
+
+// tcpConn returns the TCP connection under the wrappers of c.
+func tcpConn(c net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch conn := c.(type) {
+		case *net.TCPConn:
+			return conn, true
+		case wrappedConn:
+			c = conn.unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// counted reports n bytes to the wrappers of c.
+func counted(c net.Conn, n int64) {
+	for {
+		conn, ok := c.(wrappedConn)
+		if !ok {
+			return
+		}
+		conn.count(n)
+		c = conn.unwrap()
+	}
+}
+
+// spliceConn copies src to dst until EOF like io.Copy, which lets the kernel
+// move the data (splice(2) on Linux) when both are TCP connections. ok is
+// false when they are not and nothing was copied.
+func spliceConn(dst, src net.Conn) (written int64, err error, ok bool) {
+	rSrc, ok := tcpConn(src)
+	if !ok {
+		return 0, nil, false
+	}
+	rDst, ok := tcpConn(dst)
+	if !ok {
+		return 0, nil, false
+	}
+	for {
+		n, err := rDst.ReadFrom(&io.LimitedReader{R: rSrc, N: spliceChunk})
+		written += n
+		counted(src, n)
+		counted(dst, n)
+		// a short chunk without an error is EOF
+		if err != nil || n < spliceChunk {
+			return written, err, true
+		}
+	}
+}
+
+// idleWatch closes a tunnel once neither of its conns has read anything for
+// timeout. Its conns hide the TCP connections, so Pipe keeps reading them
+// and sees the traffic. The janitor checks the watches of all tunnels.
+type idleWatch struct {
+	timeout time.Duration
+	// UnixNano of the last read
+	last  int64
+	meta  *RequestMeta
+	conns []net.Conn
+}
+
+func newIdleWatch(timeout time.Duration, meta *RequestMeta) *idleWatch {
+	return &idleWatch{timeout: timeout, last: time.Now().UnixNano(), meta: meta}
+}
+
+func (w *idleWatch) wrap(conn net.Conn) net.Conn {
+	conn = &idleConn{Conn: conn, watch: w}
+	w.conns = append(w.conns, conn)
+	return conn
+}
+
+// reap closes the conns when the tunnel idles, which ends both directions
+// of the relay, and reports whether it did.
+func (w *idleWatch) reap(now time.Time) bool {
+	idle := now.Sub(time.Unix(0, atomic.LoadInt64(&w.last)))
+	if idle < w.timeout {
+		return false
+	}
+	if w.meta != nil {
+		log.Infoln(w.meta.ID, w.meta.Client, "tunnel idle for", idle.Round(time.Millisecond), "closed")
+	}
+	for _, conn := range w.conns {
+		conn.Close()
+	}
+	return true
+}
+
+type idleConn struct {
+	net.Conn
+	watch *idleWatch
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.watch.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *idleConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// clientWatch notices a client closing its connection while it waits for
+// its tunnel. The bytes it reads meanwhile are kept for the tunnel.
+type clientWatch struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	done   chan struct{}
+	cancel context.CancelFunc
+}
+
+// watchClient returns the watch of conn and a context canceled when the
+// client is gone.
+func watchClient(parent context.Context, conn net.Conn) (*clientWatch, context.Context) {
+	ctx, cancel := context.WithCancel(parent)
+	w := &clientWatch{conn: conn, r: bufio.NewReader(conn), done: make(chan struct{}), cancel: cancel}
+	go func() {
+		defer close(w.done)
+		if _, err := w.r.Peek(1); err != nil && !isTimeout(err) {
+			cancel()
+		}
+	}()
+	return w, ctx
+}
+
+// stop ends the watch and returns the conn to relay, which holds what the
+// client sent early.
+func (w *clientWatch) stop() net.Conn {
+	w.conn.SetReadDeadline(time.Unix(1, 0))
+	<-w.done
+	w.conn.SetReadDeadline(time.Time{})
+	w.cancel()
+	if w.r.Buffered() > 0 {
+		return &peekedConn{Conn: w.conn, r: w.r}
+	}
+	return w.conn
+}
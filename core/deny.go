@@ -0,0 +1,92 @@
+package core
+
+import (
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/chinaboard/coral/core/proxy"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// reasons recorded in the deny log
+const (
+	DenyClientNotAllowed = "client-not-allowed"
+	DenyBadRequest       = "bad-request"
+	DenyFiltered         = "filtered"
+	DenyLocalRedirect    = "local-redirect"
+	DenyLocal            = "local-address"
+	DenyLoop             = "loop"
+	DenyUnauthenticated  = "unauthenticated"
+	DenyPortNotAllowed   = "port-not-allowed"
+	DenyRejected         = "rejected"
+	DenyTooMany          = "too-many-connections"
+)
+
+// localDenied tells whether addr is a literal local address clients may
+// not reach. Names aren't resolved here, most go to an upstream resolving
+// them itself: directDenied checks them once routed direct, and the direct
+// dialer refuses the address it actually dials.
+func (this *httpListener) localDenied(addr string) bool {
+	if this.denyLocal == nil {
+		return false
+	}
+	ip := net.ParseIP(hostname(addr))
+	return ip != nil && this.denyLocal(ip)
+}
+
+// directDenied tells whether addr, routed to p, resolves to a local address
+// clients may not reach. Only the direct route is checked, and every address
+// of the name: one local address among public ones is enough, the dial may
+// pick any of them.
+func (this *httpListener) directDenied(addr string, p proxy.Proxy) bool {
+	if this.denyLocal == nil || !p.Direct() {
+		return false
+	}
+	// a name that doesn't resolve here fails the direct dial as well
+	ips, err := this.resolver.LookupIP(hostname(addr))
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if this.denyLocal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newDenyLogger returns the logger for rejected requests, the standard
+// logger unless a separate file is configured.
+func newDenyLogger(path string) (*log.Logger, error) {
+	if path == "" {
+		return log.StandardLogger(), nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Annotate(err, "open deny log")
+	}
+	logger := log.New()
+	logger.SetOutput(file)
+	logger.SetFormatter(log.StandardLogger().Formatter)
+	return logger, nil
+}
+
+func (this *httpListener) deny(r *http.Request, target, reason string) {
+	this.denyAddr(r.RemoteAddr, r.Method, target, reason)
+}
+
+// denyAddr logs a rejection of a client that isn't an HTTP request.
+func (this *httpListener) denyAddr(remoteAddr, method, target, reason string) {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+	this.denyLog.WithFields(log.Fields{
+		"client": ip,
+		"method": method,
+		"target": target,
+		"reason": reason,
+	}).Warnln("denied")
+}
@@ -0,0 +1,79 @@
+package core
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalDenied(t *testing.T) {
+	l := newTestListener(t, "deniedLocal = true\nallowedLocal = 10.1.0.0/16")
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:80", true},
+		{"[::1]:443", true},
+		{"192.168.1.1:80", true},
+		{"10.1.2.3:80", false},
+		{"8.8.8.8:53", false},
+		// names are left to the route, see TestDirectDenied
+		{"localhost:80", false},
+	}
+	for _, tt := range tests {
+		if got := l.localDenied(tt.addr); got != tt.want {
+			t.Errorf("localDenied(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestDirectDenied(t *testing.T) {
+	l := newTestListener(t, "deniedLocal = true")
+	direct, upstream := &stubProxy{name: "direct", direct: true}, &stubProxy{name: "hk"}
+	if !l.directDenied("localhost:80", direct) {
+		t.Error("a name of a local address is allowed direct")
+	}
+	if l.directDenied("localhost:80", upstream) {
+		t.Error("a name resolved by the upstream is denied")
+	}
+	if l.directDenied("8.8.8.8:53", direct) {
+		t.Error("a public address is denied direct")
+	}
+}
+
+func TestDenyLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deny.log")
+	l := newTestListener(t, "deniedLocal = true\nrejectDomains = [\"ads.example.com\"]\ndenyLog = "+path)
+	tests := []struct {
+		method, target string
+		reason         string
+	}{
+		{"GET", "http://ads.example.com/banner", DenyRejected},
+		{"GET", "http://127.0.0.1:8080/", DenyLocal},
+		{"CONNECT", "example.com:25", DenyPortNotAllowed},
+		{"CONNECT", "127.0.0.1:22", DenyLocal},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.method == "CONNECT" {
+			r.RequestURI = tt.target
+		}
+		l.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != len(tests) {
+		t.Fatalf("%d deny log lines for %d rejections:\n%s", len(lines), len(tests), b)
+	}
+	for i, tt := range tests {
+		if !strings.Contains(lines[i], "reason="+tt.reason) || !strings.Contains(lines[i], "client=192.0.2.1") {
+			t.Errorf("deny log line %q, want client 192.0.2.1 and reason %s", lines[i], tt.reason)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package core
+
+import (
+	"net"
+
+	"github.com/chinaboard/coral/core/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// dialFields describes a dial through p for the log. Direct dials carry the
+// IP actually connected to, or attempted when the dial failed, so a poisoned
+// DNS answer shows up. Upstreams resolve the hostname themselves, the IP is
+// then "remote".
+func dialFields(p proxy.Proxy, addr string, conn net.Conn, err error) log.Fields {
+	fields := log.Fields{
+		"upstream": p.Name(),
+		"target":   addr,
+	}
+	host := hostname(addr)
+	switch {
+	case net.ParseIP(host) != nil:
+		fields["ip"] = host
+	case !p.Direct():
+		fields["ip"] = "remote"
+	case conn != nil:
+		fields["ip"] = hostname(conn.RemoteAddr().String())
+	default:
+		fields["ip"] = "unresolved"
+		if opErr, ok := err.(*net.OpError); ok && opErr.Addr != nil {
+			fields["ip"] = hostname(opErr.Addr.String())
+		}
+	}
+	return fields
+}
+
+// logDial logs the outcome of a dial through p.
+func logDial(p proxy.Proxy, addr string, conn net.Conn, err error) {
+	entry := log.WithFields(dialFields(p, addr, conn, err))
+	if err != nil {
+		entry.Errorln("dial:", err)
+		return
+	}
+	entry.Debugln("dial")
+}
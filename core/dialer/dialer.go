@@ -0,0 +1,152 @@
+package dialer
+
+import (
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/juju/errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Options describes how outbound sockets are created, shared by the direct
+// proxy and every upstream type.
+type Options struct {
+	Timeout time.Duration
+	// Tos is the IP_TOS / IPV6_TCLASS byte, DSCP << 2. Zero leaves the
+	// socket unmarked.
+	Tos int
+	// ReadBuffer and WriteBuffer set SO_RCVBUF / SO_SNDBUF before connect,
+	// zero keeps the OS default.
+	ReadBuffer  int
+	WriteBuffer int
+	// SourcePorts binds outbound sockets to a local port in [Low, High],
+	// zero values leave the choice to the OS. A port is in use until its
+	// connection has left TIME_WAIT.
+	SourcePorts PortRange
+	// SourceIP binds outbound sockets to a local address, nil leaves the
+	// choice to the routing table.
+	SourceIP net.IP
+	// Mark is the SO_MARK fwmark for policy routing (linux), zero leaves
+	// the socket unmarked.
+	Mark int
+	// KeepAlive is the period of TCP keepalive probes, negative disables
+	// them and zero is the Go default.
+	KeepAlive time.Duration
+	// Deny refuses to connect to the addresses it returns true for, it sees
+	// the IP actually dialed whatever name it was resolved from.
+	Deny func(ip net.IP) bool
+}
+
+type PortRange struct {
+	Low, High int
+}
+
+// ErrPortsExhausted is returned when every port of the source range is in
+// use.
+var ErrPortsExhausted = errors.New("source port range exhausted")
+
+// ErrDenied is returned for a connection to an address Options.Deny refuses.
+var ErrDenied = errors.New("destination address denied")
+
+type control func(network string, fd uintptr) error
+
+func New(opts Options) *net.Dialer {
+	d := &net.Dialer{Timeout: opts.Timeout, KeepAlive: opts.KeepAlive}
+	// with a port range the address is bound along with the port
+	if opts.SourceIP != nil && (opts.SourcePorts.Low == 0 || !sockoptSupported) {
+		d.LocalAddr = &net.TCPAddr{IP: opts.SourceIP}
+	}
+
+	controls := []control{}
+	if opts.Tos > 0 {
+		if sockoptSupported {
+			tos := opts.Tos
+			controls = append(controls, func(network string, fd uintptr) error {
+				return setTos(network, fd, tos)
+			})
+		} else {
+			log.Warningln("tos marking is not supported on this platform")
+		}
+	}
+	if opts.ReadBuffer > 0 || opts.WriteBuffer > 0 {
+		if sockoptSupported {
+			read, write := opts.ReadBuffer, opts.WriteBuffer
+			controls = append(controls, func(network string, fd uintptr) error {
+				return setBuffers(fd, read, write)
+			})
+		} else {
+			log.Warningln("socket buffer sizes are not supported on this platform")
+		}
+	}
+	if opts.Mark != 0 {
+		if markSupported {
+			mark := opts.Mark
+			controls = append(controls, func(network string, fd uintptr) error {
+				return setMark(fd, mark)
+			})
+		} else {
+			log.Warningln("socket mark is not supported on this platform")
+		}
+	}
+	if opts.SourcePorts.Low > 0 {
+		if sockoptSupported {
+			ports := &portPicker{PortRange: opts.SourcePorts, ip: opts.SourceIP}
+			controls = append(controls, ports.bind)
+		} else {
+			log.Warningln("source port range is not supported on this platform")
+		}
+	}
+
+	if len(controls) > 0 || opts.Deny != nil {
+		deny := opts.Deny
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			if deny != nil {
+				host, _, _ := net.SplitHostPort(address)
+				if ip := net.ParseIP(host); ip != nil && deny(ip) {
+					return ErrDenied
+				}
+			}
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				for _, f := range controls {
+					if serr = f(network, fd); serr != nil {
+						return
+					}
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+	return d
+}
+
+// portPicker hands out the ports of a range in turn, skipping those in use.
+type portPicker struct {
+	PortRange
+	ip   net.IP
+	next uint32
+}
+
+func (p *portPicker) bind(network string, fd uintptr) error {
+	size := p.High - p.Low + 1
+	// the counter wraps, reduced in uint32 the offset never goes negative
+	// where int is 32 bits
+	start := int(atomic.AddUint32(&p.next, 1) % uint32(size))
+	for i := 0; i < size; i++ {
+		port := p.Low + (start+i)%size
+		err := bindPort(network, fd, p.ip, port)
+		if err == nil {
+			return nil
+		}
+		if !isAddrInUse(err) {
+			return err
+		}
+	}
+	return ErrPortsExhausted
+}
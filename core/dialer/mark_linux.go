@@ -0,0 +1,14 @@
+//go:build linux
+// +build linux
+
+package dialer
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const markSupported = true
+
+func setMark(fd uintptr, mark int) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+}
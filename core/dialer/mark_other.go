@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package dialer
+
+const markSupported = false
+
+func setMark(fd uintptr, mark int) error {
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package dialer
+
+import (
+	"net"
+)
+
+const sockoptSupported = false
+
+func setTos(network string, fd uintptr, tos int) error {
+	return nil
+}
+
+func setBuffers(fd uintptr, read, write int) error {
+	return nil
+}
+
+func bindPort(network string, fd uintptr, ip net.IP, port int) error {
+	return nil
+}
+
+func isAddrInUse(err error) bool {
+	return false
+}
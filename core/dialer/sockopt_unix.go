@@ -0,0 +1,49 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package dialer
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+const sockoptSupported = true
+
+func setTos(network string, fd uintptr, tos int) error {
+	switch network {
+	case "tcp6", "udp6":
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+}
+
+func setBuffers(fd uintptr, read, write int) error {
+	if read > 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, read); err != nil {
+			return err
+		}
+	}
+	if write > 0 {
+		return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, write)
+	}
+	return nil
+}
+
+// bindPort binds the socket to port on ip, or on any address for a nil ip.
+func bindPort(network string, fd uintptr, ip net.IP, port int) error {
+	switch network {
+	case "tcp6", "udp6":
+		sa := &unix.SockaddrInet6{Port: port}
+		copy(sa.Addr[:], ip.To16())
+		return unix.Bind(int(fd), sa)
+	}
+	sa := &unix.SockaddrInet4{Port: port}
+	copy(sa.Addr[:], ip.To4())
+	return unix.Bind(int(fd), sa)
+}
+
+func isAddrInUse(err error) bool {
+	return err == unix.EADDRINUSE
+}
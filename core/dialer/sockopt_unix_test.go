@@ -0,0 +1,111 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package dialer
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// listen returns a loopback listener of network accepting in the
+// background, skipping the test where the network isn't available.
+func listen(t *testing.T, network, addr string) net.Listener {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		t.Skip(network, "unavailable:", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return ln
+}
+
+// sockopt reads an integer option of conn.
+func sockopt(t *testing.T, conn net.Conn, level, opt int) int {
+	raw, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var serr error
+	raw.Control(func(fd uintptr) {
+		v, serr = unix.GetsockoptInt(int(fd), level, opt)
+	})
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return v
+}
+
+func TestTos(t *testing.T) {
+	const tos = 46 << 2 // EF
+	tests := []struct {
+		network, addr string
+		level, opt    int
+	}{
+		{"tcp4", "127.0.0.1:0", unix.IPPROTO_IP, unix.IP_TOS},
+		{"tcp6", "[::1]:0", unix.IPPROTO_IPV6, unix.IPV6_TCLASS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			ln := listen(t, tt.network, tt.addr)
+			conn, err := New(Options{Tos: tos}).Dial(tt.network, ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := sockopt(t, conn, tt.level, tt.opt); got != tos {
+				t.Errorf("tos %#x, want %#x", got, tos)
+			}
+		})
+	}
+}
+
+func TestSourcePorts(t *testing.T) {
+	ln := listen(t, "tcp4", "127.0.0.1:0")
+	// a range of free ports next to one
+	probe, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	low := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+	ports := PortRange{Low: low, High: low + 2}
+	d := New(Options{SourcePorts: ports, SourceIP: net.ParseIP("127.0.0.1")})
+
+	used := map[int]bool{}
+	for i := 0; ; i++ {
+		conn, err := d.Dial("tcp4", ln.Addr().String())
+		if err != nil {
+			// a port of the range taken by someone else only ends it sooner
+			if !errors.Is(err, ErrPortsExhausted) {
+				t.Fatalf("dial %d: %v, want %v", i, err, ErrPortsExhausted)
+			}
+			break
+		}
+		defer conn.Close()
+		port := conn.LocalAddr().(*net.TCPAddr).Port
+		if port < ports.Low || port > ports.High || used[port] {
+			t.Fatalf("dial %d from port %d, want a free one in %d-%d", i, port, ports.Low, ports.High)
+		}
+		used[port] = true
+		if i > ports.High-ports.Low {
+			t.Fatal("more connections than ports")
+		}
+	}
+	if len(used) == 0 {
+		t.Error("no dial from the range")
+	}
+}
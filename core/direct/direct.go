@@ -1,25 +1,146 @@
 package direct
 
 import (
+	"context"
 	"net"
+	"net/http"
 	"time"
 
 	"github.com/chinaboard/coral/core/proxy"
+	"github.com/juju/errors"
 )
 
+// Resolver looks up the addresses of a host, net.DefaultResolver is one.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
 type DirectProxy struct {
 	Timeout time.Duration
+	Dialer  *net.Dialer
+	// Parallel is the number of resolved IPs dialed at the same time, the
+	// first connection established wins
+	Parallel int
+	// Resolver replaces the system resolver when set
+	Resolver  Resolver
+	transport *http.Transport
 }
 
-func New(timeout time.Duration) proxy.Proxy {
-	return &DirectProxy{Timeout: timeout}
+func New(timeout time.Duration, dialer *net.Dialer, parallel int, resolver Resolver) proxy.Proxy {
+	p := &DirectProxy{
+		Timeout:  timeout,
+		Dialer:   dialer,
+		Parallel: parallel,
+		Resolver: resolver,
+	}
+	// shared by plain HTTP requests so keep-alive connections to the
+	// same host are reused, CONNECT tunnels always dial their own
+	p.transport = &http.Transport{
+		DialContext:     p.DialContext,
+		MaxIdleConns:    100,
+		IdleConnTimeout: timeout,
+	}
+	return p
 }
 
 func (this *DirectProxy) Dial(network, addr string) (net.Conn, time.Duration, error) {
-	conn, err := net.DialTimeout(network, addr, this.Timeout)
+	conn, err := this.DialContext(context.Background(), network, addr)
 	return conn, this.Timeout, err
 }
 
+func (this *DirectProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || (this.Parallel <= 1 && this.Resolver == nil) || net.ParseIP(host) != nil {
+		return this.Dialer.DialContext(ctx, network, addr)
+	}
+	resolver := this.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	resolveCtx := ctx
+	if this.Dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		resolveCtx, cancel = context.WithTimeout(ctx, this.Dialer.Timeout)
+		defer cancel()
+	}
+	ips, err := resolver.LookupIPAddr(resolveCtx, host)
+	if err != nil {
+		return nil, err
+	}
+	if this.Parallel <= 1 {
+		return this.dialSerial(ctx, network, port, ips)
+	}
+	if len(ips) > this.Parallel {
+		ips = ips[:this.Parallel]
+	}
+	if len(ips) == 1 {
+		return this.Dialer.DialContext(ctx, network, net.JoinHostPort(ips[0].String(), port))
+	}
+	return this.dialParallel(ctx, network, port, ips)
+}
+
+// dialSerial dials the ips in turn until one connects.
+func (this *DirectProxy) dialSerial(ctx context.Context, network, port string, ips []net.IPAddr) (net.Conn, error) {
+	var firstErr error
+	for _, ip := range ips {
+		conn, err := this.Dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Trace(firstErr)
+}
+
+// dialParallel races the dials to every ip, the losers are cancelled or
+// closed once one connection is established.
+func (this *DirectProxy) dialParallel(ctx context.Context, network, port string, ips []net.IPAddr) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	for _, ip := range ips {
+		go func(ip net.IPAddr) {
+			conn, err := this.Dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			results <- result{conn, err}
+		}(ip)
+	}
+
+	var firstErr error
+	for i := range ips {
+		res := <-results
+		if res.err == nil {
+			// the remaining dials are cancelled, close those that won anyway
+			go func(n int) {
+				for ; n > 0; n-- {
+					if late := <-results; late.conn != nil {
+						late.conn.Close()
+					}
+				}
+			}(len(ips) - i - 1)
+			return res.conn, nil
+		}
+		if firstErr == nil {
+			firstErr = res.err
+		}
+	}
+	return nil, errors.Trace(firstErr)
+}
+
+func (this *DirectProxy) Transport() http.RoundTripper {
+	return this.transport
+}
+
 func (this *DirectProxy) Name() string {
 	return "DIRECT"
 }
@@ -0,0 +1,68 @@
+package direct
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/juju/errors"
+)
+
+// DialUDP opens an unconnected UDP socket, datagrams to a hostname go to
+// its first resolved address.
+func (this *DirectProxy) DialUDP() (net.PacketConn, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &packetConn{UDPConn: conn, proxy: this}, nil
+}
+
+type packetConn struct {
+	*net.UDPConn
+	proxy *DirectProxy
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		return c.UDPConn.WriteTo(b, udp)
+	}
+	udp, err := c.proxy.resolveUDP(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	return c.UDPConn.WriteTo(b, udp)
+}
+
+func (this *DirectProxy) resolveUDP(addr string) (*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, errors.NotValidf("port %q", portStr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+	}
+
+	resolver := this.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx := context.Background()
+	if this.Dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, this.Dialer.Timeout)
+		defer cancel()
+	}
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, errors.NotFoundf("address of %s", host)
+	}
+	return &net.UDPAddr{IP: ips[0].IP, Zone: ips[0].Zone, Port: int(port)}, nil
+}
@@ -0,0 +1,156 @@
+package core
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chinaboard/coral/utils"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// bounds a download of the proxy domain list
+	domainListTimeout = 30 * time.Second
+	domainListMaxSize = 16 << 20
+)
+
+// proxyDomains are always connected through a server. The configured
+// domains are joined by those of a list downloaded from url, e.g. the
+// gfwlist, now and every interval. The last good download is kept in file,
+// so the domains are known before the first download or when it fails.
+type proxyDomains struct {
+	local    []string
+	url      string
+	file     string
+	interval time.Duration
+	client   *http.Client
+	list     atomic.Value // utils.DomainList
+	done     chan struct{}
+	once     sync.Once
+}
+
+// newProxyDomains returns nil when there are neither domains nor url. The
+// list is downloaded through dial.
+func newProxyDomains(local []string, url, file string, interval time.Duration,
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)) *proxyDomains {
+	if len(local) == 0 && url == "" {
+		return nil
+	}
+	d := &proxyDomains{
+		local:    local,
+		url:      url,
+		file:     file,
+		interval: interval,
+		client: &http.Client{
+			Timeout:   domainListTimeout,
+			Transport: &http.Transport{DialContext: dial},
+		},
+		done: make(chan struct{}),
+	}
+	var saved []string
+	if file != "" {
+		if buf, err := ioutil.ReadFile(file); err == nil {
+			saved = utils.ParseGfwList(buf)
+		} else if !os.IsNotExist(err) {
+			log.Warnln("proxy domain list:", err)
+		}
+	}
+	d.store(saved)
+	return d
+}
+
+func (d *proxyDomains) store(downloaded []string) {
+	list := utils.NewDomainList(append(downloaded, d.local...))
+	d.list.Store(list)
+	log.Infoln("proxy domain list,", len(list), "domains")
+}
+
+// Start downloads the list now and every interval.
+func (d *proxyDomains) Start() {
+	if d == nil || d.url == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+		for {
+			if err := d.refresh(); err != nil {
+				log.Warnln("proxy domain list download, keep the previous list:", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-d.done:
+				return
+			}
+		}
+	}()
+}
+
+func (d *proxyDomains) Stop() {
+	if d == nil {
+		return
+	}
+	d.once.Do(func() {
+		close(d.done)
+	})
+}
+
+func (d *proxyDomains) refresh() error {
+	resp, err := d.client.Get(d.url)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected status %s", resp.Status)
+	}
+	buf, err := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: domainListMaxSize})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	domains := utils.ParseGfwList(buf)
+	if len(domains) == 0 {
+		return errors.New("no domains in the list")
+	}
+	d.store(domains)
+	if d.file != "" {
+		if err := writeFileAtomic(d.file, buf); err != nil {
+			log.Warnln("save proxy domain list:", err)
+		}
+	}
+	return nil
+}
+
+// Match reports whether host is one of the domains or their subdomains.
+func (d *proxyDomains) Match(host string) bool {
+	if d == nil {
+		return false
+	}
+	return d.list.Load().(utils.DomainList).Match(host)
+}
+
+// writeFileAtomic replaces path with buf in one step.
+func writeFileAtomic(path string, buf []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return errors.Trace(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp.Name(), path))
+}
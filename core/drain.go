@@ -0,0 +1,90 @@
+package core
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chinaboard/coral/core/ss"
+	log "github.com/sirupsen/logrus"
+)
+
+// tunnels tracks the hijacked client connections, which http.Server no
+// longer knows about, so a shutdown can wait for them.
+type tunnels struct {
+	sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func (t *tunnels) Add(conn net.Conn) {
+	t.Lock()
+	defer t.Unlock()
+	if t.conns == nil {
+		t.conns = map[net.Conn]struct{}{}
+	}
+	t.conns[conn] = struct{}{}
+}
+
+func (t *tunnels) Remove(conn net.Conn) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.conns, conn)
+}
+
+func (t *tunnels) Len() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.conns)
+}
+
+func (t *tunnels) CloseAll() {
+	t.Lock()
+	defer t.Unlock()
+	for conn := range t.conns {
+		conn.Close()
+	}
+}
+
+// Shutdown stops accepting and waits for the open requests and tunnels to
+// finish. Those still open when ctx is done are closed.
+func (this *httpListener) Shutdown(ctx context.Context) error {
+	defer this.saveCache()
+	// the plugins carry the tunnels still draining
+	defer ss.StopPlugins()
+	this.socks.Close()
+	this.transparent.Close()
+	if err := this.srv.Shutdown(ctx); err != nil {
+		this.forceClose()
+		return err
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for n := this.tunnels.Len(); n > 0; n = this.tunnels.Len() {
+		log.Infoln("draining,", n, "connections remaining")
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			this.forceClose()
+			return ctx.Err()
+		}
+	}
+	log.Infoln("drained")
+	return nil
+}
+
+func (this *httpListener) forceClose() {
+	log.Warnln("drain timeout, close", this.tunnels.Len(), "tunnels")
+	this.tunnels.CloseAll()
+	this.srv.Close()
+}
+
+// saveCache persists the routing decisions for the next start.
+func (this *httpListener) saveCache() {
+	if this.cacheFile == "" {
+		return
+	}
+	if err := this.cache.Save(this.cacheFile); err != nil {
+		log.Warnln("save cache:", err)
+	}
+}
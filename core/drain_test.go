@@ -0,0 +1,107 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startTunnel serves a listener allowing tunnels to an echo server and
+// returns it with a client connection holding an open tunnel.
+func startTunnel(t *testing.T) (*httpListener, net.Conn, chan error) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	_, echoPort, _ := net.SplitHostPort(echo.Addr().String())
+
+	port := freePort(t)
+	addr := net.JoinHostPort("127.0.0.1", port)
+	l := newTestListener(t, "host = 127.0.0.1\nport = "+port+"\ntunnelAllowedPort = ["+echoPort+"]\n")
+	serving := make(chan struct{})
+	l.srv.BaseContext = func(net.Listener) context.Context {
+		close(serving)
+		return context.Background()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- l.ListenAndServe()
+	}()
+	<-serving
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.Write([]byte("CONNECT " + echo.Addr().String() + " HTTP/1.1\r\nHost: " + echo.Addr().String() + "\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("CONNECT:", resp, err)
+	}
+	conn.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatal("tunnel:", string(b), err)
+	}
+	return l, conn, done
+}
+
+func TestDrainWaitsForTunnel(t *testing.T) {
+	l, conn, done := startTunnel(t)
+
+	// the tunnel finishes while draining
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		conn.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := l.Shutdown(ctx); err != nil {
+		t.Fatal("shutdown:", err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("shutdown returned after %s, before the tunnel finished", d)
+	}
+	if err := <-done; err != http.ErrServerClosed {
+		t.Errorf("stopped with %v, want the clean shutdown", err)
+	}
+}
+
+func TestDrainTimeoutClosesTunnel(t *testing.T) {
+	l, conn, done := startTunnel(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := l.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown: %v, want the drain timeout", err)
+	}
+	if d := time.Since(start); d < 500*time.Millisecond {
+		t.Errorf("shutdown returned after %s, before the drain timeout", d)
+	}
+	// the tunnel still open is closed
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from the force-closed tunnel: %v, want EOF", err)
+	}
+	<-done
+}
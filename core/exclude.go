@@ -0,0 +1,66 @@
+package core
+
+import (
+	"github.com/chinaboard/coral/core/proxy"
+	"github.com/chinaboard/coral/stats"
+	log "github.com/sirupsen/logrus"
+)
+
+// reasons a server is left out of the selection
+const (
+	ExcludeUnhealthy     = "unhealthy"
+	ExcludeBreakerOpen   = "breaker-open"
+	ExcludeCanaryStopped = "canary-stopped"
+	ExcludeFailing       = "failing"
+)
+
+// ExcludeFunc returns why p must not be selected now, or "".
+type ExcludeFunc func(p proxy.Proxy) string
+
+// excludeCheck is an ExcludeFunc with its read-only variant, answering the
+// same without the changes of state a selection makes.
+type excludeCheck struct {
+	check ExcludeFunc
+	peek  ExcludeFunc
+}
+
+// RegisterExclude adds a check every server must pass to be selected. f
+// also explains routes in the admin API, so it must not change any state.
+func (this *httpListener) RegisterExclude(f ExcludeFunc) {
+	this.registerExclude(f, f)
+}
+
+func (this *httpListener) registerExclude(check, peek ExcludeFunc) {
+	this.Lock()
+	defer this.Unlock()
+	this.excludes = append(this.excludes, excludeCheck{check: check, peek: peek})
+}
+
+// excluded returns the first reason p is left out, or "". With peek the
+// checks change nothing and the exclusion isn't counted.
+func (this *httpListener) excluded(p proxy.Proxy, peek bool) string {
+	this.Lock()
+	excludes := this.excludes
+	this.Unlock()
+	for _, e := range excludes {
+		if peek {
+			if reason := e.peek(p); reason != "" {
+				return reason
+			}
+			continue
+		}
+		if reason := e.check(p); reason != "" {
+			this.logExclusion(p, reason)
+			return reason
+		}
+	}
+	return ""
+}
+
+func (this *httpListener) logExclusion(p proxy.Proxy, reason string) {
+	log.WithFields(log.Fields{
+		"server": p.Name(),
+		"reason": reason,
+	}).Debugln("excluded")
+	stats.Global.AddExclusion(p.Name(), reason)
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/chinaboard/coral/core/proxy"
+	"github.com/chinaboard/coral/stats"
+)
+
+func TestExcluded(t *testing.T) {
+	l := newTestListener(t, "")
+	// names of their own, stats.Global is shared by every test
+	a, b := &stubProxy{name: "exclude-a"}, &stubProxy{name: "exclude-b"}
+	l.RegisterExclude(func(p proxy.Proxy) string {
+		if p.Name() == a.name {
+			return ExcludeUnhealthy
+		}
+		return ""
+	})
+	l.RegisterExclude(func(p proxy.Proxy) string { return ExcludeFailing })
+
+	excluded := func(name string) map[string]uint64 {
+		return stats.Global.Snapshot().Upstreams[name].Excluded
+	}
+	for i := 0; i < 2; i++ {
+		// the first reason is counted, and only for its server
+		if reason := l.excluded(a, false); reason != ExcludeUnhealthy {
+			t.Fatalf("a excluded as %q, want %q", reason, ExcludeUnhealthy)
+		}
+		if reason := l.excluded(b, false); reason != ExcludeFailing {
+			t.Fatalf("b excluded as %q, want %q", reason, ExcludeFailing)
+		}
+	}
+	if n := excluded(a.name); n[ExcludeUnhealthy] != 2 || n[ExcludeFailing] != 0 {
+		t.Errorf("a exclusions %v, want 2 %s", n, ExcludeUnhealthy)
+	}
+	if n := excluded(b.name); n[ExcludeFailing] != 2 || n[ExcludeUnhealthy] != 0 {
+		t.Errorf("b exclusions %v, want 2 %s", n, ExcludeFailing)
+	}
+
+	if reason := l.excluded(a, true); reason != ExcludeUnhealthy {
+		t.Errorf("peek excluded a as %q, want %q", reason, ExcludeUnhealthy)
+	}
+	if n := excluded(a.name); n[ExcludeUnhealthy] != 2 {
+		t.Errorf("peek counted, a exclusions %v", n)
+	}
+}
+
+func TestExcludedPeekBreaker(t *testing.T) {
+	l := newTestListener(t, "")
+	br := newBreaker(1, time.Minute, time.Hour, nil)
+	l.registerExclude(br.Exclude, br.Peek)
+	p := &stubProxy{name: "exclude-breaker"}
+	br.Report(p, errors.New("refused"))
+
+	for _, peek := range []bool{true, false} {
+		if reason := l.excluded(p, peek); reason != ExcludeBreakerOpen {
+			t.Errorf("open breaker excluded with peek %v as %q", peek, reason)
+		}
+	}
+	if n := stats.Global.Snapshot().Upstreams[p.name].Excluded[ExcludeBreakerOpen]; n != 1 {
+		t.Errorf("%d %s exclusions, want 1 of the selection", n, ExcludeBreakerOpen)
+	}
+
+	// past the cooldown a peek sees the trial without using it up
+	c := br.get(p.name)
+	c.Lock()
+	c.since = time.Now().Add(-2 * time.Hour)
+	c.Unlock()
+	for i := 0; i < 2; i++ {
+		if reason := l.excluded(p, true); reason != "" {
+			t.Errorf("peek past the cooldown excluded as %q", reason)
+		}
+		if state := br.State(p.name); state != BreakerOpen {
+			t.Errorf("peek changed the breaker to %s", state)
+		}
+	}
+	if reason := l.excluded(p, false); reason != "" {
+		t.Errorf("trial excluded as %q", reason)
+	}
+	if state := br.State(p.name); state != BreakerHalfOpen {
+		t.Errorf("breaker %s after the trial, want %s", state, BreakerHalfOpen)
+	}
+}
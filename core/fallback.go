@@ -0,0 +1,70 @@
+package core
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chinaboard/coral/core/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// fallback retries hosts classified as direct through a proxy when the
+// direct connection fails, and keeps proxying them for a while if that
+// works: a CN IP doesn't mean the service isn't blocked.
+type fallback struct {
+	proxy proxy.Proxy
+	ttl   time.Duration
+	hosts sync.Map // host:port -> expiry time.Time
+}
+
+func newFallback(p proxy.Proxy, ttl time.Duration) *fallback {
+	return &fallback{proxy: p, ttl: ttl}
+}
+
+// For returns the proxy retrying a failure through p, or nil.
+func (f *fallback) For(p proxy.Proxy) proxy.Proxy {
+	if f == nil || !p.Direct() {
+		return nil
+	}
+	return f.proxy
+}
+
+// Remember proxies addr until the TTL expires.
+func (f *fallback) Remember(addr string) {
+	log.Infoln(addr, "failed directly, proxy it for", f.ttl)
+	f.hosts.Store(addr, time.Now().Add(f.ttl))
+}
+
+// Proxied reports whether addr failed directly recently.
+func (f *fallback) Proxied(addr string) bool {
+	if f == nil {
+		return false
+	}
+	v, ok := f.hosts.Load(addr)
+	return ok && time.Now().Before(v.(time.Time))
+}
+
+// Sweep forgets expired hosts.
+func (f *fallback) Sweep() {
+	if f == nil {
+		return
+	}
+	now := time.Now()
+	f.hosts.Range(func(key, value interface{}) bool {
+		if now.After(value.(time.Time)) {
+			f.hosts.Delete(key)
+		}
+		return true
+	})
+}
+
+// inherit keeps proxying the hosts old remembered.
+func (f *fallback) inherit(old *fallback) {
+	if f == nil || old == nil {
+		return
+	}
+	old.hosts.Range(func(key, value interface{}) bool {
+		f.hosts.Store(key, value)
+		return true
+	})
+}
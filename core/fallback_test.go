@@ -0,0 +1,46 @@
+package core
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFallbackAfterDirectFailure(t *testing.T) {
+	l := newTestListener(t, "")
+	origin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origin.Close()
+	addr := origin.Addr().String()
+
+	direct := &stubProxy{name: "direct", direct: true}
+	var dialed string
+	fb := &stubProxy{name: "fallback", dial: func(network, addr string) (net.Conn, error) {
+		dialed = addr
+		return net.Dial(network, addr)
+	}}
+	routes := *l.routes()
+	routes.fallback = newFallback(fb, time.Minute)
+	l.current.Store(&routes)
+
+	if c := l.classify(addr); !c.direct {
+		t.Fatalf("%s classified as %s before the failure, want direct", addr, c.reason)
+	}
+	p, conn, _, err := l.connect(context.Background(), direct, addr, nil)
+	if err != nil {
+		t.Fatal("connect:", err)
+	}
+	conn.Close()
+	if p != fb || dialed != addr {
+		t.Errorf("connected through %s to %q, want the fallback to %s", p.Name(), dialed, addr)
+	}
+	if c := l.classify(addr); c.direct || c.reason != ReasonFallback {
+		t.Errorf("%s classified direct=%v reason %s after the failure, want proxied by the fallback", addr, c.direct, c.reason)
+	}
+	if l.classify("127.0.0.2:1").reason == ReasonFallback {
+		t.Error("fallback remembered another host")
+	}
+}
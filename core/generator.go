@@ -1,22 +1,82 @@
 package core
 
 import (
+	"net"
+	"time"
+
 	"github.com/chinaboard/coral/config"
+	"github.com/chinaboard/coral/core/dialer"
+	"github.com/chinaboard/coral/core/direct"
+	"github.com/chinaboard/coral/core/httpproxy"
 	"github.com/chinaboard/coral/core/proxy"
+	"github.com/chinaboard/coral/core/socks"
 	"github.com/chinaboard/coral/core/ss"
 	"github.com/chinaboard/coral/core/ssr"
+	"github.com/chinaboard/coral/core/vmess"
+	"github.com/chinaboard/coral/utils"
 	"github.com/juju/errors"
 	log "github.com/sirupsen/logrus"
 )
 
-func GenerateProxy(server config.CoralServer) (proxy.Proxy, error) {
+func GenerateProxy(server config.CoralServer, common config.CoralConfigCommon) (proxy.Proxy, error) {
 	log.Infoln("init", server.Type, server.Name, server.Address(), "...")
+	d := dialer.New(dialer.Options{
+		Timeout:     common.DialTimeout,
+		Tos:         server.Tos,
+		ReadBuffer:  common.ReadBuffer,
+		WriteBuffer: common.WriteBuffer,
+		SourcePorts: dialer.PortRange(server.SourcePorts),
+		SourceIP:    net.ParseIP(server.SourceAddress),
+		Mark:        common.SoMark,
+		KeepAlive:   keepAlive(common.TcpKeepAlive),
+	})
 	switch server.Type {
 	case "ss":
-		return ss.New(server)
+		return ss.New(server, d)
 	case "ssr":
-		return ssr.New(server)
+		return ssr.New(server, d)
+	case "vmess":
+		return vmess.New(server, d)
+	case "socks5":
+		return socks.New(server, d)
+	case "http", "https":
+		return httpproxy.New(server, d)
 	default:
 		return nil, errors.NotSupportedf(server.Type)
 	}
 }
+
+func NewDirectProxy(common config.CoralConfigCommon, resolver direct.Resolver) proxy.Proxy {
+	return direct.New(common.DirectTimeout, dialer.New(dialer.Options{
+		Timeout:     common.DirectTimeout,
+		Tos:         common.DirectTos,
+		ReadBuffer:  common.ReadBuffer,
+		WriteBuffer: common.WriteBuffer,
+		SourcePorts: dialer.PortRange(common.SourcePorts),
+		SourceIP:    net.ParseIP(common.SourceAddress),
+		Mark:        common.SoMark,
+		KeepAlive:   keepAlive(common.TcpKeepAlive),
+		Deny:        localDenier(common),
+	}), common.DirectParallel, resolver)
+}
+
+// localDenier refuses the local addresses not in allowedLocal, nil when
+// deniedLocal is off.
+func localDenier(common config.CoralConfigCommon) func(ip net.IP) bool {
+	if !common.DeniedLocal {
+		return nil
+	}
+	allowed, _ := utils.ParseNoProxy(common.AllowedLocal)
+	return func(ip net.IP) bool {
+		return utils.IsLocalIP(ip) && !allowed.Match(ip.String())
+	}
+}
+
+// keepAlive converts the tcpKeepAlive option, where zero disables the
+// probes, to a dialer keepalive.
+func keepAlive(d time.Duration) time.Duration {
+	if d == 0 {
+		return -1
+	}
+	return d
+}
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hop-by-hop headers of RFC 7230 section 6.1, they concern a single
+// connection and must not be forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from h, including those
+// named by Connection. A protocol upgrade keeps its Upgrade header, which
+// only means something along with "Connection: Upgrade".
+func removeHopHeaders(h http.Header) {
+	upgrade := upgradeType(h)
+	for _, value := range h["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+	if upgrade != "" {
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", upgrade)
+	}
+}
+
+func upgradeType(h http.Header) string {
+	for _, value := range h["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,116 @@
+package core
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	tests := []struct {
+		in   http.Header
+		want http.Header
+	}{
+		{
+			http.Header{"Proxy-Authorization": {"Basic eDp5"}, "Accept": {"*/*"}},
+			http.Header{"Accept": {"*/*"}},
+		},
+		{
+			http.Header{"Connection": {"keep-alive, X-Secret"}, "Keep-Alive": {"timeout=5"}, "X-Secret": {"1"}, "Te": {"trailers"}},
+			http.Header{},
+		},
+		{
+			http.Header{"Proxy-Connection": {"keep-alive"}, "Transfer-Encoding": {"chunked"}, "Trailer": {"X-Sum"}, "Cookie": {"a=b"}},
+			http.Header{"Cookie": {"a=b"}},
+		},
+		{
+			http.Header{"Connection": {"Upgrade, X-Secret"}, "Upgrade": {"websocket"}, "X-Secret": {"1"}},
+			http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}},
+		},
+	}
+	for _, tt := range tests {
+		h := tt.in.Clone()
+		removeHopHeaders(h)
+		if !reflect.DeepEqual(h, tt.want) {
+			t.Errorf("removeHopHeaders(%v) = %v, want %v", tt.in, h, tt.want)
+		}
+	}
+}
+
+func TestProxyAuthorizationNotForwarded(t *testing.T) {
+	received := make(chan http.Header, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+	l := newTestListener(t, "userPasswd = alice:secret\n")
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	host := origin.Listener.Addr().String()
+	auth := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	conn.Write([]byte("GET http://" + host + "/ HTTP/1.1\r\nHost: " + host + "\r\n" +
+		"Proxy-Authorization: Basic " + auth + "\r\nConnection: X-Private\r\nX-Private: 1\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("request through the proxy:", resp.Status)
+	}
+	h := <-received
+	for _, name := range []string{"Proxy-Authorization", "X-Private"} {
+		if v := h.Get(name); v != "" {
+			t.Errorf("origin received %s: %s", name, v)
+		}
+	}
+	for _, name := range []string{"X-Hop", "Proxy-Authenticate"} {
+		if v := resp.Header.Get(name); v != "" {
+			t.Errorf("client received %s: %s", name, v)
+		}
+	}
+}
+
+func TestViaHeader(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+	tests := []struct {
+		conf   string
+		client string
+		want   string
+	}{
+		// 127.0.0.1 is in the default whitelist
+		{"viaHeader = true", "127.0.0.1:40000", "DIRECT"},
+		{"viaHeader = true", "192.0.2.1:40000", ""},
+		{"viaHeader = false", "127.0.0.1:40000", ""},
+	}
+	for _, tt := range tests {
+		l := newTestListener(t, tt.conf)
+		r := httptest.NewRequest("GET", origin.URL+"/", nil)
+		r.RemoteAddr = tt.client
+		w := httptest.NewRecorder()
+		l.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s, client %s: %d", tt.conf, tt.client, w.Code)
+		}
+		if got := w.Header().Get("X-Coral-Via"); got != tt.want {
+			t.Errorf("%s, client %s: X-Coral-Via %q, want %q", tt.conf, tt.client, got, tt.want)
+		}
+	}
+}
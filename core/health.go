@@ -0,0 +1,145 @@
+package core
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chinaboard/coral/core/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// health ejects an upstream from the selection after threshold failures in
+// a row, and admits it again once a test dial through it works.
+type health struct {
+	threshold int32
+	target    string
+	interval  time.Duration
+	servers   sync.Map // name -> *serverHealth
+	webhook   *webhook
+	done      chan struct{}
+	once      sync.Once
+}
+
+type serverHealth struct {
+	failures int32
+	down     int32
+}
+
+func newHealth(threshold int, target string, interval time.Duration, webhook *webhook) *health {
+	if threshold <= 0 {
+		return nil
+	}
+	return &health{
+		threshold: int32(threshold),
+		target:    target,
+		interval:  interval,
+		webhook:   webhook,
+		done:      make(chan struct{}),
+	}
+}
+
+func (h *health) get(name string) *serverHealth {
+	if v, ok := h.servers.Load(name); ok {
+		return v.(*serverHealth)
+	}
+	v, _ := h.servers.LoadOrStore(name, &serverHealth{})
+	return v.(*serverHealth)
+}
+
+// Report records the outcome of a dial or an exchange through the upstream.
+func (h *health) Report(p proxy.Proxy, err error) {
+	if h == nil || p.Direct() {
+		return
+	}
+	s := h.get(p.Name())
+	if err == nil {
+		atomic.StoreInt32(&s.failures, 0)
+		return
+	}
+	if atomic.AddInt32(&s.failures, 1) >= h.threshold && atomic.CompareAndSwapInt32(&s.down, 0, 1) {
+		log.Warnf("server %s unhealthy after %d failures: %v", p.Name(), h.threshold, err)
+		h.webhook.Notify(p.Name(), ExcludeUnhealthy)
+	}
+}
+
+// Exclude is the ExcludeFunc leaving unhealthy upstreams out.
+func (h *health) Exclude(p proxy.Proxy) string {
+	if h.Healthy(p.Name()) {
+		return ""
+	}
+	return ExcludeUnhealthy
+}
+
+func (h *health) Healthy(name string) bool {
+	if h == nil {
+		return true
+	}
+	return atomic.LoadInt32(&h.get(name).down) == 0
+}
+
+// Start test dials the unhealthy servers among proxies every interval.
+func (h *health) Start(proxies func() []proxy.Proxy) {
+	if h == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				h.recover(proxies())
+			case <-h.done:
+				return
+			}
+		}
+	}()
+}
+
+func (h *health) Stop() {
+	if h == nil {
+		return
+	}
+	h.once.Do(func() {
+		close(h.done)
+	})
+}
+
+func (h *health) recover(proxies []proxy.Proxy) {
+	var wg sync.WaitGroup
+	for _, value := range proxies {
+		if value.Direct() || h.Healthy(value.Name()) {
+			continue
+		}
+		wg.Add(1)
+		go func(value proxy.Proxy) {
+			defer wg.Done()
+			conn, _, err := value.Dial("tcp", h.target)
+			if err != nil {
+				log.Debugln("health probe", value.Name(), err)
+				return
+			}
+			conn.Close()
+			s := h.get(value.Name())
+			atomic.StoreInt32(&s.failures, 0)
+			if atomic.CompareAndSwapInt32(&s.down, 1, 0) {
+				log.Infof("server %s healthy again", value.Name())
+			}
+		}(value)
+	}
+	wg.Wait()
+}
+
+// ServerStatus returns whether each upstream is healthy, every one is when
+// health checking is off.
+func (this *httpListener) ServerStatus() map[string]bool {
+	proxies := this.routes().proxies
+	status := map[string]bool{}
+	for _, p := range proxies {
+		if !p.Direct() {
+			status[p.Name()] = this.health.Healthy(p.Name())
+		}
+	}
+	return status
+}
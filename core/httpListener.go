@@ -4,60 +4,270 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/chinaboard/coral/core/direct"
-
 	"github.com/chinaboard/coral/core/proxy"
 
 	"github.com/juju/errors"
 
 	"github.com/chinaboard/coral/cache"
 	"github.com/chinaboard/coral/config"
+	"github.com/chinaboard/coral/core/mitm"
 	"github.com/chinaboard/coral/leakybuf"
+	"github.com/chinaboard/coral/resolver"
+	"github.com/chinaboard/coral/stats"
+	"github.com/chinaboard/coral/utils"
+	"github.com/chinaboard/coral/utils/version"
 	log "github.com/sirupsen/logrus"
 )
 
 type httpListener struct {
 	sync.Mutex
 	cache           *cache.Cache
-	proxies         []proxy.Proxy
+	resolver        *resolver.Resolver
+	cacheFile       string
 	srv             *http.Server
 	selectProxyFunc SelectProxyFunc
 	whitelist       map[string]bool
+	allowedClients  utils.IPList
+	users           map[string]user
+	tunnelAllowed   bool
+	tunnelPorts     map[string]bool
+	dialAttempts    int
+	acceptors       int
+	backlog         int
+	mitm            *mitm.CertStore
+	interceptHosts  utils.DomainList
+	filterFunc      FilterFunc
+	denyLog         *log.Logger
+	accessLog       *log.Logger
+	readBuffer      int
+	writeBuffer     int
+	canary          *canary
+	janitor         *janitor
+	viaHeader       bool
+	overrides       *overrides
+	schemes         map[string]bool
+	logRedirects    bool
+	blockRedirects  bool
+	webhook         *webhook
+	probePath       string
+	probeResponse   string
+	loadBalance     string
+	failures        failures
+	prober          *prober
+	health          *health
+	breaker         *breaker
+	pac             *pac
+	sniffSni        bool
+	preReadTimeout  time.Duration
+	instanceID      string
+	maxHops         int
+	restartLimit    int
+	admin           *admin
+	socks           *socksListener
+	httpErrorCode   int
+	rejectStatus    int
+	idleTimeout     time.Duration
+	rateLimit       int
+	conns           *connLimit
+	transports      transports
+	tunnels         tunnels
+	unixSocket      string
+	transparent     *transparentListener
+	keepAlive       time.Duration
+	noDelay         bool
+	addrs           []string
+	noAuthAddrs     []string
+	proxyProtocol   utils.IPList
+	denyLocal       func(ip net.IP) bool
+	// the *routes a reload replaces
+	current  atomic.Value
+	serving  bool
+	excludes []excludeCheck
+	// the *idleWatch of every tunnel, reaped by the janitor
+	idles sync.Map
 }
 
 func NewHttpListener(conf *config.CoralConfig) (Listener, error) {
 	if conf == nil {
 		return nil, errors.New("config is nil")
 	}
-	if len(conf.Servers) == 0 {
+	if len(conf.Servers) == 0 && !conf.Common.DirectOnly {
 		return nil, errors.NotFoundf("server")
 	}
 
+	dns, err := resolver.New(conf.Common.DnsServer, conf.Common.DnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+
 	listener := &httpListener{
-		proxies:   []proxy.Proxy{direct.New(conf.Common.DirectTimeout)},
-		cache:     cache.NewCache(time.Minute * 30),
-		whitelist: conf.Common.Whitelist,
+		cache:          cache.NewCache(conf.Common.CacheTTL, conf.Common.MaxLookups, dns.LookupIP),
+		resolver:       dns,
+		whitelist:      conf.Common.Whitelist,
+		acceptors:      conf.Common.Acceptors,
+		backlog:        conf.Common.Backlog,
+		unixSocket:     conf.Common.UnixSocket,
+		keepAlive:      conf.Common.TcpKeepAlive,
+		noDelay:        conf.Common.TcpNoDelay,
+		addrs:          conf.Common.Addresses(),
+		noAuthAddrs:    conf.Common.ListenNoAuth,
+		readBuffer:     conf.Common.ReadBuffer,
+		writeBuffer:    conf.Common.WriteBuffer,
+		canary:         newCanary(conf.Common.Canary, conf.Common.CanaryPercent, conf.Common.CanaryErrorPercent),
+		janitor:        newJanitor(conf.Common.JanitorInterval),
+		viaHeader:      conf.Common.ViaHeader,
+		schemes:        map[string]bool{},
+		tunnelAllowed:  conf.Common.TunnelAllowed,
+		dialAttempts:   conf.Common.DialAttempts,
+		tunnelPorts:    map[string]bool{},
+		logRedirects:   conf.Common.LogRedirects,
+		blockRedirects: conf.Common.BlockLocalRedirects,
+		denyLocal:      localDenier(conf.Common),
+		webhook:        newWebhook(conf.Common.Webhook),
+		probePath:      conf.Common.ProbePath,
+		probeResponse:  conf.Common.ProbeResponse,
+		loadBalance:    conf.Common.LoadBalance,
+		sniffSni:       conf.Common.SniffSni,
+		preReadTimeout: conf.Common.PreReadTimeout,
+		instanceID:     newInstanceID(),
+		maxHops:        conf.Common.MaxHops,
+		restartLimit:   conf.Common.RestartLimit,
+		httpErrorCode:  conf.Common.HttpErrorCode,
+		rejectStatus:   conf.Common.RejectStatus,
+		idleTimeout:    conf.Common.IdleTimeout,
+		rateLimit:      conf.Common.RateLimit,
+		conns:          newConnLimit(conf.Common.MaxConns, conf.Common.MaxConnsPerClient),
+	}
+	for _, port := range conf.Common.TunnelAllowedPort {
+		listener.tunnelPorts[strconv.Itoa(port)] = true
 	}
+	for _, scheme := range conf.Common.AllowedSchemes {
+		listener.schemes[strings.ToLower(scheme)] = true
+	}
+	listener.cache.Policy = conf.Common.DirectPolicy
+	listener.cache.NegativeTTL = conf.Common.NegativeCacheTTL
+	listener.janitor.Add(listener.cache.Sweep)
+	listener.janitor.Add(listener.resolver.Sweep)
 
-	listener.srv = &http.Server{
-		Addr:    conf.Common.Address(),
-		Handler: listener,
+	if conf.Common.CacheFile != "" && conf.Common.CacheTTL > 0 {
+		listener.cacheFile = conf.Common.CacheFile
+		if n, err := listener.cache.Load(listener.cacheFile); err != nil {
+			log.Warnln("start with an empty cache:", err)
+		} else {
+			log.Infoln("loaded", n, "cached routes")
+		}
 	}
+	listener.janitor.Add(listener.webhook.Sweep)
+	listener.janitor.Add(listener.sweepTransports)
+	listener.janitor.Add(listener.reapIdle)
+	listener.janitor.Add(listener.sweepStats)
 
-	for _, v := range conf.Servers {
-		p, err := GenerateProxy(v)
+	users, err := loadUsers(conf.Common.UserPasswd, conf.Common.UserPasswdFile)
+	if err != nil {
+		return nil, err
+	}
+	listener.users = users
+
+	if len(conf.Common.AllowedClients) > 0 {
+		allowed, err := utils.ParseIPList(conf.Common.AllowedClients)
 		if err != nil {
-			log.Warningln(err)
-			continue
+			return nil, errors.Annotate(err, "allowedClients")
 		}
-		if ok, err := listener.RegisterProxy(p); !ok {
+		listener.allowedClients = allowed
+	}
+
+	if conf.Common.ProxyProtocol {
+		trusted, err := utils.ParseIPList(conf.Common.ProxyProtocolFrom)
+		if err != nil {
+			return nil, errors.Annotate(err, "proxyProtocolFrom")
+		}
+		listener.proxyProtocol = trusted
+	}
+
+	if conf.Common.RouteOverride != "" {
+		o, err := newOverrides(conf.Common.RouteOverride)
+		if err != nil {
 			return nil, err
 		}
+		listener.overrides = o
+	}
+
+	pac, err := newPac(conf)
+	if err != nil {
+		return nil, err
+	}
+	listener.pac = pac
+
+	denyLog, err := newDenyLogger(conf.Common.DenyLog)
+	if err != nil {
+		return nil, err
+	}
+	listener.denyLog = denyLog
+	listener.accessLog = newAccessLogger(conf.Common.AccessLog)
+
+	if len(conf.Common.InterceptHosts) > 0 {
+		store, err := mitm.NewCertStore(conf.Common.MitmCert, conf.Common.MitmKey)
+		if err != nil {
+			return nil, err
+		}
+		listener.mitm = store
+		listener.interceptHosts = utils.NewDomainList(conf.Common.InterceptHosts)
+		log.Warnln("tls interception enabled for", conf.Common.InterceptHosts)
+	}
+
+	listener.srv = &http.Server{
+		Addr:    conf.Common.Addresses()[0],
+		Handler: listener,
+	}
+
+	routes, err := listener.newRoutes(conf)
+	if err != nil {
+		return nil, err
+	}
+	listener.current.Store(routes)
+	listener.janitor.Add(func() {
+		listener.routes().fallback.Sweep()
+	})
+
+	if listener.canary != nil {
+		if _, ok := conf.Servers[listener.canary.name]; !ok {
+			log.Warnln("canary server not found:", listener.canary.name)
+		}
+	}
+
+	listener.health = newHealth(conf.Common.HealthThreshold, conf.Common.LatencyTarget, conf.Common.HealthInterval, listener.webhook)
+	if listener.health != nil {
+		listener.RegisterExclude(listener.health.Exclude)
+	}
+	listener.breaker = newBreaker(conf.Common.BreakerThreshold, conf.Common.BreakerWindow, conf.Common.BreakerCooldown, listener.webhook)
+	if listener.breaker != nil {
+		listener.registerExclude(listener.breaker.Exclude, listener.breaker.Peek)
+	}
+
+	if listener.loadBalance == LBLatency {
+		listener.prober = newProber(conf.Common.LatencyTarget, conf.Common.LatencyInterval)
+	}
+
+	if conf.Common.AdminAddress != "" {
+		listener.admin = newAdmin(conf.Common.AdminAddress, listener)
+	}
+
+	if conf.Common.SocksAddress != "" {
+		listener.socks = newSocksListener(conf.Common.SocksAddress, listener)
+	}
+
+	if conf.Common.TransparentAddress != "" {
+		listener.transparent = newTransparentListener(conf.Common.TransparentAddress, listener)
 	}
 
 	if ok, err := listener.RegisterLoadBalance(listener.DefaultSelectProxy); !ok {
@@ -71,14 +281,136 @@ func (this *httpListener) ListenAndServe() error {
 	if this.selectProxyFunc == nil {
 		return errors.New("not found selectProxyFunc")
 	}
-	return this.srv.ListenAndServe()
+
+	n := this.acceptors
+	if this.unixSocket != "" {
+		n = 1
+	}
+	if n > 1 && !reusePortSupported {
+		log.Warnln("SO_REUSEPORT not supported on this platform, use a single listener")
+		n = 1
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	stats.Global.SetConnLimit(this.Connections)
+	this.janitor.Start()
+	defer this.janitor.Stop()
+	defer this.overrides.Close()
+	this.admin.Start()
+	defer this.admin.Close()
+	if err := this.socks.Start(); err != nil {
+		return err
+	}
+	defer this.socks.Close()
+	if err := this.transparent.Start(); err != nil {
+		return err
+	}
+	defer this.transparent.Close()
+	proxies := func() []proxy.Proxy {
+		return this.routes().proxies
+	}
+	this.prober.Start(proxies)
+	defer this.prober.Stop()
+	this.Lock()
+	this.serving = true
+	this.routes().proxyDomains.Start()
+	this.Unlock()
+	defer func() {
+		this.Lock()
+		defer this.Unlock()
+		this.serving = false
+		this.routes().proxyDomains.Stop()
+	}()
+	this.health.Start(proxies)
+	defer this.health.Stop()
+
+	// a lost listener, e.g. after a VPN flap, is bound again while the
+	// upstreams and caches live on. Failing to bind at startup is fatal.
+	backoff := restartBackoff
+	for restarts := 0; ; restarts++ {
+		start := time.Now()
+		bound, err := this.serve(n)
+		if err == http.ErrServerClosed || !bound && restarts == 0 {
+			return err
+		}
+		if time.Since(start) > restartReset {
+			restarts, backoff = 0, restartBackoff
+		}
+		if restarts >= this.restartLimit {
+			return err
+		}
+		log.Errorln("listener:", err, "restart in", backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > restartMaxBackoff {
+			backoff = restartMaxBackoff
+		}
+	}
+}
+
+// serve binds n listeners on every address and serves on them until one
+// fails, bound tells whether binding worked.
+func (this *httpListener) serve(n int) (bound bool, err error) {
+	listeners, err := this.listen(n)
+	if err != nil {
+		return false, err
+	}
+	if this.proxyProtocol != nil {
+		for i, ln := range listeners {
+			listeners[i] = &proxyProtoListener{Listener: ln, trusted: this.proxyProtocol}
+		}
+	}
+
+	// every listener has its own accept loop feeding the same handler
+	errc := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			errc <- this.srv.Serve(ln)
+		}(ln)
+	}
+	err = <-errc
+	for _, l := range listeners {
+		l.Close()
+	}
+	for i := 1; i < len(listeners); i++ {
+		<-errc
+	}
+	return true, err
+}
+
+// listen binds n listeners on each listen address, or the unix socket.
+func (this *httpListener) listen(n int) ([]net.Listener, error) {
+	if this.unixSocket != "" {
+		ln, err := listenUnix(this.unixSocket)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+	listeners := make([]net.Listener, 0, n*len(this.addrs))
+	for _, addr := range this.addrs {
+		for i := 0; i < n; i++ {
+			ln, err := listenTCP(addr, n > 1, this.backlog)
+			if err != nil {
+				for _, l := range listeners {
+					l.Close()
+				}
+				return nil, err
+			}
+			listeners = append(listeners, ln)
+		}
+	}
+	return listeners, nil
 }
 
 func (this *httpListener) RegisterProxy(proxy proxy.Proxy) (bool, error) {
 	if proxy != nil {
 		this.Lock()
 		defer this.Unlock()
-		this.proxies = append(this.proxies, proxy)
+		r := *this.routes()
+		r.proxies = append(r.proxies[:len(r.proxies):len(r.proxies)], proxy)
+		this.current.Store(&r)
 		return true, nil
 	}
 	return false, errors.New("proxy is nil")
@@ -96,26 +428,128 @@ func (this *httpListener) RegisterLoadBalance(selectProxyFunc SelectProxyFunc) (
 	return false, errors.New("func errer")
 }
 
+func (this *httpListener) RegisterFilter(filterFunc FilterFunc) (bool, error) {
+	if filterFunc == nil {
+		return false, errors.New("func is nil")
+	}
+	this.filterFunc = filterFunc
+	return true, nil
+}
+
 func (this *httpListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		if err := recover(); err != nil {
-			http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			http.Error(w, fmt.Sprint(err), this.errorCode(http.StatusInternalServerError))
 			log.Debugf("panic: %v\n", err)
 		}
 	}()
 
+	if this.isProbe(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, this.probeResponse, version.BuildVersion)
+		return
+	}
+
 	if !this.auth(w, r) {
 		return
 	}
+	if this.pac.Match(r) {
+		this.servePac(w, r)
+		return
+	}
+	// browsers fetch the PAC file without proxy credentials
+	if !this.proxyAuth(w, r) {
+		return
+	}
+	client, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if !this.conns.Acquire(client) {
+		log.Warnln(r.RemoteAddr, "too many connections")
+		this.deny(r, r.Host, DenyTooMany)
+		if r.Method != "CONNECT" {
+			this.fail(w, http.StatusServiceUnavailable)
+		} else if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+			}
+		}
+		return
+	}
+	defer this.conns.Release(client)
+	stats.Global.AddConnection()
+
+	if r.Method == "CONNECT" {
+		stats.Global.AddTunnel()
+		target, err := connectTarget(r)
+		if err != nil {
+			log.Warnln(r.RemoteAddr, err)
+			this.deny(r, r.RequestURI, DenyBadRequest)
+			http.Error(w, "Bad Request.", http.StatusBadRequest)
+			return
+		}
+		r.Host = target
+		// keeps coral from relaying arbitrary protocols
+		if _, port, _ := net.SplitHostPort(target); !this.tunnelAllowed || !this.tunnelPorts[port] {
+			log.Warnln(r.RemoteAddr, "tunnel port not allowed", target)
+			this.deny(r, target, DenyPortNotAllowed)
+			http.Error(w, "Forbidden.", http.StatusForbidden)
+			return
+		}
+	} else if err := normalizeRequest(r); err != nil {
+		log.Warnln(r.RemoteAddr, err)
+		this.deny(r, r.RequestURI, DenyBadRequest)
+		http.Error(w, "Bad Request.", http.StatusBadRequest)
+		return
+	}
 
-	d := this.cache.ShouldDirect(r.Host)
+	if this.routes().rejected(hostname(r.Host)) {
+		log.Infoln(r.RemoteAddr, "rejected", r.Host)
+		this.deny(r, r.Host, DenyRejected)
+		// a 2xx answer to CONNECT would open the tunnel
+		if this.rejectStatus == http.StatusNoContent && r.Method != "CONNECT" {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			this.fail(w, http.StatusForbidden)
+		}
+		return
+	}
+
+	if (r.Method == "CONNECT" && this.isSelf(r.Host)) || this.looped(r) {
+		log.Warnln(r.RemoteAddr, "proxy loop", r.Host)
+		this.deny(r, r.Host, DenyLoop)
+		http.Error(w, "Loop Detected.", http.StatusLoopDetected)
+		return
+	}
+	if this.localDenied(r.Host) {
+		log.Warnln(r.RemoteAddr, "local address denied", r.Host)
+		this.deny(r, r.Host, DenyLocal)
+		this.fail(w, http.StatusForbidden)
+		return
+	}
 
-	proxy, err := this.selectProxyFunc(r.Host, this.proxies, d)
+	r, meta := this.withMeta(r)
+	c := this.classify(r.Host)
+	proxy, err := this.selectProxy(r.Host, this.routes().proxies, c)
 	if err != nil {
 		log.Errorln(err)
+		this.webhook.Notify("", "no upstream available")
+		this.fail(w, http.StatusBadGateway)
+		return
+	}
+	if this.directDenied(r.Host, proxy) {
+		log.Warnln(r.RemoteAddr, "local address denied", r.Host)
+		this.deny(r, r.Host, DenyLocal)
+		this.fail(w, http.StatusForbidden)
 		return
 	}
-	log.Infoln(proxy.Name(), r.RemoteAddr, r.Method, r.Host)
+	meta.routed(proxy, c)
+	if this.accessLog == nil {
+		log.Infoln(proxy.Name(), r.RemoteAddr, r.Method, r.Host)
+	} else {
+		defer this.logAccess(r.Method, r.Host, meta)
+	}
 
 	if r.Method == "CONNECT" {
 		this.HandleConnect(w, r, proxy)
@@ -125,75 +559,697 @@ func (this *httpListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// route chooses the proxy for host:port.
+func (this *httpListener) route(addr string) (proxy.Proxy, classification, error) {
+	c := this.classify(addr)
+	p, err := this.selectProxy(addr, this.routes().proxies, c)
+	return p, c, err
+}
+
+// selectProxy picks the proxy of a classification among proxies, the one
+// a rule names or else the load balancer's choice.
+func (this *httpListener) selectProxy(addr string, proxies []proxy.Proxy, c classification) (proxy.Proxy, error) {
+	if p := ruleProxy(proxies, c); p != nil {
+		return p, nil
+	}
+	if c.reason == ReasonRule && c.server != "" {
+		log.Warnln("rule server not found:", c.server)
+	}
+	return this.selectProxyFunc(addr, proxies, c.direct)
+}
+
+// peekProxy tells what selectProxy would pick without any of the changes a
+// selection makes, for the admin API.
+func (this *httpListener) peekProxy(addr string, proxies []proxy.Proxy, c classification) (proxy.Proxy, error) {
+	if p := ruleProxy(proxies, c); p != nil {
+		return p, nil
+	}
+	return this.chooseProxy(addr, proxies, c.direct, true)
+}
+
+// ruleProxy returns the proxy a rule of c chose, or nil.
+func ruleProxy(proxies []proxy.Proxy, c classification) proxy.Proxy {
+	if c.reason != ReasonRule {
+		return nil
+	}
+	for _, p := range proxies {
+		if c.server == "" && p.Direct() || c.server != "" && p.Name() == c.server {
+			return p
+		}
+	}
+	return nil
+}
+
+// classification tells whether a host is reached directly and why.
+type classification struct {
+	direct bool
+	reason string
+	cached bool
+	// the server a rule names
+	server string
+}
+
+// reasons of a classification
+const (
+	ReasonNoProxy     = "noProxy"
+	ReasonFallback    = "fallback"
+	ReasonDirectIP    = "direct ip"
+	ReasonProxyIP     = "proxied ip"
+	ReasonLookup      = "lookup failed"
+	ReasonRetry       = "retry"
+	ReasonProxyDomain = "proxy domain"
+	ReasonDirect      = "fallback direct"
+	ReasonRule        = "rule"
+	ReasonDirectPort  = "direct port"
+	ReasonProxyPort   = "proxied port"
+)
+
+// actions of a rule besides the name of a server
+const (
+	RuleDirect = "direct"
+	RuleReject = "reject"
+)
+
+func (this *httpListener) classify(addr string) classification {
+	return this.classifyBy(addr, this.cache.Classify)
+}
+
+// peekClassify is classify leaving the cache and its counters untouched,
+// for the admin API.
+func (this *httpListener) peekClassify(addr string) classification {
+	return this.classifyBy(addr, this.cache.Peek)
+}
+
+// classifyBy classifies addr, decide judges the hosts no list settles.
+func (this *httpListener) classifyBy(addr string, decide func(string) cache.Decision) classification {
+	routes := this.routes()
+	if action, ok := routes.rules.Lookup(hostname(addr)); ok && action != RuleReject {
+		if action == RuleDirect {
+			return classification{direct: true, reason: ReasonRule}
+		}
+		return classification{direct: false, reason: ReasonRule, server: action}
+	}
+	// a plain HTTP request may leave out the port
+	port := "80"
+	if _, p, err := net.SplitHostPort(addr); err == nil {
+		port = p
+	}
+	if routes.directPorts[port] {
+		return classification{direct: true, reason: ReasonDirectPort}
+	}
+	if routes.proxyPorts[port] {
+		return classification{direct: false, reason: ReasonProxyPort}
+	}
+	// noProxy is checked first, it spares the DNS lookup
+	if routes.noProxy.Match(hostname(addr)) {
+		return classification{direct: true, reason: ReasonNoProxy}
+	}
+	if routes.proxyDomains.Match(hostname(addr)) {
+		return classification{direct: false, reason: ReasonProxyDomain}
+	}
+	if routes.fallback.Proxied(addr) {
+		return classification{direct: false, reason: ReasonFallback}
+	}
+	d := decide(addr)
+	if log.IsLevelEnabled(log.DebugLevel) {
+		cache := "miss"
+		if d.Hit {
+			cache = "hit"
+		}
+		log.WithFields(log.Fields{
+			"host":     addr,
+			"cache":    cache,
+			"resolved": d.Resolved,
+			"direct":   d.Direct,
+		}).Debugln("classify")
+	}
+	c := classification{direct: d.Direct, reason: ReasonProxyIP, cached: d.Hit}
+	switch {
+	case !d.Resolved:
+		c.reason = ReasonLookup
+	case d.Direct:
+		c.reason = ReasonDirectIP
+	}
+	return c
+}
+
 func (this *httpListener) HandleConnect(w http.ResponseWriter, r *http.Request, proxy proxy.Proxy) {
+	if this.shouldIntercept(r.Host) {
+		this.HandleIntercept(w, r, proxy)
+		return
+	}
+
+	meta := MetaFrom(r.Context())
 	hj, _ := w.(http.Hijacker)
 	lConn, _, err := hj.Hijack()
 	if err != nil && err != http.ErrHijacked {
 		log.Errorln("hijack", err)
 		return
 	}
+	this.tunnels.Add(lConn)
+	defer this.tunnels.Remove(lConn)
+	this.tuneConn(lConn)
 
-	var (
-		rConn   net.Conn
-		timeout time.Duration
-		errs    error
-	)
-
-	rConn, timeout, errs = proxy.Dial("tcp", r.Host)
+	// a tunnel to an IP is routed by the server name in the ClientHello, so
+	// the client must be told to go ahead before the dial
+	established := false
+	if this.sniffSni && net.ParseIP(hostname(r.Host)) != nil {
+		lConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		established = true
+		var name string
+		lConn, name = sniffSNI(lConn, this.preReadTimeout)
+		if name != "" {
+			_, port, _ := net.SplitHostPort(r.Host)
+			if p, c, err := this.route(net.JoinHostPort(name, port)); err == nil {
+				log.Debugln(r.Host, "sni", name, "routed to", p.Name())
+				proxy = p
+				meta.routed(p, c)
+			}
+		}
+	}
 
+	// the client may give up while the upstream is dialed
+	watch, ctx := watchClient(r.Context(), lConn)
+	proxy, rConn, timeout, errs := this.connect(ctx, proxy, r.Host, meta)
+	lConn = watch.stop()
 	if errs != nil {
-		log.Errorln(proxy.Name(), "Dial:", err)
+		// once established the client only understands a closed tunnel
+		if !established {
+			code := http.StatusBadGateway
+			if isTimeout(errs) {
+				code = http.StatusGatewayTimeout
+			}
+			code = this.errorCode(code)
+			fmt.Fprintf(lConn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code))
+		}
+		lConn.Close()
 		return
 	}
-	lConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	// only a working upstream connection is announced
+	if !established {
+		lConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	}
+	this.relay(lConn, rConn, proxy, r.Host, timeout, meta)
+}
 
-	go this.Pipe(lConn, rConn, timeout)
-	this.Pipe(rConn, lConn, timeout)
+// connect opens a tunnel to addr through p, moving on to the other
+// upstreams and to the fallback while dialing fails, until ctx is done.
+func (this *httpListener) connect(ctx context.Context, p proxy.Proxy, addr string, meta *RequestMeta) (proxy.Proxy, net.Conn, time.Duration, error) {
+	first, forced := p, meta.forcedProxy()
+	p, rConn, timeout, err := this.dialRetry(ctx, p, addr)
+	if err == nil && p != first {
+		meta.rerouted(p, ReasonRetry)
+	}
+	fallback := this.routes().fallback
+	if fb := fallback.For(p); err != nil && fb != nil && ctx.Err() == nil {
+		rConn, timeout, err = this.dial(ctx, fb, addr)
+		if err == nil {
+			fallback.Remember(addr)
+			p = fb
+			meta.rerouted(fb, ReasonFallback)
+		}
+	}
+	if direct := this.routes().fallbackDirect; err != nil && direct != nil && !p.Direct() && !forced && ctx.Err() == nil {
+		log.Warnf("fallback direct: every server failed to connect %s, last error %v", addr, err)
+		rConn, timeout, err = this.dial(ctx, direct, addr)
+		if err == nil {
+			this.cache.Set(addr, true)
+			p = direct
+			meta.rerouted(direct, ReasonDirect)
+		}
+	}
+	return p, rConn, timeout, err
+}
+
+// relay copies between the client and the upstream connection of a tunnel
+// until both directions are finished, then closes both.
+func (this *httpListener) relay(lConn, rConn net.Conn, proxy proxy.Proxy, addr string, timeout time.Duration, meta *RequestMeta) {
+	start := time.Now()
+	// the dialer can't set TCP_NODELAY, Go sets it once connected. The
+	// connections of the servers are wrapped and keep it.
+	if tcpConn, ok := rConn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(this.noDelay)
+	}
+	rConn = &meteredConn{Conn: newFirstByteConn(rConn, func(d time.Duration) {
+		stats.Global.Observe(stats.MetricFirstByte, proxy.Name(), stats.OutcomeSuccess, d)
+	}), name: proxy.Name()}
+	stats.Global.AddActive(proxy.Name(), 1)
+	defer stats.Global.AddActive(proxy.Name(), -1)
+	if this.idleTimeout > 0 {
+		idle := newIdleWatch(this.idleTimeout, meta)
+		lConn = idle.wrap(lConn)
+		rConn = idle.wrap(rConn)
+		this.idles.Store(idle, struct{}{})
+		defer this.idles.Delete(idle)
+	}
+	// each direction is limited where it is written
+	lConn = throttle(lConn, this.rateLimit)
+	rConn = throttle(rConn, this.rateLimit)
+
+	done := make(chan struct{})
+	go func() {
+		n, _ := this.Pipe(lConn, rConn, timeout)
+		meta.addOut(n)
+		close(done)
+	}()
+	n, _ := this.Pipe(rConn, lConn, timeout)
+	meta.addIn(n)
+
+	// each Pipe may only half-close its destination, so the tunnel is torn
+	// down once both directions are finished
+	<-done
+	lConn.Close()
+	rConn.Close()
+
+	stats.Global.Observe(stats.MetricTunnel, proxy.Name(), stats.OutcomeSuccess, time.Since(start))
+	if this.accessLog == nil {
+		this.logTunnel(proxy, addr, time.Since(start), meta)
+	}
+}
+
+// reapIdle closes the tunnels idle for idleTimeout.
+func (this *httpListener) reapIdle() {
+	now := time.Now()
+	this.idles.Range(func(key, value interface{}) bool {
+		if key.(*idleWatch).reap(now) {
+			this.idles.Delete(key)
+		}
+		return true
+	})
+}
+
+// dial connects to addr through p, recording the outcome unless ctx ended
+// the dial.
+func (this *httpListener) dial(ctx context.Context, p proxy.Proxy, addr string) (net.Conn, time.Duration, error) {
+	start := time.Now()
+	conn, timeout, err := dialContext(ctx, p, "tcp", addr)
+	if err != nil && ctx.Err() != nil {
+		return nil, 0, err
+	}
+	this.report(p, err)
+	logDial(p, addr, conn, err)
+	if err != nil {
+		stats.Global.Observe(stats.MetricDial, p.Name(), stats.OutcomeFailure, time.Since(start))
+		stats.Global.AddError(p.Name())
+		return nil, 0, err
+	}
+	stats.Global.Observe(stats.MetricDial, p.Name(), stats.OutcomeSuccess, time.Since(start))
+	return conn, timeout, nil
+}
+
+// dialContext dials addr through p, giving up when ctx is done first. The
+// connection is closed should it arrive later.
+func dialContext(ctx context.Context, p proxy.Proxy, network, addr string) (net.Conn, time.Duration, error) {
+	if ctx.Done() == nil {
+		return p.Dial(network, addr)
+	}
+	type dialed struct {
+		conn    net.Conn
+		timeout time.Duration
+		err     error
+	}
+	ch := make(chan dialed, 1)
+	go func() {
+		conn, timeout, err := p.Dial(network, addr)
+		ch <- dialed{conn, timeout, err}
+	}()
+	select {
+	case d := <-ch:
+		return d.conn, d.timeout, d.err
+	case <-ctx.Done():
+		go func() {
+			if d := <-ch; d.conn != nil {
+				d.conn.Close()
+			}
+		}()
+		return nil, 0, ctx.Err()
+	}
+}
+
+// isTimeout reports whether err, possibly annotated, is a timeout.
+func isTimeout(err error) bool {
+	err = errors.Cause(err)
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// dialRouted connects to addr the way a tunnel of a client would.
+func (this *httpListener) dialRouted(ctx context.Context, network, addr string) (net.Conn, error) {
+	p, _, err := this.route(addr)
+	if err != nil {
+		return nil, err
+	}
+	_, conn, _, err := this.dialRetry(ctx, p, addr)
+	return conn, err
+}
+
+// dialRetry connects to addr through p, moving on to the next upstream
+// while the dial fails. It returns the upstream that connected, or the last
+// one tried.
+func (this *httpListener) dialRetry(ctx context.Context, p proxy.Proxy, addr string) (proxy.Proxy, net.Conn, time.Duration, error) {
+	conn, timeout, err := this.dial(ctx, p, addr)
+	for tried := []proxy.Proxy{p}; err != nil && ctx.Err() == nil; {
+		next := this.nextProxy(addr, tried)
+		if next == nil {
+			break
+		}
+		log.Warnln(p.Name(), addr, err, "retry through", next.Name())
+		p = next
+		tried = append(tried, p)
+		conn, timeout, err = this.dial(ctx, p, addr)
+	}
+	return p, conn, timeout, err
+}
+
+// nextProxy returns the upstream to try after those in tried failed to
+// connect to addr, or nil. Direct connections are left to the fallback.
+func (this *httpListener) nextProxy(addr string, tried []proxy.Proxy) proxy.Proxy {
+	if len(tried) >= this.dialAttempts || tried[len(tried)-1].Direct() {
+		return nil
+	}
+	proxies := this.routes().proxies
+	var rest []proxy.Proxy
+	for _, p := range proxies {
+		if !containsProxy(tried, p) {
+			rest = append(rest, p)
+		}
+	}
+	p, err := this.selectProxyFunc(addr, rest, false)
+	if err != nil || p.Direct() {
+		return nil
+	}
+	return p
+}
+
+func containsProxy(list []proxy.Proxy, p proxy.Proxy) bool {
+	for _, value := range list {
+		if value == p {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *httpListener) dialOnce(ctx context.Context, p proxy.Proxy, network, addr string) (net.Conn, error) {
+	start := time.Now()
+	conn, _, err := dialContext(ctx, p, network, addr)
+	if err != nil && ctx.Err() != nil {
+		return nil, err
+	}
+	this.report(p, err)
+	logDial(p, addr, conn, err)
+	outcome := stats.OutcomeSuccess
+	if err != nil {
+		outcome = stats.OutcomeFailure
+	}
+	stats.Global.Observe(stats.MetricDial, p.Name(), outcome, time.Since(start))
+	return conn, err
 }
 
 func (this *httpListener) HandleHttp(w http.ResponseWriter, r *http.Request, proxy proxy.Proxy) {
-	tr := http.Transport{
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			conn, _, err := proxy.Dial(network, addr)
-			return conn, err
-		},
+	if !this.schemes[strings.ToLower(r.URL.Scheme)] {
+		log.Warnln(r.RemoteAddr, "unsupported scheme", r.URL.Scheme)
+		this.deny(r, r.URL.String(), DenyBadRequest)
+		http.Error(w, "Bad Request.", http.StatusBadRequest)
+		return
+	}
+	// websocket upgrades travel as ordinary http requests
+	switch strings.ToLower(r.URL.Scheme) {
+	case "ws":
+		r.URL.Scheme = "http"
+	case "wss":
+		r.URL.Scheme = "https"
+	}
+
+	removeHopHeaders(r.Header)
+	first := proxy
+
+	stats.Global.AddActive(proxy.Name(), 1)
+	defer stats.Global.AddActive(proxy.Name(), -1)
+
+	r.Header.Add(hopHeader, this.instanceID)
+
+	// the deadline covers the body as well, not just the response header
+	ctx := r.Context()
+	routes := this.routes()
+	// an upgraded connection lives on past the response
+	if timeout := routes.responseTimeouts[proxy.Name()]; timeout > 0 && upgradeType(r.Header) == "" {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
 	}
 
-	r.Close = true
-	resp, err := tr.RoundTrip(r)
+	if limiter := newLimiter(this.rateLimit); limiter != nil && r.Body != nil && r.Body != http.NoBody {
+		r.Body = &throttledReader{ReadCloser: r.Body, limiter: limiter}
+	}
+	start := time.Now()
+	forced := MetaFrom(r.Context()).forcedProxy()
+	resp, dialed, err := this.roundTrip(r, &proxy)
+	if proxy != first {
+		MetaFrom(r.Context()).rerouted(proxy, ReasonRetry)
+	}
+	// only a request without body can be sent again
+	if fb := routes.fallback.For(proxy); err != nil && fb != nil && ctx.Err() == nil && (r.Body == nil || r.Body == http.NoBody) {
+		stats.Global.Observe(stats.MetricFirstByte, proxy.Name(), stats.OutcomeFailure, time.Since(start))
+		stats.Global.AddError(proxy.Name())
+		log.Warnln(proxy.Name(), r.Host, err, "retry through", fb.Name())
+		proxy = fb
+		start = time.Now()
+		resp, dialed, err = this.roundTripOnce(r, r.Body, proxy)
+		if err == nil {
+			routes.fallback.Remember(r.Host)
+			MetaFrom(r.Context()).rerouted(proxy, ReasonFallback)
+		}
+	}
+	// only a request no server got a connection for is sent directly, and
+	// only one that could do no harm sent twice, should the failure be
+	// misread
+	if direct := routes.fallbackDirect; err != nil && direct != nil && !proxy.Direct() && !forced && ctx.Err() == nil && !dialed && replayable(r) {
+		stats.Global.Observe(stats.MetricFirstByte, proxy.Name(), stats.OutcomeFailure, time.Since(start))
+		stats.Global.AddError(proxy.Name())
+		log.Warnf("fallback direct: every server failed to request %s, last error %v", r.Host, err)
+		proxy = direct
+		start = time.Now()
+		resp, _, err = this.roundTripOnce(r, r.Body, proxy)
+		if err == nil {
+			this.cache.Set(r.Host, true)
+			MetaFrom(r.Context()).rerouted(proxy, ReasonDirect)
+		}
+	}
+	if _, pooled := proxy.(HttpTransport); pooled && r.Context().Err() == nil {
+		// the direct pool dials ahead, the exchange is what fails
+		this.health.Report(proxy, err)
+	}
 	if err != nil {
+		stats.Global.Observe(stats.MetricFirstByte, proxy.Name(), stats.OutcomeFailure, time.Since(start))
+		stats.Global.AddError(proxy.Name())
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Errorln(proxy.Name(), r.Host, "response header timeout")
+			this.fail(w, http.StatusGatewayTimeout)
+			return
+		}
 		log.Errorln("request error: ", err)
+		this.fail(w, http.StatusBadGateway)
 		return
 	}
+	stats.Global.Observe(stats.MetricFirstByte, proxy.Name(), stats.OutcomeSuccess, time.Since(start))
 	defer resp.Body.Close()
 
+	if !this.checkRedirect(r, resp) {
+		this.deny(r, r.URL.String(), DenyLocalRedirect)
+		this.fail(w, http.StatusForbidden)
+		return
+	}
+
+	removeHopHeaders(resp.Header)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		this.relayUpgrade(w, r, resp, proxy)
+		return
+	}
 	for k, values := range resp.Header {
 		for _, v := range values {
 			w.Header().Add(k, v)
 		}
 	}
+	if this.viaHeader && this.trusted(r) {
+		w.Header().Set("X-Coral-Via", proxy.Name())
+	}
 	w.WriteHeader(resp.StatusCode)
 
-	io.Copy(w, resp.Body)
+	var body io.Writer = w
+	if limiter := newLimiter(this.rateLimit); limiter != nil {
+		body = &throttledWriter{Writer: w, limiter: limiter}
+	}
+	n, err := io.Copy(body, resp.Body)
+	stats.Global.AddBytes(proxy.Name(), n)
+	MetaFrom(r.Context()).addIn(n)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		// the status is already sent, cut the connection so the client
+		// can't take the truncated body for a complete one
+		log.Errorln(proxy.Name(), r.Host, "response body timeout after", n, "bytes")
+		stats.Global.AddError(proxy.Name())
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// isProbe reports whether r asks coral itself for the probe path, a proxy
+// request for the same path on another host is proxied as usual.
+func (this *httpListener) isProbe(r *http.Request) bool {
+	return this.probePath != "" && r.Method == "GET" && !r.URL.IsAbs() && r.URL.Path == this.probePath
+}
+
+// checkRedirect logs the target of a redirect and reports whether it may
+// be passed on to the client, which follows it itself.
+func (this *httpListener) checkRedirect(r *http.Request, resp *http.Response) bool {
+	if resp.StatusCode < 300 || resp.StatusCode > 399 || (!this.logRedirects && !this.blockRedirects) {
+		return true
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return true
+	}
+	if this.logRedirects {
+		log.WithFields(log.Fields{
+			"status":   resp.StatusCode,
+			"from":     r.URL.String(),
+			"location": location.String(),
+		}).Infoln("redirect")
+	}
+	// a local site may still redirect within the local network
+	return !this.blockRedirects || !utils.IsLocalHost(location.Hostname()) || utils.IsLocalHost(r.URL.Hostname())
 }
 
 func (this *httpListener) DefaultSelectProxy(addr string, proxies []proxy.Proxy, direct bool) (proxy.Proxy, error) {
-	// first match proxy
+	return this.chooseProxy(addr, proxies, direct, false)
+}
+
+// chooseProxy is the default selection. With peek it only tells what it
+// would choose: the exclusions change and count nothing, and the canary
+// is left to its share of requests instead of drawn.
+func (this *httpListener) chooseProxy(addr string, proxies []proxy.Proxy, direct, peek bool) (proxy.Proxy, error) {
+	if name := this.overrides.Match(hostname(addr)); name != "" {
+		for _, value := range proxies {
+			if value.Name() == name {
+				return value, nil
+			}
+		}
+		log.Warnln("route override server not found:", name)
+	}
+
+	var canary proxy.Proxy
+	if !direct && this.canary != nil {
+		for _, value := range proxies {
+			if value.Name() == this.canary.name {
+				canary = value
+				break
+			}
+		}
+	}
+	// a stopped canary is still the last resort, an excluded one is not
+	lastResort := canary
+	if canary != nil {
+		switch {
+		case this.canary.Stopped():
+			if !peek {
+				this.logExclusion(canary, ExcludeCanaryStopped)
+			}
+		case this.excluded(canary, peek) != "":
+			lastResort = nil
+		case !peek && this.canary.pick():
+			return canary, nil
+		}
+	}
+
+	var candidates []proxy.Proxy
 	for _, value := range proxies {
-		if direct == value.Direct() {
-			return value, nil
+		if direct == value.Direct() && value != canary && this.excluded(value, peek) == "" {
+			candidates = append(candidates, value)
+		}
+	}
+	if len(candidates) == 0 {
+		if this.routes().directOnly && !direct {
+			return this.chooseProxy(addr, proxies, true, peek)
+		}
+		if lastResort != nil {
+			return lastResort, nil
 		}
+		// with every server left out, refusing every request helps no one,
+		// they are all tried and the dial moves on from a dead one
+		for _, value := range proxies {
+			if direct == value.Direct() && value != canary {
+				candidates = append(candidates, value)
+			}
+		}
+		if len(candidates) == 0 && canary != nil {
+			candidates = append(candidates, canary)
+		}
+		if len(candidates) == 0 {
+			return nil, errors.NotFoundf("proxy: %v", direct)
+		}
+		if !peek {
+			log.Debugln("every server excluded, selecting among all for", addr)
+		}
+	}
+	switch {
+	case this.loadBalance == LBLeastConn:
+		return leastConn(candidates), nil
+	case this.loadBalance == LBBackup:
+		return this.backup(candidates, peek), nil
+	case this.loadBalance == LBLatency:
+		return this.prober.Lowest(candidates), nil
+	case this.loadBalance == LBWeighted:
+		return weighted(candidates, this.routes().weights, rand.Intn), nil
+	default:
+		// first match proxy
+		return candidates[0], nil
+	}
+}
+
+// report records the outcome of a dial through p.
+func (this *httpListener) report(p proxy.Proxy, err error) {
+	stats.Global.AddDial(p.Name())
+	if err != nil {
+		stats.Global.AddDialFailure(p.Name())
+	} else {
+		stats.Global.AddDialSuccess(p.Name())
+	}
+	this.failures.Report(p.Name(), err)
+	this.health.Report(p, err)
+	this.breaker.Report(p, err)
+	if this.canary != nil && p.Name() == this.canary.name && this.canary.report(err) {
+		this.webhook.Notify(p.Name(), "canary stopped")
 	}
-	return nil, errors.NotFoundf("proxy: %s", direct)
 }
 
-func (this *httpListener) Pipe(src, dst net.Conn, timeout time.Duration) error {
+// Pipe copies src to dst. Without a timeout, once the first read went
+// through the wrappers of the conns, TCP connections are handed to the kernel
+// to relay without copying; reads with a deadline need the buffered loop.
+func (this *httpListener) Pipe(src, dst net.Conn, timeout time.Duration) (int64, error) {
+	var (
+		written int64
+		eof     bool
+		empty   int
+	)
+	splice := timeout == 0
 	buf := leakybuf.GlobalLeakyBuf.Get()
 	for {
 		if timeout != 0 {
 			src.SetReadDeadline(time.Now().Add(timeout))
 		}
 		n, err := src.Read(buf)
+		// a broken conn returning (0, nil) forever would spin this loop
+		if n == 0 && err == nil {
+			if empty++; empty >= maxEmptyReads {
+				log.Debugln("pipe:", io.ErrNoProgress)
+				break
+			}
+			continue
+		}
+		empty = 0
 		// read may return EOF with n > 0
 		// should always process n > 0 bytes before handling error
 		if n > 0 {
@@ -201,21 +1257,153 @@ func (this *httpListener) Pipe(src, dst net.Conn, timeout time.Duration) error {
 			if _, err := dst.Write(buf[0:n]); err != nil {
 				break
 			}
+			written += int64(n)
+			if splice && err == nil {
+				splice = false
+				if n, err, ok := spliceConn(dst, src); ok {
+					written += n
+					eof = err == nil
+					break
+				}
+			}
 		}
 		if err != nil {
 			// Always "use of closed network connection", but no easy way to
 			// identify this specific error. So just leave the error along for now.
 			// More info here: https://code.google.com/p/go/issues/detail?id=4373
+			eof = err == io.EOF
 			break
 		}
 	}
 	leakybuf.GlobalLeakyBuf.Put(buf)
-	dst.Close()
+
+	// A clean EOF is a half-close from src: pass the FIN on and keep the
+	// other direction open. Anything else tears the whole connection down.
+	if cw, ok := dst.(closeWriter); ok && eof {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+	return written, nil
+}
+
+// tuneConn applies the configured socket buffer sizes and keepalive to an
+// accepted connection, outbound ones get them from their dialer.
+func (this *httpListener) tuneConn(conn net.Conn) {
+	tcpConn, ok := tcpConn(conn)
+	if !ok {
+		return
+	}
+	if this.readBuffer > 0 {
+		tcpConn.SetReadBuffer(this.readBuffer)
+	}
+	if this.writeBuffer > 0 {
+		tcpConn.SetWriteBuffer(this.writeBuffer)
+	}
+	tcpConn.SetKeepAlive(this.keepAlive > 0)
+	if this.keepAlive > 0 {
+		tcpConn.SetKeepAlivePeriod(this.keepAlive)
+	}
+	tcpConn.SetNoDelay(this.noDelay)
+}
+
+// listener restart backoff, doubling up to the maximum. The restart count
+// starts over once the listener served for restartReset.
+const (
+	restartBackoff    = time.Second
+	restartMaxBackoff = time.Second * 30
+	restartReset      = time.Minute
+)
+
+// Pipe gives up on a source after this many consecutive empty reads, as
+// bufio does.
+const maxEmptyReads = 100
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// hostname strips the port, and the brackets of an IPv6 literal, from addr.
+func hostname(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return strings.Trim(addr, "[]")
+	}
+	return host
+}
+
+// connectTarget extracts host:port from a CONNECT request. Besides the
+// authority-form it accepts the malformed absolute-form some clients send
+// ("CONNECT http://host:port/"), and defaults a missing port to 443.
+// Credentials in the authority are dropped, they never reach the upstream.
+func connectTarget(r *http.Request) (string, error) {
+	target := r.RequestURI
+	if target == "" {
+		target = r.Host
+	}
+	if strings.Contains(target, "://") {
+		u, err := url.Parse(target)
+		if err != nil || u.Host == "" {
+			return "", errors.NotValidf("connect target %q", target)
+		}
+		target = u.Host
+		if u.Port() == "" {
+			port := "443"
+			if u.Scheme == "http" {
+				port = "80"
+			}
+			target = net.JoinHostPort(u.Hostname(), port)
+		}
+	}
+	if i := strings.LastIndexByte(target, '@'); i >= 0 {
+		target = target[i+1:]
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		switch {
+		case strings.HasPrefix(target, "[") && strings.HasSuffix(target, "]"):
+			host, port = target[1:len(target)-1], "443"
+		case !strings.ContainsAny(target, ":/ "):
+			host, port = target, "443"
+		default:
+			return "", errors.NotValidf("connect target %q", target)
+		}
+	}
+	if host == "" || port == "" {
+		return "", errors.NotValidf("connect target %q", target)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", errors.NotValidf("connect target %q", target)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// normalizeRequest reconciles the request line and the Host header so the
+// request can be sent by a Transport. An absolute-form request line wins
+// over a disagreeing Host.
+func normalizeRequest(r *http.Request) error {
+	switch {
+	case r.URL.Host == "" && r.Host == "":
+		return errors.NotValidf("request without host %q", r.RequestURI)
+	case r.URL.Host == "":
+		r.URL.Host = r.Host
+	case r.Host == "":
+		r.Host = r.URL.Host
+	case !strings.EqualFold(r.URL.Host, r.Host):
+		log.Warnf("host mismatch, request line %q, Host %q", r.URL.Host, r.Host)
+		r.Host = r.URL.Host
+	}
+	if r.URL.Scheme == "" {
+		r.URL.Scheme = "http"
+	}
 	return nil
 }
 
-func (this *httpListener) AuthUser(user, pwd string) bool {
-	return true
+// AuthUser checks the credentials of a client of the listener port, an
+// account limited to another port fails. Port 0 only passes the accounts
+// limited to no port.
+func (this *httpListener) AuthUser(user, pwd string, port int) bool {
+	return len(this.users) == 0 || this.authUser(user, pwd, port)
 }
 
 func (this *httpListener) AuthIP(ip string) bool {
@@ -228,11 +1416,22 @@ func (this *httpListener) AuthIP(ip string) bool {
 	return true
 }
 
+// trusted reports whether the client is explicitly listed in the whitelist.
+func (this *httpListener) trusted(r *http.Request) bool {
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return this.whitelist[ip]
+}
+
 func (this *httpListener) auth(w http.ResponseWriter, r *http.Request) bool {
 	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if len(this.allowedClients) > 0 && !this.allowedClients.Contains(ip) {
+		this.deny(r, r.Host, DenyClientNotAllowed)
+		http.Error(w, "Forbidden.", http.StatusForbidden)
+		return false
+	}
 	auth := this.AuthIP(ip)
 	if !auth {
-		log.Warnln(r.RemoteAddr, r.Method, r.Host)
+		this.deny(r, r.Host, DenyClientNotAllowed)
 		this.badAuth(w)
 	}
 	return auth
@@ -241,3 +1440,17 @@ func (this *httpListener) auth(w http.ResponseWriter, r *http.Request) bool {
 func (this *httpListener) badAuth(w http.ResponseWriter) {
 	http.Error(w, "Unauthorized.", http.StatusUnauthorized)
 }
+
+// errorCode returns the status answering a blocked or failed request,
+// httpErrorCode in place of code when it is set.
+func (this *httpListener) errorCode(code int) int {
+	if this.httpErrorCode != 0 {
+		return this.httpErrorCode
+	}
+	return code
+}
+
+func (this *httpListener) fail(w http.ResponseWriter, code int) {
+	code = this.errorCode(code)
+	http.Error(w, http.StatusText(code)+".", code)
+}
@@ -0,0 +1,118 @@
+package httpproxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/chinaboard/coral/config"
+	"github.com/chinaboard/coral/core/proxy"
+	"github.com/chinaboard/coral/core/tlsclient"
+	"github.com/juju/errors"
+)
+
+// handshakeTimeout bounds the CONNECT exchange with the proxy.
+const handshakeTimeout = 30 * time.Second
+
+// HttpProxy tunnels through an HTTP proxy with CONNECT, over TLS for an
+// https proxy.
+type HttpProxy struct {
+	name        string
+	Timeout     time.Duration
+	Address     string
+	Host        string
+	TLS         bool
+	Fingerprint string
+	// the Proxy-Authorization header, empty without credentials
+	Auth   string
+	Dialer *net.Dialer
+}
+
+func New(server config.CoralServer, dialer *net.Dialer) (proxy.Proxy, error) {
+	p := &HttpProxy{
+		name:        server.Name,
+		Timeout:     server.ReadTimeout,
+		Address:     server.Address(),
+		Host:        server.Host,
+		TLS:         server.Type == "https",
+		Fingerprint: server.Fingerprint,
+		Dialer:      dialer,
+	}
+	if server.Username != "" {
+		p.Auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(server.Username+":"+server.Password))
+	}
+	return p, nil
+}
+
+func (this *HttpProxy) Dial(network, addr string) (net.Conn, time.Duration, error) {
+	conn, err := this.Dialer.Dial("tcp", this.Address)
+	if err != nil {
+		return nil, this.Timeout, err
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if this.TLS {
+		tlsConn, err := tlsclient.Client(conn, this.Host, this.Fingerprint)
+		if err != nil {
+			conn.Close()
+			return nil, this.Timeout, err
+		}
+		conn = tlsConn
+	}
+	c, err := this.connect(conn, addr)
+	if err != nil {
+		conn.Close()
+		return nil, this.Timeout, err
+	}
+	conn.SetDeadline(time.Time{})
+	return c, this.Timeout, nil
+}
+
+// connect sends the CONNECT request for addr and reads the answer.
+func (this *HttpProxy) connect(conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if this.Auth != "" {
+		req.Header.Set("Proxy-Authorization", this.Auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, errors.Annotate(err, "http proxy")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("http proxy CONNECT %s: %s", addr, resp.Status)
+	}
+	// the tunnel may have started within the read of the response
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+func (this *HttpProxy) Name() string {
+	return this.name
+}
+
+func (this *HttpProxy) Direct() bool {
+	return false
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
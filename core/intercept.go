@@ -0,0 +1,115 @@
+package core
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/chinaboard/coral/core/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+func (this *httpListener) shouldIntercept(addr string) bool {
+	if this.mitm == nil {
+		return false
+	}
+	return this.interceptHosts.Match(hostname(addr))
+}
+
+// HandleIntercept terminates the client TLS with a certificate issued by the
+// configured CA, passes every decrypted request through the filter and sends
+// it on over a fresh TLS connection through proxy.
+func (this *httpListener) HandleIntercept(w http.ResponseWriter, r *http.Request, proxy proxy.Proxy) {
+	hj, _ := w.(http.Hijacker)
+	lConn, _, err := hj.Hijack()
+	if err != nil && err != http.ErrHijacked {
+		log.Errorln("hijack", err)
+		return
+	}
+	defer lConn.Close()
+	this.tunnels.Add(lConn)
+	defer this.tunnels.Remove(lConn)
+	lConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+	host, _, _ := net.SplitHostPort(r.Host)
+	tlsConn := tls.Server(lConn, this.mitm.TLSConfig(host))
+	if err := tlsConn.Handshake(); err != nil {
+		log.Warnln("mitm handshake", r.RemoteAddr, r.Host, err)
+		return
+	}
+
+	tr := &http.Transport{
+		DialTLS: func(network, addr string) (net.Conn, error) {
+			conn, _, err := proxy.Dial(network, addr)
+			this.report(proxy, err)
+			logDial(proxy, addr, conn, err)
+			if err != nil {
+				return nil, err
+			}
+			serverName, _, _ := net.SplitHostPort(addr)
+			c := tls.Client(conn, &tls.Config{ServerName: serverName})
+			if err := c.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return c, nil
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	reader := bufio.NewReader(tlsConn)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Debugln("mitm read request", r.Host, err)
+			}
+			return
+		}
+		req.URL.Scheme = "https"
+		req.URL.Host = r.Host
+		req.RequestURI = ""
+		log.Infoln("mitm", proxy.Name(), r.RemoteAddr, req.Method, req.URL)
+
+		if this.filterFunc != nil {
+			if err := this.filterFunc(req); err != nil {
+				log.Debugln("mitm filtered", req.URL, err)
+				this.deny(r, req.URL.String(), DenyFiltered)
+				io.Copy(ioutil.Discard, req.Body)
+				req.Body.Close()
+				writeResponse(tlsConn, this.errorCode(http.StatusForbidden))
+				continue
+			}
+		}
+
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			log.Errorln("mitm request error:", req.URL, err)
+			writeResponse(tlsConn, this.errorCode(http.StatusBadGateway))
+			return
+		}
+		err = resp.Write(tlsConn)
+		resp.Body.Close()
+		if err != nil || resp.Close || req.Close {
+			return
+		}
+	}
+}
+
+func writeResponse(w io.Writer, code int) error {
+	body := fmt.Sprintf("%d %s\n", code, http.StatusText(code))
+	resp := &http.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	return resp.Write(w)
+}
@@ -0,0 +1,124 @@
+package core
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCA writes a CA certificate and its key to dir and returns their
+// paths and the pool trusting it.
+func writeTestCA(t *testing.T, dir string) (certFile, keyFile string, pool *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "coral test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "ca.crt")
+	keyFile = filepath.Join(dir, "ca.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestIntercept(t *testing.T) {
+	certFile, keyFile, pool := writeTestCA(t, t.TempDir())
+	l := newTestListener(t, "interceptHosts = [\"example.com\"]\nmitmCert = "+certFile+"\nmitmKey = "+keyFile+"\n")
+	if !l.shouldIntercept("www.example.com:443") || l.shouldIntercept("example.org:443") {
+		t.Fatal("intercepted hosts don't follow interceptHosts")
+	}
+	l.RegisterFilter(func(r *http.Request) error {
+		if r.URL.Path == "/blocked" {
+			return errors.New("blocked")
+		}
+		return nil
+	})
+
+	// the origin's certificate isn't signed by a trusted CA, re-originating
+	// TLS to it must fail
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request sent to an untrusted origin")
+	}))
+	defer origin.Close()
+	dialed := make(chan string, 1)
+	upstream := &stubProxy{name: "upstream", dial: func(network, addr string) (net.Conn, error) {
+		dialed <- addr
+		return net.Dial(network, origin.Listener.Addr().String())
+	}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.HandleIntercept(w, r, upstream)
+	}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("CONNECT www.example.com:443 HTTP/1.1\r\nHost: www.example.com:443\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("CONNECT:", resp, err)
+	}
+	// the client trusts the test CA and sees a certificate for the host
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "www.example.com", RootCAs: pool})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal("handshake with the generated certificate:", err)
+	}
+	tr := bufio.NewReader(tlsConn)
+
+	tlsConn.Write([]byte("GET /blocked HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+	resp, err = http.ReadResponse(tr, nil)
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatal("filtered request:", resp, err)
+	}
+	resp.Body.Close()
+	select {
+	case addr := <-dialed:
+		t.Fatal("filtered request dialed", addr)
+	default:
+	}
+
+	tlsConn.Write([]byte("GET /ok HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+	resp, err = http.ReadResponse(tr, nil)
+	if err != nil || resp.StatusCode != http.StatusBadGateway {
+		t.Fatal("request to an untrusted origin:", resp, err)
+	}
+	if addr := <-dialed; addr != "www.example.com:443" {
+		t.Errorf("dialed %s, want the CONNECT host", addr)
+	}
+}
@@ -0,0 +1,56 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// janitor runs every periodic cleanup task from a single ticker so the
+// reclamation cadence is set in one place.
+type janitor struct {
+	sync.Mutex
+	interval time.Duration
+	tasks    []func()
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newJanitor(interval time.Duration) *janitor {
+	return &janitor{interval: interval, done: make(chan struct{})}
+}
+
+func (j *janitor) Add(task func()) {
+	j.Lock()
+	defer j.Unlock()
+	j.tasks = append(j.tasks, task)
+}
+
+func (j *janitor) Start() {
+	go func() {
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				j.run()
+			case <-j.done:
+				return
+			}
+		}
+	}()
+}
+
+func (j *janitor) run() {
+	j.Lock()
+	tasks := j.tasks
+	j.Unlock()
+	for _, task := range tasks {
+		task()
+	}
+}
+
+func (j *janitor) Stop() {
+	j.once.Do(func() {
+		close(j.done)
+	})
+}
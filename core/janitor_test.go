@@ -0,0 +1,76 @@
+package core
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestJanitorRunsTasks(t *testing.T) {
+	j := newJanitor(10 * time.Millisecond)
+	ticks := make(chan struct{}, 1)
+	j.Add(func() {
+		select {
+		case ticks <- struct{}{}:
+		default:
+		}
+	})
+	j.Start()
+	defer j.Stop()
+	select {
+	case <-ticks:
+	case <-time.After(time.Second):
+		t.Fatal("task not run on the tick")
+	}
+}
+
+func TestJanitorReapsIdleTunnels(t *testing.T) {
+	l := &httpListener{}
+	idle, idlePeer := net.Pipe()
+	busy, busyPeer := net.Pipe()
+	defer busy.Close()
+	defer busyPeer.Close()
+
+	idleWatch := newIdleWatch(50*time.Millisecond, nil)
+	idleWatch.wrap(idle)
+	l.idles.Store(idleWatch, struct{}{})
+	busyWatch := newIdleWatch(50*time.Millisecond, nil)
+	busyConn := busyWatch.wrap(busy)
+	l.idles.Store(busyWatch, struct{}{})
+	go func() {
+		b := make([]byte, 1)
+		for {
+			if _, err := busyConn.Read(b); err != nil {
+				return
+			}
+		}
+	}()
+
+	j := newJanitor(10 * time.Millisecond)
+	j.Add(l.reapIdle)
+	j.Start()
+	defer j.Stop()
+
+	closed := make(chan struct{})
+	go func() {
+		idlePeer.Read(make([]byte, 1))
+		close(closed)
+	}()
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case <-closed:
+			if _, err := busyPeer.Write([]byte{0}); err != nil {
+				t.Fatal("busy tunnel reaped:", err)
+			}
+			if _, ok := l.idles.Load(idleWatch); ok {
+				t.Error("reaped tunnel still watched")
+			}
+			return
+		case <-deadline:
+			t.Fatal("idle tunnel not reaped")
+		case <-time.After(5 * time.Millisecond):
+			busyPeer.Write([]byte{0})
+		}
+	}
+}
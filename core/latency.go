@@ -0,0 +1,131 @@
+package core
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chinaboard/coral/core/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// weight of a new probe in the moving average
+const latencyAlpha = 0.3
+
+// latency of a server that failed its last probe or was never probed
+const latencyInfinite = time.Duration(math.MaxInt64)
+
+// prober dials a known host through every server periodically and keeps an
+// exponentially weighted moving average of the connect time.
+type prober struct {
+	target   string
+	interval time.Duration
+	servers  sync.Map // name -> *int64 nanoseconds
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newProber(target string, interval time.Duration) *prober {
+	return &prober{target: target, interval: interval, done: make(chan struct{})}
+}
+
+// Start probes the servers returned by proxies now and every interval.
+func (p *prober) Start(proxies func() []proxy.Proxy) {
+	if p == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			p.probe(proxies())
+			select {
+			case <-ticker.C:
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+func (p *prober) Stop() {
+	if p == nil {
+		return
+	}
+	p.once.Do(func() {
+		close(p.done)
+	})
+}
+
+func (p *prober) probe(proxies []proxy.Proxy) {
+	var wg sync.WaitGroup
+	for _, value := range proxies {
+		if value.Direct() {
+			continue
+		}
+		wg.Add(1)
+		go func(value proxy.Proxy) {
+			defer wg.Done()
+			start := time.Now()
+			conn, _, err := value.Dial("tcp", p.target)
+			if err != nil {
+				log.Debugln("latency probe", value.Name(), err)
+				p.set(value.Name(), latencyInfinite)
+				return
+			}
+			conn.Close()
+			p.observe(value.Name(), time.Since(start))
+		}(value)
+	}
+	wg.Wait()
+}
+
+func (p *prober) get(name string) *int64 {
+	if v, ok := p.servers.Load(name); ok {
+		return v.(*int64)
+	}
+	v, _ := p.servers.LoadOrStore(name, newLatency())
+	return v.(*int64)
+}
+
+func newLatency() *int64 {
+	v := int64(latencyInfinite)
+	return &v
+}
+
+func (p *prober) set(name string, d time.Duration) {
+	atomic.StoreInt64(p.get(name), int64(d))
+}
+
+func (p *prober) observe(name string, rtt time.Duration) {
+	v := p.get(name)
+	prev := time.Duration(atomic.LoadInt64(v))
+	if prev == latencyInfinite {
+		// a server coming back starts over from its first probe
+		atomic.StoreInt64(v, int64(rtt))
+		return
+	}
+	atomic.StoreInt64(v, int64(latencyAlpha*float64(rtt)+(1-latencyAlpha)*float64(prev)))
+}
+
+// Latency returns the average connect time through the server, or
+// latencyInfinite when it is unknown or the last probe failed.
+func (p *prober) Latency(name string) time.Duration {
+	if p == nil {
+		return latencyInfinite
+	}
+	return time.Duration(atomic.LoadInt64(p.get(name)))
+}
+
+// Lowest returns the proxy with the lowest latency, the first one on a tie.
+func (p *prober) Lowest(proxies []proxy.Proxy) proxy.Proxy {
+	best := proxies[0]
+	min := p.Latency(best.Name())
+	for _, value := range proxies[1:] {
+		if d := p.Latency(value.Name()); d < min {
+			best, min = value, d
+		}
+	}
+	return best
+}
@@ -1,8 +1,134 @@
 package core
 
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chinaboard/coral/core/proxy"
+	"github.com/chinaboard/coral/stats"
+)
+
+// load balance modes choosing among the matching upstreams
+const (
+	LBFirst     = "first"
+	LBLeastConn = "leastconn"
+	LBBackup    = "backup"
+	LBLatency   = "latency"
+	LBWeighted  = "weighted"
+)
+
+const (
+	// a server is failing after this many dial errors in a row
+	backupMaxFailures = 3
+	// a failing server gets a dial again after this long
+	backupRetry = time.Second * 30
+)
+
 type LB interface {
 	//Get(string, []Proxy) Proxy
 }
 
 type RandomLB struct {
 }
+
+// weighted picks a proxy at random, each with the probability of its share
+// of the total weight, drawn from intn. Proxies without a configured weight
+// count as 1.
+func weighted(proxies []proxy.Proxy, weights map[string]int, intn func(int) int) proxy.Proxy {
+	weight := func(p proxy.Proxy) int {
+		if w, ok := weights[p.Name()]; ok {
+			return w
+		}
+		return 1
+	}
+	total := 0
+	for _, p := range proxies {
+		total += weight(p)
+	}
+	n := intn(total)
+	for _, p := range proxies {
+		if n -= weight(p); n < 0 {
+			return p
+		}
+	}
+	return proxies[len(proxies)-1]
+}
+
+// leastConn returns the proxy with the fewest open connections, ties are
+// broken randomly.
+func leastConn(proxies []proxy.Proxy) proxy.Proxy {
+	var (
+		best  proxy.Proxy
+		min   int64
+		count int
+	)
+	for _, p := range proxies {
+		active := stats.Global.Active(p.Name())
+		switch {
+		case best == nil || active < min:
+			best, min, count = p, active, 1
+		case active == min:
+			// reservoir sampling keeps every tied proxy equally likely
+			count++
+			if rand.Intn(count) == 0 {
+				best = p
+			}
+		}
+	}
+	return best
+}
+
+// failures counts the consecutive dial errors of each upstream, a
+// successful dial resets the count.
+type failures struct {
+	servers sync.Map // name -> *failureCount
+}
+
+type failureCount struct {
+	count int32
+	last  int64 // unix nano of the last failure
+}
+
+func (f *failures) get(name string) *failureCount {
+	if v, ok := f.servers.Load(name); ok {
+		return v.(*failureCount)
+	}
+	v, _ := f.servers.LoadOrStore(name, &failureCount{})
+	return v.(*failureCount)
+}
+
+func (f *failures) Report(name string, err error) {
+	c := f.get(name)
+	if err == nil {
+		atomic.StoreInt32(&c.count, 0)
+		return
+	}
+	atomic.StoreInt64(&c.last, time.Now().UnixNano())
+	atomic.AddInt32(&c.count, 1)
+}
+
+// Failing tells whether the upstream failed too often lately, it recovers
+// after backupRetry so that a dial can find out whether it is back.
+func (f *failures) Failing(name string) bool {
+	c := f.get(name)
+	if atomic.LoadInt32(&c.count) < backupMaxFailures {
+		return false
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.last))) < backupRetry
+}
+
+// backup returns the first proxy in order that isn't failing, or the first
+// one when they all are. With peek the skipped ones aren't counted.
+func (this *httpListener) backup(proxies []proxy.Proxy, peek bool) proxy.Proxy {
+	for _, p := range proxies {
+		if !this.failures.Failing(p.Name()) {
+			return p
+		}
+		if !peek {
+			this.logExclusion(p, ExcludeFailing)
+		}
+	}
+	return proxies[0]
+}
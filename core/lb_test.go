@@ -0,0 +1,93 @@
+package core
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chinaboard/coral/core/proxy"
+	"github.com/chinaboard/coral/stats"
+)
+
+// stubProxy is a server whose dials are answered by dial, or refused when
+// it is nil.
+type stubProxy struct {
+	name   string
+	direct bool
+	dial   func(network, addr string) (net.Conn, error)
+}
+
+func (p *stubProxy) Dial(network, addr string) (net.Conn, time.Duration, error) {
+	if p.dial == nil {
+		return nil, 0, errors.New("refused")
+	}
+	conn, err := p.dial(network, addr)
+	return conn, 0, err
+}
+
+func (p *stubProxy) Name() string { return p.name }
+
+func (p *stubProxy) Direct() bool { return p.direct }
+
+func TestWeighted(t *testing.T) {
+	proxies := []proxy.Proxy{&stubProxy{name: "a"}, &stubProxy{name: "b"}, &stubProxy{name: "c"}}
+	tests := []struct {
+		weights map[string]int
+		shares  map[string]float64
+	}{
+		{map[string]int{}, map[string]float64{"a": 1.0 / 3, "b": 1.0 / 3, "c": 1.0 / 3}},
+		{map[string]int{"a": 3, "b": 1}, map[string]float64{"a": 0.6, "b": 0.2, "c": 0.2}},
+		{map[string]int{"a": 1, "b": 0, "c": 9}, map[string]float64{"a": 0.1, "b": 0, "c": 0.9}},
+	}
+	const samples = 100000
+	for _, tt := range tests {
+		r := rand.New(rand.NewSource(1))
+		counts := map[string]int{}
+		for i := 0; i < samples; i++ {
+			counts[weighted(proxies, tt.weights, r.Intn).Name()]++
+		}
+		for name, share := range tt.shares {
+			got := float64(counts[name]) / samples
+			if math.Abs(got-share) > 0.01 {
+				t.Errorf("weights %v: %s got %.3f of the picks, want %.3f", tt.weights, name, got, share)
+			}
+		}
+	}
+}
+
+func TestLeastConn(t *testing.T) {
+	// names of their own, stats.Global is shared by every test
+	proxies := []proxy.Proxy{&stubProxy{name: "lc-a"}, &stubProxy{name: "lc-b"}, &stubProxy{name: "lc-c"}}
+	active := map[string]int64{"lc-a": 3, "lc-b": 1, "lc-c": 2}
+	for name, n := range active {
+		stats.Global.AddActive(name, n)
+	}
+	defer func() {
+		for name, n := range active {
+			stats.Global.AddActive(name, -n)
+		}
+	}()
+	if p := leastConn(proxies); p.Name() != "lc-b" {
+		t.Errorf("picked %s, want the least loaded lc-b", p.Name())
+	}
+
+	// a tie with lc-b, the picks are spread among both
+	stats.Global.AddActive("lc-c", -1)
+	active["lc-c"]--
+	const samples = 10000
+	counts := map[string]int{}
+	for i := 0; i < samples; i++ {
+		counts[leastConn(proxies).Name()]++
+	}
+	if counts["lc-a"] != 0 {
+		t.Errorf("the busiest lc-a picked %d times", counts["lc-a"])
+	}
+	for _, name := range []string{"lc-b", "lc-c"} {
+		if share := float64(counts[name]) / samples; math.Abs(share-0.5) > 0.05 {
+			t.Errorf("tied %s got %.3f of the picks, want 0.5", name, share)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package core
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// connLimit caps the requests and tunnels in flight, in all and per client
+// IP. A zero cap is no limit.
+type connLimit struct {
+	max       int64
+	perClient int
+	inUse     int64
+	sync.Mutex
+	clients map[string]int
+}
+
+func newConnLimit(max, perClient int) *connLimit {
+	return &connLimit{max: int64(max), perClient: perClient, clients: map[string]int{}}
+}
+
+// Acquire takes a slot for client, false means a cap is reached and the
+// connection must be refused. Every taken slot is given back by Release.
+func (l *connLimit) Acquire(client string) bool {
+	if n := atomic.AddInt64(&l.inUse, 1); l.max > 0 && n > l.max {
+		atomic.AddInt64(&l.inUse, -1)
+		return false
+	}
+	if l.perClient <= 0 {
+		return true
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.clients[client] >= l.perClient {
+		atomic.AddInt64(&l.inUse, -1)
+		return false
+	}
+	l.clients[client]++
+	return true
+}
+
+func (l *connLimit) Release(client string) {
+	atomic.AddInt64(&l.inUse, -1)
+	if l.perClient <= 0 {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.clients[client]--; l.clients[client] <= 0 {
+		delete(l.clients, client)
+	}
+}
+
+func (l *connLimit) InUse() int {
+	return int(atomic.LoadInt64(&l.inUse))
+}
+
+// Connections returns the requests and tunnels in flight and their cap, 0
+// when there is none.
+func (this *httpListener) Connections() (inUse, max int) {
+	return this.conns.InUse(), int(this.conns.max)
+}
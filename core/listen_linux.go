@@ -0,0 +1,54 @@
+//go:build linux
+// +build linux
+
+package core
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const reusePortSupported = true
+
+func listenTCP(addr string, reusePort bool, backlog int) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if reusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil || backlog <= 0 {
+		return ln, err
+	}
+
+	// calling listen(2) again on a listening socket only updates its backlog
+	rc, err := ln.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.Listen(int(fd), backlog)
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package core
+
+import (
+	"net"
+)
+
+const reusePortSupported = false
+
+func listenTCP(addr string, reusePort bool, backlog int) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
@@ -1,15 +1,35 @@
 package core
 
 import (
+	"context"
+	"net/http"
+
+	"github.com/chinaboard/coral/config"
 	"github.com/chinaboard/coral/core/proxy"
 )
 
 type SelectProxyFunc func(addr string, proxies []proxy.Proxy, direct bool) (proxy.Proxy, error)
 
+// HttpTransport is implemented by proxies keeping their own connection pool
+// for plain HTTP requests.
+type HttpTransport interface {
+	Transport() http.RoundTripper
+}
+
+// FilterFunc inspects an intercepted request, a non-nil error rejects it.
+type FilterFunc func(r *http.Request) error
+
 type Listener interface {
 	ListenAndServe() error
+	Shutdown(context.Context) error
+	Reload(*config.CoralConfig) error
 	RegisterProxy(proxy.Proxy) (bool, error)
 	RegisterLoadBalance(SelectProxyFunc) (bool, error)
+	RegisterFilter(FilterFunc) (bool, error)
 	AuthIP(string) bool
-	AuthUser(string, string) bool
+	AuthUser(user, passwd string, port int) bool
+	// Connections returns the requests and tunnels in flight and their cap
+	Connections() (inUse, max int)
+	// BreakerStatus returns the circuit state of each server
+	BreakerStatus() map[string]string
 }
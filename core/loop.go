@@ -0,0 +1,84 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hopHeader lists the coral instances a plain HTTP request went through.
+const hopHeader = "X-Coral-Hop"
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// looped reports whether r already passed this instance, or too many
+// others.
+func (this *httpListener) looped(r *http.Request) bool {
+	hops := 0
+	for _, value := range r.Header.Values(hopHeader) {
+		for _, id := range strings.Split(value, ",") {
+			if strings.TrimSpace(id) == this.instanceID {
+				return true
+			}
+			hops++
+		}
+	}
+	return this.maxHops > 0 && hops >= this.maxHops
+}
+
+// isSelf reports whether addr is an address this listener accepts on, a
+// tunnel to it would come straight back. Hostnames other than localhost
+// are not resolved.
+func (this *httpListener) isSelf(addr string) bool {
+	for _, listenAddr := range this.addrs {
+		if isListenAddr(addr, listenAddr) {
+			return true
+		}
+	}
+	if this.transparent != nil && isListenAddr(addr, this.transparent.addr) {
+		return true
+	}
+	return this.socks != nil && isListenAddr(addr, this.socks.addr)
+}
+
+// isListenAddr reports whether addr reaches a listener bound to listenAddr.
+func isListenAddr(addr, listenAddr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	listenHost, listenPort, err := net.SplitHostPort(listenAddr)
+	if err != nil || port != listenPort {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") || host == listenHost {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if listen := net.ParseIP(listenHost); listen != nil && !listen.IsUnspecified() {
+		return ip.Equal(listen)
+	}
+	// listening on all addresses, any local one is us
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLooped(t *testing.T) {
+	l := newTestListener(t, "maxHops = 3")
+	tests := []struct {
+		hops []string
+		want bool
+	}{
+		{nil, false},
+		{[]string{"a1"}, false},
+		{[]string{l.instanceID}, true},
+		{[]string{"a1, " + l.instanceID}, true},
+		{[]string{"a1", "b2, " + l.instanceID}, true},
+		{[]string{"a1, b2"}, false},
+		// too many other instances
+		{[]string{"a1, b2", "c3"}, true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		for _, v := range tt.hops {
+			r.Header.Add(hopHeader, v)
+		}
+		if got := l.looped(r); got != tt.want {
+			t.Errorf("looped with hops %q = %v, want %v", tt.hops, got, tt.want)
+		}
+	}
+}
+
+func TestIsListenAddr(t *testing.T) {
+	tests := []struct {
+		addr, listen string
+		want         bool
+	}{
+		{"127.0.0.1:5438", "127.0.0.1:5438", true},
+		{"localhost:5438", "127.0.0.1:5438", true},
+		{"LOCALHOST:5438", "0.0.0.0:5438", true},
+		{"127.0.0.2:5438", "0.0.0.0:5438", true},
+		{"[::1]:5438", "[::]:5438", true},
+		{"127.0.0.1:5439", "127.0.0.1:5438", false},
+		{"10.9.9.9:5438", "127.0.0.1:5438", false},
+		// names other than localhost aren't resolved
+		{"example.com:5438", "0.0.0.0:5438", false},
+		{"127.0.0.1", "127.0.0.1:5438", false},
+	}
+	for _, tt := range tests {
+		if got := isListenAddr(tt.addr, tt.listen); got != tt.want {
+			t.Errorf("isListenAddr(%s, %s) = %v, want %v", tt.addr, tt.listen, got, tt.want)
+		}
+	}
+}
+
+func TestLoopDetected(t *testing.T) {
+	l := newTestListener(t, `listen = ["127.0.0.1:5438", "[::1]:5439"]
+tunnelAllowedPort = [5438, 5439]`)
+	tests := []struct {
+		name string
+		r    *http.Request
+	}{
+		{"hop header", httptest.NewRequest("GET", "http://example.com/", nil)},
+		{"connect to self", httptest.NewRequest("CONNECT", "127.0.0.1:5438", nil)},
+		{"connect to localhost", httptest.NewRequest("CONNECT", "localhost:5438", nil)},
+		{"connect to second address", httptest.NewRequest("CONNECT", "[::1]:5439", nil)},
+	}
+	tests[0].r.Header.Set(hopHeader, l.instanceID)
+	for _, tt := range tests {
+		if tt.r.Method == "CONNECT" {
+			tt.r.RequestURI = tt.r.Host
+		}
+		w := httptest.NewRecorder()
+		l.ServeHTTP(w, tt.r)
+		if w.Code != http.StatusLoopDetected {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, http.StatusLoopDetected)
+		}
+	}
+}
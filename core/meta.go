@@ -0,0 +1,104 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/chinaboard/coral/core/proxy"
+)
+
+// RequestMeta follows a proxied request through its handlers, it is carried
+// by the request context.
+type RequestMeta struct {
+	ID     string
+	Client string
+	Start  time.Time
+	// set once the request is routed, and again if it is rerouted
+	Upstream string
+	Direct   bool
+	Reason   string
+	Cached   bool
+	// bytes sent to the client and to the upstream, updated atomically
+	BytesIn  int64
+	BytesOut int64
+}
+
+type metaKey struct{}
+
+var requestCount uint64
+
+// withMeta attaches a new RequestMeta to r.
+func (this *httpListener) withMeta(r *http.Request) (*http.Request, *RequestMeta) {
+	meta := this.newMeta(r.RemoteAddr)
+	return r.WithContext(context.WithValue(r.Context(), metaKey{}, meta)), meta
+}
+
+// newMeta starts the RequestMeta of a request from remoteAddr.
+func (this *httpListener) newMeta(remoteAddr string) *RequestMeta {
+	client, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		client = remoteAddr
+	}
+	return &RequestMeta{
+		ID:     fmt.Sprintf("%s-%d", this.instanceID, atomic.AddUint64(&requestCount, 1)),
+		Client: client,
+		Start:  time.Now(),
+	}
+}
+
+// MetaFrom returns the RequestMeta of a request context, or nil.
+func MetaFrom(ctx context.Context) *RequestMeta {
+	meta, _ := ctx.Value(metaKey{}).(*RequestMeta)
+	return meta
+}
+
+// routed records the upstream chosen for the request.
+func (m *RequestMeta) routed(p proxy.Proxy, c classification) {
+	if m == nil {
+		return
+	}
+	m.Upstream = p.Name()
+	m.Direct = p.Direct()
+	m.Reason = c.reason
+	m.Cached = c.cached
+}
+
+// rerouted records a change of upstream after the classification.
+func (m *RequestMeta) rerouted(p proxy.Proxy, reason string) {
+	if m == nil {
+		return
+	}
+	m.Upstream = p.Name()
+	m.Direct = p.Direct()
+	m.Reason = reason
+}
+
+func (m *RequestMeta) addIn(n int64) {
+	if m != nil {
+		atomic.AddInt64(&m.BytesIn, n)
+	}
+}
+
+func (m *RequestMeta) addOut(n int64) {
+	if m != nil {
+		atomic.AddInt64(&m.BytesOut, n)
+	}
+}
+
+// forcedProxy tells whether the request was sent through a server on
+// purpose, by a rule, proxyDomains or proxyPort, so it must not fall back to
+// a direct connection.
+func (m *RequestMeta) forcedProxy() bool {
+	if m == nil {
+		return false
+	}
+	switch m.Reason {
+	case ReasonRule, ReasonProxyDomain, ReasonProxyPort:
+		return !m.Direct
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetaFrom(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello world"))
+	}))
+	defer origin.Close()
+	l := newTestListener(t, "")
+
+	r := httptest.NewRequest("GET", origin.URL+"/", nil)
+	if MetaFrom(r.Context()) != nil {
+		t.Fatal("meta of a request not seen by the listener")
+	}
+	r, meta := l.withMeta(r)
+	p, c, err := l.route(r.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.routed(p, c)
+	w := httptest.NewRecorder()
+	l.HandleHttp(w, r, p)
+	if w.Code != http.StatusOK {
+		t.Fatal("request through the listener:", w.Code)
+	}
+
+	m := MetaFrom(r.Context())
+	if m != meta {
+		t.Fatalf("meta %+v, want the one attached", m)
+	}
+	if !strings.HasPrefix(m.ID, l.instanceID+"-") || m.Client != "192.0.2.1" {
+		t.Errorf("meta id %q of client %q, want an id of instance %s for 192.0.2.1", m.ID, m.Client, l.instanceID)
+	}
+	if m.Upstream != "DIRECT" || !m.Direct || m.Reason == "" {
+		t.Errorf("routed to %s, direct %v, reason %q", m.Upstream, m.Direct, m.Reason)
+	}
+	if m.BytesIn != int64(len("hello world")) {
+		t.Errorf("%d bytes in, want %d", m.BytesIn, len("hello world"))
+	}
+	if _, other := l.withMeta(r); other.ID == m.ID {
+		t.Error("two requests with the same meta id")
+	}
+}
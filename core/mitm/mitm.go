@@ -0,0 +1,104 @@
+package mitm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// CertStore issues leaf certificates signed by a CA the clients trust, one
+// per host, cached for the lifetime of the process.
+type CertStore struct {
+	ca     *x509.Certificate
+	caKey  crypto.Signer
+	key    *ecdsa.PrivateKey
+	leaves sync.Map
+}
+
+func NewCertStore(certFile, keyFile string) (*CertStore, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Annotate(err, "load mitm ca")
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, errors.Annotate(err, "parse mitm ca")
+	}
+	if !ca.IsCA {
+		return nil, errors.NotValidf("mitm ca %s, not a CA certificate", certFile)
+	}
+	caKey, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.NotSupportedf("mitm ca key type")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &CertStore{ca: ca, caKey: caKey, key: key}, nil
+}
+
+// Certificate returns the leaf certificate for host, generating it on first
+// use.
+func (s *CertStore) Certificate(host string) (*tls.Certificate, error) {
+	if v, ok := s.leaves.Load(host); ok {
+		return v.(*tls.Certificate), nil
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	notAfter := time.Now().AddDate(1, 0, 0)
+	if notAfter.After(s.ca.NotAfter) {
+		notAfter = s.ca.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, s.ca, &s.key.PublicKey, s.caKey)
+	if err != nil {
+		return nil, errors.Annotatef(err, "sign certificate for %s", host)
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, s.ca.Raw},
+		PrivateKey:  s.key,
+	}
+	v, _ := s.leaves.LoadOrStore(host, cert)
+	return v.(*tls.Certificate), nil
+}
+
+// TLSConfig terminates client TLS for a CONNECT to host, preferring the SNI
+// the client sends.
+func (s *CertStore) TLSConfig(host string) *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				return s.Certificate(hello.ServerName)
+			}
+			return s.Certificate(host)
+		},
+		NextProtos: []string{"http/1.1"},
+	}
+}
@@ -0,0 +1,103 @@
+package mitm
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCA writes a CA certificate and its key to dir and returns their
+// paths and the pool trusting it.
+func writeTestCA(t *testing.T, dir string, isCA bool) (certFile, keyFile string, pool *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "coral test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "ca.crt")
+	keyFile = filepath.Join(dir, "ca.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestCertificate(t *testing.T) {
+	certFile, keyFile, pool := writeTestCA(t, t.TempDir(), true)
+	store, err := NewCertStore(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"example.com", "192.0.2.1"} {
+		cert, err := store.Certificate(host)
+		if err != nil {
+			t.Fatal(host, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(host, err)
+		}
+		opts := x509.VerifyOptions{DNSName: host, Roots: pool}
+		if _, err := leaf.Verify(opts); err != nil {
+			t.Errorf("certificate for %s not trusted: %v", host, err)
+		}
+		if again, _ := store.Certificate(host); again != cert {
+			t.Errorf("certificate for %s issued twice", host)
+		}
+	}
+}
+
+func TestTLSConfigPrefersSNI(t *testing.T) {
+	certFile, keyFile, pool := writeTestCA(t, t.TempDir(), true)
+	store, err := NewCertStore(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go tls.Server(server, store.TLSConfig("192.0.2.1")).Handshake()
+
+	c := tls.Client(client, &tls.Config{ServerName: "www.example.com", RootCAs: pool})
+	if err := c.Handshake(); err != nil {
+		t.Fatal("handshake:", err)
+	}
+	if got := c.ConnectionState().PeerCertificates[0].Subject.CommonName; got != "www.example.com" {
+		t.Errorf("certificate for %q, want the SNI", got)
+	}
+}
+
+func TestNotCA(t *testing.T) {
+	certFile, keyFile, _ := writeTestCA(t, t.TempDir(), false)
+	if _, err := NewCertStore(certFile, keyFile); err == nil {
+		t.Error("a certificate that isn't a CA was accepted")
+	}
+}
@@ -0,0 +1,141 @@
+package core
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// overrides steers domains to a named upstream. The table is read from an
+// operator-editable file and reloaded whenever the file changes, a file
+// that fails to parse leaves the previous table in place.
+//
+// One rule per line, "domain upstream", a domain also matches all of its
+// subdomains and the most specific one wins. "#" starts a comment.
+type overrides struct {
+	path    string
+	table   atomic.Value // map[string]string
+	watcher *fsnotify.Watcher
+}
+
+func newOverrides(path string) (*overrides, error) {
+	o := &overrides{path: path}
+	table, err := parseOverrides(path)
+	if err != nil {
+		return nil, err
+	}
+	o.table.Store(table)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// editors usually replace the file instead of writing it in place, which
+	// drops a watch on the file itself, so the directory is watched
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, errors.Trace(err)
+	}
+	o.watcher = watcher
+	go o.watch()
+	return o, nil
+}
+
+func (o *overrides) watch() {
+	name := filepath.Clean(o.path)
+	for {
+		select {
+		case ev, ok := <-o.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(ev.Name) != name || ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			o.reload()
+		case err, ok := <-o.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Warnln("route override watch:", err)
+		}
+	}
+}
+
+func (o *overrides) reload() {
+	table, err := parseOverrides(o.path)
+	if err != nil {
+		log.Errorln("route override reload, keep previous rules:", err)
+		return
+	}
+	o.table.Store(table)
+	log.Infoln("route override reloaded,", len(table), "rules")
+}
+
+// Match returns the upstream name for host, or "" if no rule applies.
+func (o *overrides) Match(host string) string {
+	if o == nil {
+		return ""
+	}
+	table := o.table.Load().(map[string]string)
+	if len(table) == 0 {
+		return ""
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for {
+		if name, ok := table[host]; ok {
+			return name
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return ""
+		}
+		host = host[i+1:]
+	}
+}
+
+func (o *overrides) Close() error {
+	if o == nil || o.watcher == nil {
+		return nil
+	}
+	return o.watcher.Close()
+}
+
+func parseOverrides(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	table := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, errors.NotValidf("%s line %d", path, n)
+		}
+		domain := strings.ToLower(strings.Trim(fields[0], "."))
+		if domain == "" {
+			return nil, errors.NotValidf("%s line %d", path, n)
+		}
+		table[domain] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return table, nil
+}
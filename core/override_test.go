@@ -0,0 +1,61 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chinaboard/coral/core/proxy"
+)
+
+func TestOverrideFileWatched(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "override.txt")
+	if err := ioutil.WriteFile(path, []byte("# incident\nexample.com hk\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := newTestListener(t, "routeOverride = "+path+"\n")
+	defer l.overrides.Close()
+	proxies := []proxy.Proxy{&stubProxy{name: "hk"}, &stubProxy{name: "jp"}}
+	route := func() string {
+		p, err := l.chooseProxy("www.example.com:443", proxies, false, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p.Name()
+	}
+	waitRoute := func(want string) {
+		deadline := time.Now().Add(2 * time.Second)
+		for route() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("routed through %s, want %s", route(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if got := route(); got != "hk" {
+		t.Fatalf("routed through %s, want hk", got)
+	}
+
+	// written in place
+	if err := ioutil.WriteFile(path, []byte("example.com jp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitRoute("jp")
+
+	// replaced the way editors save
+	tmp := path + ".tmp"
+	ioutil.WriteFile(tmp, []byte("www.example.com hk\n"), 0644)
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	waitRoute("hk")
+
+	// a broken file keeps the previous rules
+	ioutil.WriteFile(path, []byte("example.com jp extra\n"), 0644)
+	time.Sleep(200 * time.Millisecond)
+	if got := route(); got != "hk" {
+		t.Errorf("routed through %s after a broken edit, want the previous hk", got)
+	}
+}
@@ -0,0 +1,131 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/chinaboard/coral/config"
+	"github.com/chinaboard/coral/utils"
+)
+
+const pacTemplate = `var proxy = %s;
+var directDomains = %s;
+var proxyDomains = %s;
+
+function inList(list, host) {
+	host = host.toLowerCase();
+	for (;;) {
+		if (list.hasOwnProperty(host)) {
+			return true;
+		}
+		var i = host.indexOf(".");
+		if (i < 0) {
+			return false;
+		}
+		host = host.substring(i + 1);
+	}
+}
+
+function FindProxyForURL(url, host) {
+	if (inList(proxyDomains, host)) {
+		return proxy;
+	}
+	if (isPlainHostName(host) || inList(directDomains, host)) {
+		return "DIRECT";
+	}
+	return proxy;
+}
+`
+
+type pacGroup struct {
+	name    string
+	clients utils.IPList
+	direct  utils.DomainList
+	proxy   utils.DomainList
+}
+
+// pac generates the PAC file, the first group, by name, whose clients
+// contain the requesting IP decides the domain lists.
+type pac struct {
+	path     string
+	addr     string
+	defaults pacGroup
+	groups   []pacGroup
+}
+
+func newPac(conf *config.CoralConfig) (*pac, error) {
+	p := &pac{
+		path: conf.Common.PacPath,
+		addr: conf.Common.AddrInPac,
+		defaults: pacGroup{
+			direct: utils.NewDomainList(conf.Common.PacDirect),
+			proxy:  utils.NewDomainList(conf.Common.PacProxy),
+		},
+	}
+	for name, group := range conf.PacGroups {
+		clients, err := utils.ParseIPList(group.Clients)
+		if err != nil {
+			return nil, err
+		}
+		p.groups = append(p.groups, pacGroup{
+			name:    name,
+			clients: clients,
+			direct:  utils.NewDomainList(group.Direct),
+			proxy:   utils.NewDomainList(group.Proxy),
+		})
+	}
+	sort.Slice(p.groups, func(i, j int) bool {
+		return p.groups[i].name < p.groups[j].name
+	})
+	return p, nil
+}
+
+func (p *pac) group(ip string) *pacGroup {
+	for i := range p.groups {
+		if p.groups[i].clients.Contains(ip) {
+			return &p.groups[i]
+		}
+	}
+	return &p.defaults
+}
+
+// Generate returns the PAC file for the client at ip, pointing browsers at
+// proxyAddr.
+func (p *pac) Generate(ip, proxyAddr string) []byte {
+	group := p.group(ip)
+	addr, _ := json.Marshal("PROXY " + proxyAddr)
+	direct, _ := json.Marshal(group.direct)
+	proxy, _ := json.Marshal(group.proxy)
+	return []byte(fmt.Sprintf(pacTemplate, addr, direct, proxy))
+}
+
+// Match reports whether r asks coral itself for the PAC file.
+func (p *pac) Match(r *http.Request) bool {
+	return r.Method == "GET" && !r.URL.IsAbs() && r.URL.Path == p.path
+}
+
+// servePac answers with the PAC file for the requesting client. Unless the
+// address is configured, it points at the address the client fetched it
+// from, which is the one that reaches this listener.
+func (this *httpListener) servePac(w http.ResponseWriter, r *http.Request) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	addr := this.pac.addr
+	if addr == "" {
+		addr = r.Host
+	}
+	if addr == "" {
+		addr = this.srv.Addr
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "80")
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Write(this.pac.Generate(ip, addr))
+}
@@ -0,0 +1,55 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPacGroups(t *testing.T) {
+	l := newTestListener(t, `pacDirect = ["lan.example.com"]
+[pac:phone]
+clients = ["192.168.1.0/24"]
+direct = ["cn"]
+[pac:office]
+clients = ["10.0.0.0/8", "192.168.1.9"]
+proxy = ["blocked.example"]
+`)
+	tests := []struct {
+		client string
+		// the lines of the PAC file
+		want []string
+	}{
+		{"192.168.1.20", []string{`var directDomains = {"cn":true};`, `var proxyDomains = {};`}},
+		// the first group by name wins
+		{"192.168.1.9", []string{`var directDomains = {"lan.example.com":true};`, `var proxyDomains = {"blocked.example":true};`}},
+		{"10.1.2.3", []string{`var directDomains = {"lan.example.com":true};`, `var proxyDomains = {"blocked.example":true};`}},
+		{"172.16.0.1", []string{`var directDomains = {"lan.example.com":true};`, `var proxyDomains = {};`}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/proxy.pac", nil)
+		r.RemoteAddr = tt.client + ":50000"
+		r.Host = "192.168.1.2:5438"
+		w := httptest.NewRecorder()
+		l.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("client %s: status %d", tt.client, w.Code)
+		}
+		lines := strings.Split(w.Body.String(), "\n")
+		for _, want := range append(tt.want, `var proxy = "PROXY 192.168.1.2:5438";`) {
+			if !contains(lines, want) {
+				t.Errorf("client %s: PAC file without %s:\n%s", tt.client, want, w.Body)
+			}
+		}
+	}
+}
+
+func contains(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
@@ -10,3 +10,19 @@ type Proxy interface {
 	Name() string
 	Direct() bool
 }
+
+// UDPDialer is implemented by proxies able to relay UDP.
+type UDPDialer interface {
+	// DialUDP returns a packet connection sending each datagram to the
+	// host:port of its address through the proxy, ReadFrom tells which
+	// address a reply came from.
+	DialUDP() (net.PacketConn, error)
+}
+
+// Addr is a host:port destination whose host may be a name, for the
+// proxies resolving it themselves.
+type Addr string
+
+func (a Addr) Network() string { return "udp" }
+
+func (a Addr) String() string { return string(a) }
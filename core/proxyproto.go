@@ -0,0 +1,191 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chinaboard/coral/utils"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// proxyHeaderTimeout bounds the wait for the PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// the signature starting a PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoListener accepts connections starting with a PROXY protocol
+// header, v1 or v2, sent by a load balancer in front of the listener. Only
+// the trusted peers may connect, the others are closed at once. Peers of a
+// unix socket, guarded by its permissions, are trusted.
+type proxyProtoListener struct {
+	net.Listener
+	trusted utils.IPList
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.trust(conn.RemoteAddr()) {
+			return &proxyConn{Conn: conn}, nil
+		}
+		log.Warnln(conn.RemoteAddr(), "proxy protocol from untrusted peer, closed")
+		conn.Close()
+	}
+}
+
+func (l *proxyProtoListener) trust(addr net.Addr) bool {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return l.trusted.Contains(addr.IP.String())
+	case *net.UnixAddr:
+		return true
+	}
+	return false
+}
+
+// proxyConn reads the header on first use, in the goroutine serving the
+// connection rather than the accept loop. Its remote address is the client
+// the header names, a connection without valid header fails to read.
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.Conn)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.err = errors.Annotatef(c.err, "proxy protocol from %s", c.Conn.RemoteAddr())
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr is the client named by the header, or the peer itself for a
+// header that doesn't name one, e.g. a health check of the balancer.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remote
+}
+
+func (c *proxyConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// the header is read exactly, so the conn holds nothing a zero-copy relay
+// of the underlying one would miss
+func (c *proxyConn) unwrap() net.Conn {
+	c.init()
+	return c.Conn
+}
+
+func (c *proxyConn) count(n int64) {}
+
+// readProxyHeader reads a PROXY protocol header without reading past it.
+// The address is nil for the LOCAL command and unknown protocols.
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(r, first); err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		return readProxyV1(r)
+	case proxyV2Signature[0]:
+		return readProxyV2(r)
+	}
+	return nil, errors.New("missing header")
+}
+
+// readProxyV1 reads the rest of "PROXY TCP4 src dst sport dport\r\n".
+func readProxyV1(r io.Reader) (net.Addr, error) {
+	// at most 107 bytes in all
+	line := []byte{'P'}
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= 107 {
+			return nil, errors.New("v1 header too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("invalid v1 header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, errors.New("invalid v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("invalid v1 address")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 reads the rest of a binary header.
+func readProxyV2(r io.Reader) (net.Addr, error) {
+	buf := make([]byte, 16)
+	buf[0] = proxyV2Signature[0]
+	if _, err := io.ReadFull(r, buf[1:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(buf[:12], proxyV2Signature) || buf[12]>>4 != 2 {
+		return nil, errors.New("invalid v2 header")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(buf[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	// LOCAL, the balancer speaking for itself
+	if buf[12]&0x0f == 0 {
+		return nil, nil
+	}
+	switch buf[13] >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, errors.New("short v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errors.New("short v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,267 @@
+package core
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/chinaboard/coral/config"
+	"github.com/chinaboard/coral/core/proxy"
+	"github.com/chinaboard/coral/core/tlsclient"
+	"github.com/chinaboard/coral/utils"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// routes is the part of the configuration a reload replaces: the servers
+// and the domain lists. A request keeps the routes it started with.
+type routes struct {
+	proxies []proxy.Proxy
+	// plain HTTP deadlines by server name
+	responseTimeouts map[string]time.Duration
+	noProxy          *utils.NoProxy
+	reject           utils.DomainList
+	proxyDomains     *proxyDomains
+	fallback         *fallback
+	directOnly       bool
+	// load balancing weights by server name, those of weight 0 are left out
+	weights map[string]int
+	// the direct connection tried once the servers failed, nil if disabled
+	fallbackDirect proxy.Proxy
+	// the options the servers were built with
+	common config.CoralConfigCommon
+	// the action by host pattern, checked before any other list
+	rules utils.DomainMap
+	// destination ports always connected directly or through a server
+	directPorts map[string]bool
+	proxyPorts  map[string]bool
+}
+
+func (this *httpListener) routes() *routes {
+	return this.current.Load().(*routes)
+}
+
+// newRoutes builds the servers and domain lists of conf.
+func (this *httpListener) newRoutes(conf *config.CoralConfig) (*routes, error) {
+	r := &routes{
+		proxies:          []proxy.Proxy{NewDirectProxy(conf.Common, this.resolver)},
+		responseTimeouts: map[string]time.Duration{},
+		weights:          map[string]int{},
+		reject:           utils.NewDomainList(conf.Common.RejectDomains),
+		common:           conf.Common,
+		rules:            utils.NewDomainMap(conf.Common.Rules),
+		directPorts:      map[string]bool{},
+		proxyPorts:       map[string]bool{},
+	}
+
+	for _, port := range conf.Common.DirectPorts {
+		r.directPorts[strconv.Itoa(port)] = true
+	}
+	for _, port := range conf.Common.ProxyPorts {
+		r.proxyPorts[strconv.Itoa(port)] = true
+	}
+
+	if conf.Common.NoProxy != "" {
+		noProxy, err := utils.ParseNoProxy(conf.Common.NoProxy)
+		if err != nil {
+			return nil, err
+		}
+		r.noProxy = noProxy
+	}
+
+	// servers are registered by name, the order backup mode tries them in
+	names := make([]string, 0, len(conf.Servers))
+	for name := range conf.Servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v := conf.Servers[name]
+		if v.Weight == 0 {
+			log.Infoln("server", name, "disabled by weight 0")
+			continue
+		}
+		if err := tlsclient.Validate(v.Fingerprint); err != nil {
+			return nil, errors.Annotatef(err, "server %s", v.Name)
+		}
+		p, err := GenerateProxy(v, conf.Common)
+		if err != nil {
+			log.Warningln(err)
+			continue
+		}
+		r.add(p, v)
+	}
+
+	if len(r.proxies) == 1 {
+		if !conf.Common.DirectOnly {
+			return nil, errors.NotFoundf("usable server")
+		}
+		log.Warnln("no usable server, directOnly mode: every request is connected directly")
+		r.directOnly = true
+	}
+
+	if conf.Common.Fallback != "" {
+		for _, p := range r.proxies {
+			if p.Name() == conf.Common.Fallback && !p.Direct() {
+				r.fallback = newFallback(p, conf.Common.FallbackTTL)
+			}
+		}
+		if r.fallback == nil {
+			log.Warnln("fallback server not found:", conf.Common.Fallback)
+		}
+	}
+
+	// servers may still be added at runtime, until then the rule is skipped
+	for pattern, action := range r.rules {
+		if action != RuleDirect && action != RuleReject && r.find(action) == nil {
+			log.Warnln("rule", pattern, "server not found:", action)
+		}
+	}
+
+	if conf.Common.FallbackDirect && !r.directOnly {
+		r.fallbackDirect = r.proxies[0]
+	}
+
+	r.proxyDomains = newProxyDomains(conf.Common.ProxyDomains, conf.Common.ProxyDomainURL,
+		conf.Common.ProxyDomainFile, conf.Common.ProxyDomainInterval, this.dialRouted)
+	return r, nil
+}
+
+// add registers p, built from server.
+func (r *routes) add(p proxy.Proxy, server config.CoralServer) {
+	r.proxies = append(r.proxies, p)
+	if server.ResponseTimeout > 0 {
+		r.responseTimeouts[p.Name()] = server.ResponseTimeout
+	}
+	r.weights[p.Name()] = server.Weight
+}
+
+// find returns the server called name, or nil.
+func (r *routes) find(name string) proxy.Proxy {
+	for _, p := range r.proxies {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// rejected tells whether requests to host are refused, by rejectDomains or
+// a rule.
+func (r *routes) rejected(host string) bool {
+	action, _ := r.rules.Lookup(host)
+	return action == RuleReject || r.reject.Match(host)
+}
+
+// copy returns routes sharing everything but the servers with r, for a
+// change of the servers alone.
+func (r *routes) copy() *routes {
+	c := *r
+	c.proxies = append([]proxy.Proxy(nil), r.proxies...)
+	c.responseTimeouts = map[string]time.Duration{}
+	for name, timeout := range r.responseTimeouts {
+		c.responseTimeouts[name] = timeout
+	}
+	c.weights = map[string]int{}
+	for name, weight := range r.weights {
+		c.weights[name] = weight
+	}
+	return &c
+}
+
+// NewServer builds the upstream of server with the options of the current
+// configuration, without registering it.
+func (this *httpListener) NewServer(server config.CoralServer) (proxy.Proxy, error) {
+	if server.Weight == 0 {
+		return nil, errors.NotValidf("server %s of weight 0", server.Name)
+	}
+	if err := tlsclient.Validate(server.Fingerprint); err != nil {
+		return nil, errors.Annotatef(err, "server %s", server.Name)
+	}
+	return GenerateProxy(server, this.routes().common)
+}
+
+// AddServer registers p, built from server by NewServer, next to the
+// servers of the configuration. A reload drops it.
+func (this *httpListener) AddServer(p proxy.Proxy, server config.CoralServer) error {
+	this.Lock()
+	defer this.Unlock()
+	r := this.routes().copy()
+	for _, value := range r.proxies {
+		if value.Name() == p.Name() {
+			return errors.AlreadyExistsf("server %s", p.Name())
+		}
+	}
+	r.add(p, server)
+	this.current.Store(r)
+	log.Infoln("server", p.Name(), "added")
+	return nil
+}
+
+// RemoveServer stops selecting the server name, its open connections
+// finish on it. A reload brings back a server of the configuration.
+func (this *httpListener) RemoveServer(name string) error {
+	this.Lock()
+	defer this.Unlock()
+	r := this.routes().copy()
+	for i, p := range r.proxies {
+		if p.Direct() || p.Name() != name {
+			continue
+		}
+		r.proxies = append(r.proxies[:i], r.proxies[i+1:]...)
+		delete(r.responseTimeouts, name)
+		delete(r.weights, name)
+		if r.fallback != nil && r.fallback.proxy == p {
+			log.Warnln("fallback server", name, "removed, failed direct connections are not retried")
+			r.fallback = nil
+		}
+		this.current.Store(r)
+		log.Infoln("server", name, "removed")
+		return nil
+	}
+	return errors.NotFoundf("server %s", name)
+}
+
+// Reload replaces the servers and domain lists by those of conf, the
+// listening sockets and open connections are left alone. A conf that fails
+// to build keeps the current ones. Other options need a restart.
+func (this *httpListener) Reload(conf *config.CoralConfig) error {
+	if conf == nil {
+		return errors.New("config is nil")
+	}
+	r, err := this.newRoutes(conf)
+	if err != nil {
+		return err
+	}
+
+	this.Lock()
+	old := this.routes()
+	r.fallback.inherit(old.fallback)
+	this.current.Store(r)
+	old.proxyDomains.Stop()
+	if this.serving {
+		r.proxyDomains.Start()
+	}
+	this.Unlock()
+
+	names := make([]string, 0, len(r.proxies))
+	current := map[proxy.Proxy]bool{}
+	for _, p := range r.proxies {
+		names = append(names, p.Name())
+		current[p] = true
+	}
+	// the keep-alive connections of the removed servers are never used again
+	for _, p := range old.proxies {
+		if current[p] {
+			continue
+		}
+		if t, ok := p.(HttpTransport); ok {
+			if c, ok := t.Transport().(interface{ CloseIdleConnections() }); ok {
+				c.CloseIdleConnections()
+			}
+		}
+	}
+	this.sweepTransports()
+	log.Infoln("reloaded, servers", names)
+	return nil
+}
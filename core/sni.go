@@ -0,0 +1,125 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// largest TLS record, a ClientHello is expected to fit in one
+const maxTLSRecord = 5 + 16384
+
+// peekedConn replays the bytes peeked from a connection before reading on.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// sniffSNI waits up to timeout for a TLS ClientHello on conn and returns the
+// server name it carries, or "" for silent clients and anything else. The
+// returned conn still yields every byte read from conn.
+func sniffSNI(conn net.Conn, timeout time.Duration) (net.Conn, string) {
+	r := bufio.NewReaderSize(conn, maxTLSRecord)
+	peeked := &peekedConn{Conn: conn, r: r}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	header, err := r.Peek(5)
+	if err != nil || header[0] != 0x16 {
+		return peeked, ""
+	}
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	record, err := r.Peek(5 + length)
+	if err != nil {
+		return peeked, ""
+	}
+	return peeked, parseSNI(record[5:])
+}
+
+// parseSNI extracts the host_name of the server_name extension from a
+// ClientHello handshake message.
+func parseSNI(b []byte) string {
+	// handshake type and length, client version, random
+	if len(b) < 4 || b[0] != 0x01 {
+		return ""
+	}
+	b = b[4:]
+	if len(b) < 34 {
+		return ""
+	}
+	b = b[34:]
+
+	// session id, cipher suites, compression methods
+	skip := func(lenBytes int) bool {
+		if len(b) < lenBytes {
+			return false
+		}
+		n := 0
+		for _, c := range b[:lenBytes] {
+			n = n<<8 | int(c)
+		}
+		if len(b) < lenBytes+n {
+			return false
+		}
+		b = b[lenBytes+n:]
+		return true
+	}
+	if !skip(1) || !skip(2) || !skip(1) {
+		return ""
+	}
+
+	if len(b) < 2 {
+		return ""
+	}
+	extensions := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) < extensions {
+		return ""
+	}
+	b = b[:extensions]
+	for len(b) >= 4 {
+		typ := binary.BigEndian.Uint16(b)
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		b = b[4:]
+		if len(b) < n {
+			return ""
+		}
+		if typ != 0 {
+			b = b[n:]
+			continue
+		}
+		// server_name: list length, then name type and length prefixed names
+		ext := b[:n]
+		if len(ext) < 2 {
+			return ""
+		}
+		ext = ext[2:]
+		for len(ext) >= 3 {
+			nameType := ext[0]
+			nameLen := int(binary.BigEndian.Uint16(ext[1:]))
+			ext = ext[3:]
+			if len(ext) < nameLen {
+				return ""
+			}
+			if nameType == 0 {
+				return string(ext[:nameLen])
+			}
+			ext = ext[nameLen:]
+		}
+		return ""
+	}
+	return ""
+}
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientHello returns the first TLS record a client sends for serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[5:]); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	return record
+}
+
+func TestSniffSNI(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+	tests := []struct {
+		name string
+		sent []byte
+		want string
+	}{
+		{"hello", hello, "www.example.com"},
+		{"truncated", hello[:len(hello)/2], ""},
+		{"plain http", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), ""},
+		{"silent", nil, ""},
+	}
+	for _, tt := range tests {
+		client, server := tcpPair(t)
+		client.Write(tt.sent)
+		start := time.Now()
+		conn, name := sniffSNI(server, 200*time.Millisecond)
+		if name != tt.want {
+			t.Errorf("%s: server name %q, want %q", tt.name, name, tt.want)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: sniffed for %v", tt.name, elapsed)
+		}
+		// whatever was sniffed is read again, and the deadline is gone
+		client.Write([]byte("more"))
+		client.Close()
+		got, err := ioutil.ReadAll(conn)
+		if err != nil || string(got) != string(tt.sent)+"more" {
+			t.Errorf("%s: read %q, %v after sniffing, want every byte sent", tt.name, got, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestParseSNITruncated(t *testing.T) {
+	hello := clientHello(t, "www.example.com")[5:]
+	if name := parseSNI(hello); name != "www.example.com" {
+		t.Fatalf("server name %q", name)
+	}
+	// no cut of the message may be misread or crash the parser
+	for i := range hello {
+		if name := parseSNI(hello[:i]); name != "" && name != "www.example.com" {
+			t.Errorf("cut at %d: server name %q", i, name)
+		}
+	}
+}
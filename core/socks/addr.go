@@ -0,0 +1,45 @@
+package socks
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+
+	"github.com/juju/errors"
+)
+
+// address types of RFC 1928, shadowsocks uses the same encoding
+const (
+	AtypIPv4   = 0x01
+	AtypDomain = 0x03
+	AtypIPv6   = 0x04
+)
+
+// ParseAddr encodes host:port as ATYP | address | port.
+func ParseAddr(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, errors.NotValidf("port %q", portStr)
+	}
+
+	var buf []byte
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append([]byte{AtypIPv4}, ip4...)
+		} else {
+			buf = append([]byte{AtypIPv6}, ip.To16()...)
+		}
+	} else {
+		if len(host) == 0 || len(host) > 255 {
+			return nil, errors.NotValidf("host %q", host)
+		}
+		buf = append([]byte{AtypDomain, byte(len(host))}, host...)
+	}
+	buf = append(buf, 0, 0)
+	binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(port))
+	return buf, nil
+}
@@ -0,0 +1,37 @@
+package socks
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want []byte
+	}{
+		{"1.2.3.4:80", []byte{AtypIPv4, 1, 2, 3, 4, 0, 80}},
+		{"[::1]:443", append(append([]byte{AtypIPv6}, make([]byte, 15)...), 1, 1, 187)},
+		{"[::ffff:1.2.3.4]:80", []byte{AtypIPv4, 1, 2, 3, 4, 0, 80}},
+		{"example.com:8080", append([]byte{AtypDomain, 11}, append([]byte("example.com"), 0x1f, 0x90)...)},
+		{"::1:443", nil},
+		{"[[::1]]:443", nil},
+		{"example.com:http", nil},
+		{"example.com:65536", nil},
+		{":80", nil},
+		{strings.Repeat("a", 256) + ":80", nil},
+	}
+	for _, tt := range tests {
+		got, err := ParseAddr(tt.addr)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("ParseAddr(%q) = %v, want an error", tt.addr, got)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("ParseAddr(%q) = %v, %v, want %v", tt.addr, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package socks
+
+import (
+	"io"
+
+	"github.com/juju/errors"
+)
+
+// replyText describes the reply codes of a server.
+var replyText = map[byte]string{
+	ReplyGeneralFailure:      "general failure",
+	ReplyNotAllowed:          "connection not allowed by ruleset",
+	ReplyNetworkUnreachable:  "network unreachable",
+	ReplyHostUnreachable:     "host unreachable",
+	ReplyConnectionRefused:   "connection refused",
+	ReplyTTLExpired:          "TTL expired",
+	ReplyCommandNotSupported: "command not supported",
+	ReplyAddrNotSupported:    "address type not supported",
+}
+
+// ClientHandshake negotiates the authentication method with a server, and
+// authenticates with username and password when name is set.
+func ClientHandshake(rw io.ReadWriter, name, passwd string) error {
+	methods := []byte{MethodNoAuth}
+	if name != "" {
+		methods = append(methods, MethodUserPass)
+	}
+	if _, err := rw.Write(append([]byte{Version5, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		return err
+	}
+	if buf[0] != Version5 {
+		return errors.NotValidf("socks version %d", buf[0])
+	}
+	switch buf[1] {
+	case MethodNoAuth:
+		return nil
+	case MethodUserPass:
+		if name != "" {
+			break
+		}
+		fallthrough
+	default:
+		return errors.Errorf("socks server refused the offered authentication methods %v", methods)
+	}
+
+	if len(name) > 255 || len(passwd) > 255 {
+		return errors.NotValidf("username or password longer than 255 bytes")
+	}
+	req := append([]byte{userPassVersion, byte(len(name))}, name...)
+	req = append(append(req, byte(len(passwd))), passwd...)
+	if _, err := rw.Write(req); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		return err
+	}
+	if buf[1] != userPassOK {
+		return errors.Unauthorizedf("socks server rejected user %s", name)
+	}
+	return nil
+}
+
+// ClientConnect asks the server for a connection to host:port addr.
+func ClientConnect(rw io.ReadWriter, addr string) error {
+	rawaddr, err := ParseAddr(addr)
+	if err != nil {
+		return err
+	}
+	if _, err := rw.Write(append([]byte{Version5, CmdConnect, 0x00}, rawaddr...)); err != nil {
+		return err
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		return err
+	}
+	if buf[0] != Version5 {
+		return errors.NotValidf("socks version %d", buf[0])
+	}
+	if buf[1] != ReplySucceeded {
+		text, ok := replyText[buf[1]]
+		if !ok {
+			text = "unknown error"
+		}
+		return errors.Errorf("socks connect %s: %s", addr, text)
+	}
+	// the bound address is of no use to the client
+	_, err = ReadAddr(rw)
+	return err
+}
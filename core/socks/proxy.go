@@ -0,0 +1,59 @@
+package socks
+
+import (
+	"net"
+	"time"
+
+	"github.com/chinaboard/coral/config"
+	"github.com/chinaboard/coral/core/proxy"
+)
+
+// handshakeTimeout bounds the negotiation with the server.
+const handshakeTimeout = 30 * time.Second
+
+// Socks5Proxy connects through a SOCKS5 server.
+type Socks5Proxy struct {
+	name     string
+	Timeout  time.Duration
+	Address  string
+	Username string
+	Password string
+	Dialer   *net.Dialer
+}
+
+func New(server config.CoralServer, dialer *net.Dialer) (proxy.Proxy, error) {
+	return &Socks5Proxy{
+		name:     server.Name,
+		Timeout:  server.ReadTimeout,
+		Address:  server.Address(),
+		Username: server.Username,
+		Password: server.Password,
+		Dialer:   dialer,
+	}, nil
+}
+
+func (this *Socks5Proxy) Dial(network, addr string) (net.Conn, time.Duration, error) {
+	conn, err := this.Dialer.Dial("tcp", this.Address)
+	if err != nil {
+		return nil, this.Timeout, err
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := ClientHandshake(conn, this.Username, this.Password); err != nil {
+		conn.Close()
+		return nil, this.Timeout, err
+	}
+	if err := ClientConnect(conn, addr); err != nil {
+		conn.Close()
+		return nil, this.Timeout, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, this.Timeout, nil
+}
+
+func (this *Socks5Proxy) Name() string {
+	return this.name
+}
+
+func (this *Socks5Proxy) Direct() bool {
+	return false
+}
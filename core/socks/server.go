@@ -0,0 +1,192 @@
+package socks
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/juju/errors"
+)
+
+// Version5 is the protocol version of RFC 1928.
+const Version5 = 0x05
+
+// authentication methods
+const (
+	MethodNoAuth       = 0x00
+	MethodUserPass     = 0x02
+	MethodNoAcceptable = 0xff
+)
+
+// commands of a request
+const (
+	CmdConnect      = 0x01
+	CmdBind         = 0x02
+	CmdUDPAssociate = 0x03
+)
+
+// reply codes
+const (
+	ReplySucceeded           = 0x00
+	ReplyGeneralFailure      = 0x01
+	ReplyNotAllowed          = 0x02
+	ReplyNetworkUnreachable  = 0x03
+	ReplyHostUnreachable     = 0x04
+	ReplyConnectionRefused   = 0x05
+	ReplyTTLExpired          = 0x06
+	ReplyCommandNotSupported = 0x07
+	ReplyAddrNotSupported    = 0x08
+)
+
+// version and status of the username/password negotiation of RFC 1929
+const (
+	userPassVersion = 0x01
+	userPassOK      = 0x00
+	userPassFailure = 0x01
+)
+
+// ErrAuthFailed is returned by Handshake for wrong credentials or when the
+// client offers no acceptable method.
+var ErrAuthFailed = errors.New("socks authentication failed")
+
+// AuthFunc checks a username and password.
+type AuthFunc func(name, passwd string) bool
+
+// Handshake negotiates the authentication method with a client. A nil
+// auth accepts clients without authentication, otherwise the client must
+// authenticate with username and password.
+func Handshake(rw io.ReadWriter, auth AuthFunc) error {
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != Version5 {
+		return errors.NotValidf("socks version %d", buf[0])
+	}
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return err
+	}
+
+	want := byte(MethodNoAuth)
+	if auth != nil {
+		want = MethodUserPass
+	}
+	offered := false
+	for _, m := range methods {
+		if m == want {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		rw.Write([]byte{Version5, MethodNoAcceptable})
+		return ErrAuthFailed
+	}
+	if _, err := rw.Write([]byte{Version5, want}); err != nil {
+		return err
+	}
+	if auth == nil {
+		return nil
+	}
+
+	name, passwd, err := readUserPass(rw)
+	if err != nil {
+		return err
+	}
+	if !auth(name, passwd) {
+		rw.Write([]byte{userPassVersion, userPassFailure})
+		return ErrAuthFailed
+	}
+	_, err = rw.Write([]byte{userPassVersion, userPassOK})
+	return err
+}
+
+func readUserPass(r io.Reader) (name, passwd string, err error) {
+	buf := make([]byte, 255)
+	if _, err = io.ReadFull(r, buf[:2]); err != nil {
+		return
+	}
+	if buf[0] != userPassVersion {
+		return "", "", errors.NotValidf("username/password version %d", buf[0])
+	}
+	n := buf[1]
+	if _, err = io.ReadFull(r, buf[:n]); err != nil {
+		return
+	}
+	name = string(buf[:n])
+	if _, err = io.ReadFull(r, buf[:1]); err != nil {
+		return
+	}
+	n = buf[0]
+	if _, err = io.ReadFull(r, buf[:n]); err != nil {
+		return
+	}
+	return name, string(buf[:n]), nil
+}
+
+// ReadRequest reads the command and destination host:port of a request.
+func ReadRequest(r io.Reader) (cmd byte, addr string, err error) {
+	buf := make([]byte, 3)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return
+	}
+	if buf[0] != Version5 {
+		return 0, "", errors.NotValidf("socks version %d", buf[0])
+	}
+	addr, err = ReadAddr(r)
+	return buf[1], addr, err
+}
+
+// ReadAddr decodes ATYP | address | port into host:port.
+func ReadAddr(r io.Reader) (string, error) {
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return "", err
+	}
+	var host string
+	switch buf[0] {
+	case AtypIPv4:
+		if _, err := io.ReadFull(r, buf[:net.IPv4len]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:net.IPv4len]).String()
+	case AtypIPv6:
+		if _, err := io.ReadFull(r, buf[:net.IPv6len]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:net.IPv6len]).String()
+	case AtypDomain:
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return "", err
+		}
+		n := buf[0]
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return "", err
+		}
+		host = string(buf[:n])
+	default:
+		return "", errors.NotValidf("address type %d", buf[0])
+	}
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return "", err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// WriteReply answers a request with rep and the bound address, the zero
+// IPv4 address when addr is nil.
+func WriteReply(w io.Writer, rep byte, addr net.Addr) error {
+	bound := "0.0.0.0:0"
+	if addr != nil {
+		bound = addr.String()
+	}
+	raw, err := ParseAddr(bound)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append([]byte{Version5, rep, 0x00}, raw...))
+	return err
+}
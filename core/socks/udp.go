@@ -0,0 +1,40 @@
+package socks
+
+import (
+	"bytes"
+
+	"github.com/juju/errors"
+)
+
+// ErrFragmented is returned for UDP datagrams with a fragment number,
+// which are not supported.
+var ErrFragmented = errors.New("socks udp fragments not supported")
+
+// ParseDatagram splits a UDP request, RSV | FRAG | ATYP | address | port |
+// data, into its destination and data.
+func ParseDatagram(b []byte) (addr string, data []byte, err error) {
+	if len(b) < 3 {
+		return "", nil, errors.NotValidf("udp datagram")
+	}
+	if b[2] != 0 {
+		return "", nil, ErrFragmented
+	}
+	r := bytes.NewReader(b[3:])
+	addr, err = ReadAddr(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return addr, b[len(b)-r.Len():], nil
+}
+
+// Datagram encapsulates data sent by host:port addr for the client.
+func Datagram(addr string, data []byte) ([]byte, error) {
+	raw, err := ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, 3+len(raw)+len(data))
+	b = append(b, 0, 0, 0)
+	b = append(b, raw...)
+	return append(b, data...), nil
+}
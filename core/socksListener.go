@@ -0,0 +1,216 @@
+package core
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/chinaboard/coral/core/socks"
+	"github.com/chinaboard/coral/stats"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// socksHandshakeTimeout bounds the negotiation and request of a client.
+const socksHandshakeTimeout = 30 * time.Second
+
+// socksListener accepts SOCKS5 clients on its own address and routes them
+// like the CONNECT requests of the HTTP listener, sharing its cache,
+// upstreams and users.
+type socksListener struct {
+	listener *httpListener
+	addr     string
+	ln       net.Listener
+}
+
+func newSocksListener(addr string, listener *httpListener) *socksListener {
+	return &socksListener{listener: listener, addr: addr}
+}
+
+// Start binds the address and serves on it in the background.
+func (s *socksListener) Start() error {
+	if s == nil {
+		return nil
+	}
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return errors.Annotate(err, "socks")
+	}
+	s.ln = ln
+	log.Infof("socks5 listen on %s", s.addr)
+	go s.serve()
+	return nil
+}
+
+// Close stops accepting, the open tunnels are left to the drain.
+func (s *socksListener) Close() error {
+	if s == nil || s.ln == nil {
+		return nil
+	}
+	return s.ln.Close()
+}
+
+func (s *socksListener) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *socksListener) handle(conn net.Conn) {
+	this := s.listener
+	defer conn.Close()
+	remote := conn.RemoteAddr().String()
+
+	ip, _, _ := net.SplitHostPort(remote)
+	if len(this.allowedClients) > 0 && !this.allowedClients.Contains(ip) || !this.AuthIP(ip) {
+		this.denyAddr(remote, "SOCKS5", "", DenyClientNotAllowed)
+		return
+	}
+	if !this.conns.Acquire(ip) {
+		log.Warnln(remote, "too many connections")
+		this.denyAddr(remote, "SOCKS5", "", DenyTooMany)
+		return
+	}
+	defer this.conns.Release(ip)
+
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	var auth socks.AuthFunc
+	if len(this.users) > 0 {
+		port := 0
+		if tcp, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			port = tcp.Port
+		}
+		auth = func(name, passwd string) bool {
+			return this.authUser(name, passwd, port)
+		}
+	}
+	if err := socks.Handshake(conn, auth); err != nil {
+		if err == socks.ErrAuthFailed {
+			this.denyAddr(remote, "SOCKS5", "", DenyUnauthenticated)
+		} else {
+			log.Debugln(remote, "socks handshake:", err)
+		}
+		return
+	}
+	cmd, addr, err := socks.ReadRequest(conn)
+	if err != nil {
+		log.Warnln(remote, err)
+		this.denyAddr(remote, "SOCKS5", "", DenyBadRequest)
+		socks.WriteReply(conn, socks.ReplyGeneralFailure, nil)
+		return
+	}
+	stats.Global.AddConnection()
+	switch cmd {
+	case socks.CmdConnect:
+		s.connect(conn, remote, addr)
+	case socks.CmdUDPAssociate:
+		s.associate(conn, remote, addr)
+	default:
+		this.denyAddr(remote, "SOCKS5", addr, DenyBadRequest)
+		socks.WriteReply(conn, socks.ReplyCommandNotSupported, nil)
+	}
+}
+
+// connect opens a tunnel to addr for the client on conn.
+func (s *socksListener) connect(conn net.Conn, remote, addr string) {
+	this := s.listener
+	stats.Global.AddTunnel()
+	if _, port, _ := net.SplitHostPort(addr); !this.tunnelAllowed || !this.tunnelPorts[port] {
+		log.Warnln(remote, "tunnel port not allowed", addr)
+		this.denyAddr(remote, "SOCKS5", addr, DenyPortNotAllowed)
+		socks.WriteReply(conn, socks.ReplyNotAllowed, nil)
+		return
+	}
+	if this.routes().rejected(hostname(addr)) {
+		log.Infoln(remote, "rejected", addr)
+		this.denyAddr(remote, "SOCKS5", addr, DenyRejected)
+		socks.WriteReply(conn, socks.ReplyNotAllowed, nil)
+		return
+	}
+	if this.isSelf(addr) {
+		log.Warnln(remote, "proxy loop", addr)
+		this.denyAddr(remote, "SOCKS5", addr, DenyLoop)
+		socks.WriteReply(conn, socks.ReplyNotAllowed, nil)
+		return
+	}
+	if this.localDenied(addr) {
+		log.Warnln(remote, "local address denied", addr)
+		this.denyAddr(remote, "SOCKS5", addr, DenyLocal)
+		socks.WriteReply(conn, socks.ReplyNotAllowed, nil)
+		return
+	}
+
+	meta := this.newMeta(remote)
+	proxy, c, err := this.route(addr)
+	if err != nil {
+		log.Errorln(err)
+		this.webhook.Notify("", "no upstream available")
+		socks.WriteReply(conn, socks.ReplyGeneralFailure, nil)
+		return
+	}
+	if this.directDenied(addr, proxy) {
+		log.Warnln(remote, "local address denied", addr)
+		this.denyAddr(remote, "SOCKS5", addr, DenyLocal)
+		socks.WriteReply(conn, socks.ReplyNotAllowed, nil)
+		return
+	}
+	meta.routed(proxy, c)
+	if this.accessLog == nil {
+		log.Infoln(proxy.Name(), remote, "SOCKS5", addr)
+	} else {
+		defer this.logAccess("SOCKS5", addr, meta)
+	}
+
+	this.tunnels.Add(conn)
+	defer this.tunnels.Remove(conn)
+	this.tuneConn(conn)
+	watch, ctx := watchClient(context.Background(), conn)
+	proxy, rConn, timeout, err := this.connect(ctx, proxy, addr, meta)
+	conn = watch.stop()
+	if err != nil {
+		socks.WriteReply(conn, socksReply(err), nil)
+		return
+	}
+	if err := socks.WriteReply(conn, socks.ReplySucceeded, nil); err != nil {
+		rConn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	this.relay(conn, rConn, proxy, addr, timeout, meta)
+}
+
+// socksReply maps a dial error to the reply code telling the client why.
+func socksReply(err error) byte {
+	if isTimeout(err) {
+		return socks.ReplyHostUnreachable
+	}
+	err = errors.Cause(err)
+	if op, ok := err.(*net.OpError); ok {
+		err = op.Err
+	}
+	if sys, ok := err.(*os.SyscallError); ok {
+		err = sys.Err
+	}
+	switch err {
+	case syscall.ECONNREFUSED:
+		return socks.ReplyConnectionRefused
+	case syscall.ENETUNREACH:
+		return socks.ReplyNetworkUnreachable
+	case syscall.EHOSTUNREACH:
+		return socks.ReplyHostUnreachable
+	}
+	if _, ok := err.(*net.DNSError); ok {
+		return socks.ReplyHostUnreachable
+	}
+	return socks.ReplyGeneralFailure
+}
@@ -0,0 +1,193 @@
+package core
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chinaboard/coral/core/proxy"
+	"github.com/chinaboard/coral/core/socks"
+	"github.com/chinaboard/coral/stats"
+	log "github.com/sirupsen/logrus"
+)
+
+// udpBufferSize holds the largest UDP datagram.
+const udpBufferSize = 64 * 1024
+
+// association relays the UDP datagrams of a SOCKS5 client, each
+// destination is routed once and its datagrams go through the upstream
+// chosen then. It lives as long as the controlling TCP connection.
+type association struct {
+	sync.Mutex
+	listener   *httpListener
+	relay      *net.UDPConn
+	clientIP   net.IP
+	clientPort int
+	// learned from the first datagram of the client
+	client    *net.UDPAddr
+	routes    map[string]proxy.Proxy
+	upstreams map[proxy.Proxy]net.PacketConn
+	closed    bool
+}
+
+// associate answers a UDP ASSOCIATE request with a relay address and
+// relays until conn is closed. addr is where the client will send from,
+// its unspecified parts match any.
+func (s *socksListener) associate(conn net.Conn, remote, addr string) {
+	this := s.listener
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	clientIP, _, _ := net.SplitHostPort(remote)
+	var bindIP net.IP
+	if local != nil {
+		bindIP = local.IP
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: bindIP})
+	if err != nil {
+		log.Errorln("socks udp:", err)
+		socks.WriteReply(conn, socks.ReplyGeneralFailure, nil)
+		return
+	}
+	a := &association{
+		listener:  this,
+		relay:     relay,
+		clientIP:  net.ParseIP(clientIP),
+		routes:    map[string]proxy.Proxy{},
+		upstreams: map[proxy.Proxy]net.PacketConn{},
+	}
+	if udp, err := net.ResolveUDPAddr("udp", addr); err == nil {
+		a.clientPort = udp.Port
+	}
+	defer a.Close()
+	if err := socks.WriteReply(conn, socks.ReplySucceeded, relay.LocalAddr()); err != nil {
+		return
+	}
+	log.Infoln(remote, "SOCKS5 UDP ASSOCIATE on", relay.LocalAddr())
+
+	this.tunnels.Add(conn)
+	defer this.tunnels.Remove(conn)
+	conn.SetDeadline(time.Time{})
+	go a.serve()
+	// the client sends nothing more, its close ends the association
+	io.Copy(ioutil.Discard, conn)
+}
+
+// serve forwards the datagrams of the client to their destinations.
+func (a *association) serve() {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, from, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !from.IP.Equal(a.clientIP) || a.clientPort != 0 && from.Port != a.clientPort {
+			continue
+		}
+		dst, data, err := socks.ParseDatagram(buf[:n])
+		if err != nil {
+			log.Debugln("socks udp from", from, err)
+			continue
+		}
+		p, pc := a.upstream(dst, from)
+		if pc == nil {
+			continue
+		}
+		if _, err := pc.WriteTo(data, proxy.Addr(dst)); err != nil {
+			log.Debugln("socks udp to", dst, "through", p.Name(), err)
+			continue
+		}
+		stats.Global.AddBytes(p.Name(), int64(len(data)))
+	}
+}
+
+// upstream returns the packet connection datagrams to dst are sent on,
+// nil when no upstream relays UDP for it.
+func (a *association) upstream(dst string, from *net.UDPAddr) (proxy.Proxy, net.PacketConn) {
+	a.Lock()
+	defer a.Unlock()
+	a.client = from
+	p, ok := a.routes[dst]
+	if !ok {
+		p = a.listener.routeUDP(dst)
+		a.routes[dst] = p
+	}
+	if p == nil || a.closed {
+		return nil, nil
+	}
+	if pc := a.upstreams[p]; pc != nil {
+		return p, pc
+	}
+	pc, err := p.(proxy.UDPDialer).DialUDP()
+	if err != nil {
+		log.Warnln("socks udp through", p.Name(), err)
+		a.listener.report(p, err)
+		return nil, nil
+	}
+	a.upstreams[p] = pc
+	go a.reply(p, pc)
+	return p, pc
+}
+
+// reply passes the datagrams coming back through p to the client.
+func (a *association) reply(p proxy.Proxy, pc net.PacketConn) {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		a.Lock()
+		client := a.client
+		a.Unlock()
+		d, err := socks.Datagram(from.String(), buf[:n])
+		if err != nil || client == nil {
+			continue
+		}
+		stats.Global.AddBytes(p.Name(), int64(n))
+		a.relay.WriteToUDP(d, client)
+	}
+}
+
+func (a *association) Close() {
+	a.Lock()
+	defer a.Unlock()
+	a.closed = true
+	a.relay.Close()
+	for _, pc := range a.upstreams {
+		pc.Close()
+	}
+}
+
+// routeUDP chooses the upstream for datagrams to addr among those relaying
+// UDP, nil when there is none or addr is rejected.
+func (this *httpListener) routeUDP(addr string) proxy.Proxy {
+	routes := this.routes()
+	if routes.rejected(hostname(addr)) {
+		log.Infoln("socks udp rejected", addr)
+		return nil
+	}
+	if this.localDenied(addr) {
+		log.Warnln("socks udp local address denied", addr)
+		return nil
+	}
+	proxies := routes.proxies
+	var capable []proxy.Proxy
+	for _, p := range proxies {
+		if _, ok := p.(proxy.UDPDialer); ok {
+			capable = append(capable, p)
+		}
+	}
+	c := this.classify(addr)
+	p, err := this.selectProxy(addr, capable, c)
+	if err != nil {
+		log.Warnln("socks udp: no upstream relays udp to", addr)
+		return nil
+	}
+	if this.directDenied(addr, p) {
+		log.Warnln("socks udp local address denied", addr)
+		return nil
+	}
+	log.Infoln(p.Name(), "SOCKS5 UDP", addr)
+	return p
+}
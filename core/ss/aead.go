@@ -0,0 +1,236 @@
+package ss
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// the largest payload of a chunk of an AEAD stream
+const aeadMaxPayload = 0x3FFF
+
+// aeadCiphers are the AEAD methods with their key size.
+var aeadCiphers = map[string]struct {
+	keySize int
+	new     func(key []byte) (cipher.AEAD, error)
+}{
+	"aes-128-gcm":            {16, newGCM},
+	"aes-192-gcm":            {24, newGCM},
+	"aes-256-gcm":            {32, newGCM},
+	"chacha20-ietf-poly1305": {32, chacha20poly1305.New},
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// aeadCipher derives a cipher for every salt from the key of the password,
+// as in the shadowsocks AEAD specification.
+type aeadCipher struct {
+	key []byte
+	new func(key []byte) (cipher.AEAD, error)
+}
+
+func newAEADCipher(method, password string) (*aeadCipher, bool) {
+	info, ok := aeadCiphers[method]
+	if !ok {
+		return nil, false
+	}
+	return &aeadCipher{key: kdf(password, info.keySize), new: info.new}, true
+}
+
+func (c *aeadCipher) SaltSize() int {
+	return len(c.key)
+}
+
+// subkey returns the cipher of the session started with salt.
+func (c *aeadCipher) subkey(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(c.key))
+	if _, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey")), subkey); err != nil {
+		return nil, err
+	}
+	return c.new(subkey)
+}
+
+// kdf is OpenSSL's EVP_BytesToKey with MD5, which shadowsocks derives the
+// key from the password with.
+func kdf(password string, keySize int) []byte {
+	var key, prev []byte
+	h := md5.New()
+	for len(key) < keySize {
+		h.Reset()
+		h.Write(prev)
+		h.Write([]byte(password))
+		key = h.Sum(key)
+		prev = key[len(key)-h.Size():]
+	}
+	return key[:keySize]
+}
+
+// increment adds one to the little-endian nonce.
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// aeadConn encrypts a stream as chunks of an encrypted length and an
+// encrypted payload, each direction starting with its own salt.
+type aeadConn struct {
+	net.Conn
+	cipher   *aeadCipher
+	enc, dec cipher.AEAD
+	encNonce []byte
+	decNonce []byte
+	// decrypted but not yet read
+	pending []byte
+	buf     []byte
+}
+
+func newAEADConn(conn net.Conn, c *aeadCipher) *aeadConn {
+	return &aeadConn{Conn: conn, cipher: c}
+}
+
+func (c *aeadConn) Write(b []byte) (int, error) {
+	var out []byte
+	if c.enc == nil {
+		salt := make([]byte, c.cipher.SaltSize())
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		enc, err := c.cipher.subkey(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.enc, c.encNonce = enc, make([]byte, enc.NonceSize())
+		out = salt
+	}
+	n := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > aeadMaxPayload {
+			chunk = chunk[:aeadMaxPayload]
+		}
+		size := []byte{byte(len(chunk) >> 8), byte(len(chunk))}
+		out = c.enc.Seal(out, c.encNonce, size, nil)
+		increment(c.encNonce)
+		out = c.enc.Seal(out, c.encNonce, chunk, nil)
+		increment(c.encNonce)
+		b = b[len(chunk):]
+		n += len(chunk)
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (c *aeadConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	if c.dec == nil {
+		salt := make([]byte, c.cipher.SaltSize())
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return 0, err
+		}
+		dec, err := c.cipher.subkey(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.dec, c.decNonce = dec, make([]byte, dec.NonceSize())
+		c.buf = make([]byte, aeadMaxPayload+dec.Overhead())
+	}
+
+	overhead := c.dec.Overhead()
+	sizeBuf := c.buf[:2+overhead]
+	if _, err := io.ReadFull(c.Conn, sizeBuf); err != nil {
+		return 0, err
+	}
+	if _, err := c.dec.Open(sizeBuf[:0], c.decNonce, sizeBuf, nil); err != nil {
+		return 0, errors.Annotate(err, "ss aead length")
+	}
+	increment(c.decNonce)
+	size := int(binary.BigEndian.Uint16(sizeBuf[:2])) & aeadMaxPayload
+
+	payload := c.buf[:size+overhead]
+	if _, err := io.ReadFull(c.Conn, payload); err != nil {
+		return 0, err
+	}
+	if _, err := c.dec.Open(payload[:0], c.decNonce, payload, nil); err != nil {
+		return 0, errors.Annotate(err, "ss aead payload")
+	}
+	increment(c.decNonce)
+	n := copy(b, payload[:size])
+	c.pending = payload[n:size]
+	return n, nil
+}
+
+func (c *aeadConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// aeadPacketConn encrypts every datagram on its own with a fresh salt and
+// a zero nonce.
+type aeadPacketConn struct {
+	net.PacketConn
+	cipher *aeadCipher
+}
+
+func (c *aeadPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	salt := make([]byte, c.cipher.SaltSize())
+	if _, err := rand.Read(salt); err != nil {
+		return 0, err
+	}
+	aead, err := c.cipher.subkey(salt)
+	if err != nil {
+		return 0, err
+	}
+	out := aead.Seal(salt, make([]byte, aead.NonceSize()), b, nil)
+	if _, err := c.PacketConn.WriteTo(out, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *aeadPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, maxPacketSize)
+	n, src, err := c.PacketConn.ReadFrom(buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	saltSize := c.cipher.SaltSize()
+	if n < saltSize {
+		return 0, src, errors.NotValidf("ss aead datagram")
+	}
+	aead, err := c.cipher.subkey(buf[:saltSize])
+	if err != nil {
+		return 0, src, err
+	}
+	plain, err := aead.Open(buf[saltSize:saltSize], make([]byte, aead.NonceSize()), buf[saltSize:n], nil)
+	if err != nil {
+		return 0, src, errors.Annotate(err, "ss aead datagram")
+	}
+	return copy(b, plain), src, nil
+}
@@ -0,0 +1,180 @@
+package ss
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// how long a new plugin is given to listen before the first dial
+	pluginStartTimeout = 3 * time.Second
+	pluginMaxBackoff   = 30 * time.Second
+)
+
+// plugin runs a SIP003 plugin, which carries the connections to its local
+// address on to the server. It is started again when it exits.
+type plugin struct {
+	name  string
+	path  string
+	opts  string
+	local string
+	env   []string
+	done  chan struct{}
+	once  sync.Once
+}
+
+// plugins are shared by the servers with the same plugin, options and
+// address, so a reload keeps them running.
+var plugins = struct {
+	sync.Mutex
+	m map[string]*plugin
+}{m: map[string]*plugin{}}
+
+// startPlugin returns the running plugin path with opts for the server at
+// remote, starting it when needed.
+func startPlugin(name, path, opts, remote string) (*plugin, error) {
+	key := path + "\x00" + opts + "\x00" + remote
+	plugins.Lock()
+	defer plugins.Unlock()
+	if p, ok := plugins.m[key]; ok {
+		return p, nil
+	}
+
+	host, port, err := net.SplitHostPort(remote)
+	if err != nil {
+		return nil, err
+	}
+	local, err := freePort()
+	if err != nil {
+		return nil, errors.Annotate(err, "plugin port")
+	}
+	p := &plugin{
+		name:  name,
+		path:  path,
+		opts:  opts,
+		local: net.JoinHostPort("127.0.0.1", strconv.Itoa(local)),
+		env: append(os.Environ(),
+			"SS_REMOTE_HOST="+host,
+			"SS_REMOTE_PORT="+port,
+			"SS_LOCAL_HOST=127.0.0.1",
+			"SS_LOCAL_PORT="+strconv.Itoa(local),
+			"SS_PLUGIN_OPTIONS="+opts,
+		),
+		done: make(chan struct{}),
+	}
+	cmd, err := p.start()
+	if err != nil {
+		return nil, err
+	}
+	go p.run(cmd)
+	p.wait()
+	plugins.m[key] = p
+	return p, nil
+}
+
+// StopPlugins ends the plugin processes.
+func StopPlugins() {
+	plugins.Lock()
+	defer plugins.Unlock()
+	for key, p := range plugins.m {
+		p.once.Do(func() {
+			close(p.done)
+		})
+		delete(plugins.m, key)
+	}
+}
+
+func (p *plugin) start() (*exec.Cmd, error) {
+	cmd := exec.Command(p.path)
+	cmd.Env = p.env
+	setPdeathsig(cmd)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Annotatef(err, "start plugin %s of server %s", p.path, p.name)
+	}
+	log.Infof("plugin %s of server %s on %s", p.path, p.name, p.local)
+	go p.log(stdout, log.InfoLevel)
+	go p.log(stderr, log.WarnLevel)
+	return cmd, nil
+}
+
+// run starts the plugin again whenever it exits, waiting longer each time,
+// until it is stopped.
+func (p *plugin) run(cmd *exec.Cmd) {
+	backoff := time.Second
+	for {
+		exited := make(chan error, 1)
+		go func() {
+			exited <- cmd.Wait()
+		}()
+		select {
+		case <-p.done:
+			cmd.Process.Kill()
+			<-exited
+			return
+		case err := <-exited:
+			log.Errorf("plugin %s of server %s exited: %v, restart in %s", p.path, p.name, err, backoff)
+		}
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > pluginMaxBackoff {
+				backoff = pluginMaxBackoff
+			}
+			var err error
+			if cmd, err = p.start(); err == nil {
+				break
+			}
+			log.Errorln(err)
+		}
+	}
+}
+
+// wait gives the plugin a moment to listen, dials before that would fail.
+func (p *plugin) wait() {
+	for deadline := time.Now().Add(pluginStartTimeout); time.Now().Before(deadline); {
+		if conn, err := net.DialTimeout("tcp", p.local, time.Second); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.Warnf("plugin %s of server %s not listening on %s yet", p.path, p.name, p.local)
+}
+
+// log passes the output of the plugin on to the log, line by line.
+func (p *plugin) log(r io.Reader, level log.Level) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		log.WithField("plugin", p.name).Log(level, scanner.Text())
+	}
+}
+
+// freePort returns a local port nobody listens on right now.
+func freePort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
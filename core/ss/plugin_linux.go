@@ -0,0 +1,14 @@
+//go:build linux
+// +build linux
+
+package ss
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setPdeathsig has the plugin killed when coral dies without stopping it.
+func setPdeathsig(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package ss
+
+import (
+	"os/exec"
+)
+
+func setPdeathsig(cmd *exec.Cmd) {}
@@ -2,39 +2,102 @@ package ss
 
 import (
 	"net"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/chinaboard/coral/core/proxy"
+	"github.com/chinaboard/coral/core/socks"
 
 	"github.com/chinaboard/coral/config"
+	"github.com/juju/errors"
 
 	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
 )
 
+// streamCiphers are the stream methods of shadowsocks-go.
+var streamCiphers = []string{
+	"aes-128-cfb", "aes-192-cfb", "aes-256-cfb", "aes-128-ctr", "aes-192-ctr", "aes-256-ctr",
+	"des-cfb", "bf-cfb", "cast5-cfb", "rc4-md5", "rc4-md5-6", "chacha20", "chacha20-ietf", "salsa20",
+}
+
 type ShadowsocksProxy struct {
 	name    string
 	Timeout time.Duration
-	Cipher  *ss.Cipher
+	// Cipher of a stream method, AEAD of an AEAD method
+	Cipher *ss.Cipher
+	AEAD   *aeadCipher
+	// Address is dialed for TCP, the local end of the plugin if any
 	Address string
+	// Server is the address of the server for UDP, which skips the plugin
+	Server string
+	Dialer *net.Dialer
 }
 
-func New(server config.CoralServer) (proxy.Proxy, error) {
-	cipher, err := ss.NewCipher(server.Method, server.Password)
+func New(server config.CoralServer, dialer *net.Dialer) (proxy.Proxy, error) {
+	p := &ShadowsocksProxy{
+		name:    server.Name,
+		Timeout: server.ReadTimeout,
+		Address: server.Address(),
+		Server:  server.Address(),
+		Dialer:  dialer,
+	}
+	if server.Plugin != "" {
+		plugin, err := startPlugin(server.Name, server.Plugin, server.PluginOpts, p.Server)
+		if err != nil {
+			return nil, err
+		}
+		p.Address = plugin.local
+	}
+	method := strings.ToLower(server.Method)
+	if c, ok := newAEADCipher(method, server.Password); ok {
+		p.AEAD = c
+		return p, nil
+	}
+	if ss.CheckCipherMethod(method) != nil {
+		return nil, unsupportedMethod(server.Name, method)
+	}
+	cipher, err := ss.NewCipher(method, server.Password)
 	if err != nil {
 		return nil, err
 	}
+	p.Cipher = cipher
+	return p, nil
+}
 
-	return &ShadowsocksProxy{
-		name:    server.Name,
-		Timeout: server.ReadTimeout,
-		Cipher:  cipher,
-		Address: server.Address(),
-	}, nil
+func unsupportedMethod(name, method string) error {
+	methods := make([]string, 0, len(aeadCiphers))
+	for m := range aeadCiphers {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	methods = append(methods, streamCiphers...)
+	if strings.HasPrefix(method, "2022-") {
+		return errors.Errorf("server %s: the shadowsocks 2022 method %s is not supported, supported methods: %s", name, method, strings.Join(methods, ", "))
+	}
+	return errors.Errorf("server %s: unsupported method %q, supported methods: %s", name, method, strings.Join(methods, ", "))
 }
 
 func (this *ShadowsocksProxy) Dial(network, addr string) (net.Conn, time.Duration, error) {
-	conn, err := ss.Dial(addr, this.Address, this.Cipher.Copy())
-	return conn, this.Timeout, err
+	rawaddr, err := socks.ParseAddr(addr)
+	if err != nil {
+		return nil, this.Timeout, err
+	}
+	conn, err := this.Dialer.Dial("tcp", this.Address)
+	if err != nil {
+		return nil, this.Timeout, err
+	}
+	var c net.Conn
+	if this.AEAD != nil {
+		c = newAEADConn(conn, this.AEAD)
+	} else {
+		c = ss.NewConn(conn, this.Cipher.Copy())
+	}
+	if _, err := c.Write(rawaddr); err != nil {
+		c.Close()
+		return nil, this.Timeout, err
+	}
+	return c, this.Timeout, nil
 }
 
 func (this *ShadowsocksProxy) Name() string {
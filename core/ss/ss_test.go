@@ -0,0 +1,67 @@
+package ss
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chinaboard/coral/config"
+	"github.com/chinaboard/coral/core/socks"
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"github.com/vaughan0/go-ini"
+)
+
+func TestDialIPv6(t *testing.T) {
+	const target = "[2001:db8::1]:443"
+	want, _ := socks.ParseAddr(target)
+	for _, method := range []string{"aes-256-gcm", "aes-256-cfb"} {
+		ln, err := net.Listen("tcp6", "[::1]:0")
+		if err != nil {
+			t.Skip("no IPv6 loopback:", err)
+		}
+		defer ln.Close()
+		// the host as written in a config, bracketed
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+		server, err := config.UnmarshalServerFormSection("v6", ini.Section{
+			"type": "ss", "host": "[::1]", "port": port, "method": method, "password": "p"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy, err := New(server, &net.Dialer{Timeout: 5 * time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := proxy.(*ShadowsocksProxy)
+		if p.Address != "[::1]:"+port {
+			t.Errorf("%s: server address %q", method, p.Address)
+		}
+
+		got := make(chan []byte, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var c net.Conn
+			if p.AEAD != nil {
+				c = newAEADConn(conn, p.AEAD)
+			} else {
+				c = ss.NewConn(conn, p.Cipher.Copy())
+			}
+			buf := make([]byte, len(want))
+			n, _ := c.Read(buf)
+			got <- buf[:n]
+		}()
+		conn, _, err := p.Dial("tcp", target)
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		if b := <-got; !bytes.Equal(b, want) {
+			t.Errorf("%s: the server got target %v, want %v", method, b, want)
+		}
+		conn.Close()
+	}
+}
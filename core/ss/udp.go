@@ -0,0 +1,74 @@
+package ss
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/chinaboard/coral/core/proxy"
+	"github.com/chinaboard/coral/core/socks"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// maxPacketSize bounds a relayed datagram, the library reads no more.
+const maxPacketSize = 4096
+
+// DialUDP opens a UDP association with the server, each datagram carries
+// its destination in front of the data and is encrypted on its own. The
+// server must have UDP relay enabled.
+func (this *ShadowsocksProxy) DialUDP() (net.PacketConn, error) {
+	server, err := net.ResolveUDPAddr("udp", this.Server)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	if this.AEAD != nil {
+		return &packetConn{PacketConn: &aeadPacketConn{PacketConn: conn, cipher: this.AEAD}, server: server}, nil
+	}
+	return &packetConn{PacketConn: ss.NewSecurePacketConn(conn, this.Cipher.Copy()), server: server}, nil
+}
+
+// packetConn addresses the datagrams of the encrypting PacketConn.
+type packetConn struct {
+	net.PacketConn
+	server *net.UDPAddr
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	rawaddr, err := socks.ParseAddr(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.PacketConn.WriteTo(append(rawaddr, b...), c.server); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom returns the next datagram of the server with the address it
+// came from, datagrams from elsewhere or failing to decode are dropped.
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, src, err := c.PacketConn.ReadFrom(buf)
+		if _, ok := err.(net.Error); ok {
+			return 0, nil, err
+		}
+		// garbage doesn't end the association
+		if err != nil {
+			continue
+		}
+		if udp, ok := src.(*net.UDPAddr); !ok || !udp.IP.Equal(c.server.IP) || udp.Port != c.server.Port {
+			continue
+		}
+		r := bytes.NewReader(buf[:n])
+		addr, err := socks.ReadAddr(r)
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[n-r.Len():n]), proxy.Addr(addr), nil
+	}
+}
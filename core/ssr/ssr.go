@@ -4,11 +4,15 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/chinaboard/coral/config"
 	"github.com/chinaboard/coral/core/proxy"
-	"github.com/sun8911879/shadowsocksR/tools/socks"
+	"github.com/chinaboard/coral/core/socks"
+	"github.com/sun8911879/shadowsocksR/obfs"
+	"github.com/sun8911879/shadowsocksR/protocol"
+	"github.com/sun8911879/shadowsocksR/ssr"
 
 	"github.com/juju/errors"
 
@@ -21,9 +25,10 @@ type ShadowsocksRProxy struct {
 	Address      *url.URL
 	ObfsData     interface{}
 	ProtocolData interface{}
+	Dialer       *net.Dialer
 }
 
-func New(server config.CoralServer) (proxy.Proxy, error) {
+func New(server config.CoralServer, dialer *net.Dialer) (proxy.Proxy, error) {
 	u := &url.URL{
 		Scheme: server.Type,
 		Host:   server.Address(),
@@ -41,11 +46,12 @@ func New(server config.CoralServer) (proxy.Proxy, error) {
 		name:    server.Name,
 		Timeout: server.ReadTimeout,
 		Address: u,
+		Dialer:  dialer,
 	}, nil
 }
 
 func (this *ShadowsocksRProxy) Dial(network, addr string) (net.Conn, time.Duration, error) {
-	ssrconn, err := shadowsocksr.NewSSRClient(this.Address)
+	ssrconn, err := this.newClient()
 	if err != nil {
 		return nil, this.Timeout, errors.New(fmt.Sprintf("connecting to SSR server failed :%v", err))
 	}
@@ -60,12 +66,61 @@ func (this *ShadowsocksRProxy) Dial(network, addr string) (net.Conn, time.Durati
 	}
 	ssrconn.IProtocol.SetData(this.ProtocolData)
 
-	if _, err := ssrconn.Write(socks.ParseAddr(addr)); err != nil {
-		return nil, this.Timeout, ssrconn.Close()
+	rawaddr, err := socks.ParseAddr(addr)
+	if err != nil {
+		ssrconn.Close()
+		return nil, this.Timeout, err
+	}
+	if _, err := ssrconn.Write(rawaddr); err != nil {
+		ssrconn.Close()
+		return nil, this.Timeout, err
 	}
 	return ssrconn, this.Timeout, nil
 }
 
+// newClient is shadowsocksr.NewSSRClient dialing through our own dialer.
+func (this *ShadowsocksRProxy) newClient() (*shadowsocksr.SSTCPConn, error) {
+	query := this.Address.Query()
+	cipher, err := shadowsocksr.NewStreamCipher(query.Get("encrypt-method"), query.Get("encrypt-key"))
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := this.Dialer.Dial("tcp", this.Address.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	ssconn := shadowsocksr.NewSSTCPConn(conn, cipher)
+	if ssconn.Conn == nil || ssconn.RemoteAddr() == nil {
+		conn.Close()
+		return nil, errors.New("nil connection")
+	}
+
+	host, portStr, err := net.SplitHostPort(ssconn.RemoteAddr().String())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	ssconn.IObfs = obfs.NewObfs(query.Get("obfs"))
+	ssconn.IObfs.SetServerInfo(&ssr.ServerInfoForObfs{
+		Host:   host,
+		Port:   uint16(port),
+		TcpMss: 1460,
+		Param:  query.Get("obfs-param"),
+	})
+	ssconn.IProtocol = protocol.NewProtocol(query.Get("protocol"))
+	ssconn.IProtocol.SetServerInfo(&ssr.ServerInfoForObfs{
+		Host:   host,
+		Port:   uint16(port),
+		TcpMss: 1460,
+		Param:  query.Get("protocol-param"),
+	})
+	return ssconn, nil
+}
+
 func (this *ShadowsocksRProxy) Name() string {
 	return this.name
 }
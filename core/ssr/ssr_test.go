@@ -0,0 +1,53 @@
+package ssr
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chinaboard/coral/config"
+	"github.com/vaughan0/go-ini"
+)
+
+func TestDialIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	}
+	defer ln.Close()
+	accepted := make(chan struct{})
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		close(accepted)
+	}()
+
+	// the host as written in a config, bracketed
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	server, err := config.UnmarshalServerFormSection("v6", ini.Section{
+		"type": "ssr", "host": "[::1]", "port": port, "method": "aes-256-cfb", "password": "p",
+		"obfs": "plain", "obfsParam": "o", "protocol": "origin", "protocolParam": "q"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(server, &net.Dialer{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host := p.(*ShadowsocksRProxy).Address.Host; host != "[::1]:"+port {
+		t.Errorf("server address %q", host)
+	}
+	conn, _, err := p.Dial("tcp", "[2001:db8::1]:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Error("the server got no connection")
+	}
+}
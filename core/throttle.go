@@ -0,0 +1,91 @@
+package core
+
+import (
+	"context"
+	"io"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// newLimiter returns a limiter of bytesPerSec with a burst of a second's
+// worth, or nil for no limit.
+func newLimiter(bytesPerSec int) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), bytesPerSec)
+}
+
+// throttledWriter waits for the limiter before each write, sleeping rather
+// than polling while it is throttled.
+type throttledWriter struct {
+	io.Writer
+	limiter *rate.Limiter
+}
+
+func (w *throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		// WaitN refuses more than the burst at once
+		if burst := w.limiter.Burst(); n > burst {
+			n = burst
+		}
+		if err := w.limiter.WaitN(context.Background(), n); err != nil {
+			return written, err
+		}
+		n, err := w.Writer.Write(b[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// throttledConn limits the writes to a conn.
+type throttledConn struct {
+	net.Conn
+	w throttledWriter
+}
+
+// throttle limits writes to conn to bytesPerSec, 0 returns conn unchanged.
+func throttle(conn net.Conn, bytesPerSec int) net.Conn {
+	limiter := newLimiter(bytesPerSec)
+	if limiter == nil {
+		return conn
+	}
+	return &throttledConn{Conn: conn, w: throttledWriter{Writer: conn, limiter: limiter}}
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c *throttledConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// throttledReader limits the reads of a request body.
+type throttledReader struct {
+	io.ReadCloser
+	limiter *rate.Limiter
+}
+
+func (r *throttledReader) Read(b []byte) (int, error) {
+	if burst := r.limiter.Burst(); len(b) > burst {
+		b = b[:burst]
+	}
+	n, err := r.ReadCloser.Read(b)
+	if n > 0 {
+		if werr := r.limiter.WaitN(context.Background(), n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
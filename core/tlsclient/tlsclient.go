@@ -0,0 +1,57 @@
+package tlsclient
+
+import (
+	"crypto/tls"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+	utls "github.com/refraction-networking/utls"
+)
+
+// fingerprints are the browser ClientHellos a TLS upstream connection can
+// mimic, Go's own is easy to tell apart and gets blocked.
+var fingerprints = map[string]utls.ClientHelloID{
+	"chrome":     utls.HelloChrome_Auto,
+	"firefox":    utls.HelloFirefox_Auto,
+	"ios":        utls.HelloIOS_Auto,
+	"randomized": utls.HelloRandomized,
+}
+
+// Validate checks a fingerprint name, "" means crypto/tls.
+func Validate(fingerprint string) error {
+	if fingerprint == "" {
+		return nil
+	}
+	if _, ok := fingerprints[strings.ToLower(fingerprint)]; ok {
+		return nil
+	}
+	names := make([]string, 0, len(fingerprints))
+	for name := range fingerprints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return errors.Errorf("invalid fingerprint %q, use one of %s", fingerprint, strings.Join(names, ", "))
+}
+
+// Client runs the TLS handshake for serverName over conn, with the
+// ClientHello of fingerprint or with crypto/tls when it is "".
+func Client(conn net.Conn, serverName, fingerprint string) (net.Conn, error) {
+	if fingerprint == "" {
+		c := tls.Client(conn, &tls.Config{ServerName: serverName})
+		if err := c.Handshake(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return c, nil
+	}
+	id, ok := fingerprints[strings.ToLower(fingerprint)]
+	if !ok {
+		return nil, Validate(fingerprint)
+	}
+	c := utls.UClient(conn, &utls.Config{ServerName: serverName}, id)
+	if err := c.Handshake(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return c, nil
+}
@@ -0,0 +1,83 @@
+package tlsclient
+
+import (
+	"bufio"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	for _, fingerprint := range []string{"", "chrome", "Firefox", "IOS", "randomized"} {
+		if err := Validate(fingerprint); err != nil {
+			t.Errorf("Validate(%q): %v", fingerprint, err)
+		}
+	}
+	if err := Validate("safari"); err == nil {
+		t.Error("unknown fingerprint is valid")
+	}
+}
+
+func TestClient(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	// the unknown fingerprint closes its connection before the handshake
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	// trust the certificate of srv, which is the same in every test as the
+	// system roots are loaded once
+	roots := filepath.Join(t.TempDir(), "roots.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}
+	if err := ioutil.WriteFile(roots, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{"SSL_CERT_FILE": roots, "SSL_CERT_DIR": ""} {
+		defer os.Setenv(key, os.Getenv(key))
+		os.Setenv(key, value)
+	}
+
+	dial := func(t *testing.T, fingerprint string) (net.Conn, error) {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := Client(conn, "example.com", fingerprint)
+		if err != nil {
+			conn.Close()
+		}
+		return c, err
+	}
+
+	for _, fingerprint := range []string{"", "chrome", "firefox", "ios", "randomized"} {
+		c, err := dial(t, fingerprint)
+		if err != nil {
+			t.Errorf("handshake with fingerprint %q: %v", fingerprint, err)
+			continue
+		}
+		req, _ := http.NewRequest("GET", "https://example.com/", nil)
+		if err := req.Write(c); err != nil {
+			t.Errorf("write with fingerprint %q: %v", fingerprint, err)
+		} else if resp, err := http.ReadResponse(bufio.NewReader(c), req); err != nil {
+			t.Errorf("read with fingerprint %q: %v", fingerprint, err)
+		} else {
+			body, _ := ioutil.ReadAll(resp.Body)
+			if string(body) != "ok" {
+				t.Errorf("body with fingerprint %q: %q", fingerprint, body)
+			}
+		}
+		c.Close()
+	}
+
+	if _, err := dial(t, "safari"); err == nil {
+		t.Error("handshake with an unknown fingerprint")
+	}
+}
@@ -0,0 +1,149 @@
+package core
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/chinaboard/coral/stats"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// transparentListener accepts the connections an iptables REDIRECT sends
+// it and tunnels each to its original destination, routed like a CONNECT
+// tunnel. The clients don't know about the proxy.
+type transparentListener struct {
+	listener *httpListener
+	addr     string
+	ln       net.Listener
+}
+
+func newTransparentListener(addr string, listener *httpListener) *transparentListener {
+	return &transparentListener{listener: listener, addr: addr}
+}
+
+// Start binds the address and serves on it in the background.
+func (t *transparentListener) Start() error {
+	if t == nil {
+		return nil
+	}
+	if !transparentSupported {
+		return errors.NotSupportedf("transparent proxy on %s", runtime.GOOS)
+	}
+	ln, err := net.Listen("tcp", t.addr)
+	if err != nil {
+		return errors.Annotate(err, "transparent")
+	}
+	t.ln = ln
+	log.Infof("transparent proxy listen on %s", t.addr)
+	go t.serve()
+	return nil
+}
+
+// Close stops accepting, the open tunnels are left to the drain.
+func (t *transparentListener) Close() error {
+	if t == nil || t.ln == nil {
+		return nil
+	}
+	return t.ln.Close()
+}
+
+func (t *transparentListener) serve() {
+	for {
+		conn, err := t.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		go t.handle(conn)
+	}
+}
+
+func (t *transparentListener) handle(conn net.Conn) {
+	this := t.listener
+	defer conn.Close()
+	remote := conn.RemoteAddr().String()
+
+	ip, _, _ := net.SplitHostPort(remote)
+	if len(this.allowedClients) > 0 && !this.allowedClients.Contains(ip) || !this.AuthIP(ip) {
+		this.denyAddr(remote, "TRANSPARENT", "", DenyClientNotAllowed)
+		return
+	}
+	addr, err := originalDst(conn)
+	if err != nil {
+		log.Warnln(remote, "original destination:", err)
+		this.denyAddr(remote, "TRANSPARENT", "", DenyBadRequest)
+		return
+	}
+	// a client connecting to the listener itself wasn't redirected
+	if addr == conn.LocalAddr().String() || this.isSelf(addr) {
+		log.Warnln(remote, "proxy loop", addr)
+		this.denyAddr(remote, "TRANSPARENT", addr, DenyLoop)
+		return
+	}
+	if !this.conns.Acquire(ip) {
+		log.Warnln(remote, "too many connections")
+		this.denyAddr(remote, "TRANSPARENT", addr, DenyTooMany)
+		return
+	}
+	defer this.conns.Release(ip)
+	stats.Global.AddConnection()
+	stats.Global.AddTunnel()
+
+	// the destination is an IP, the server name of a TLS client is a
+	// better guide to the route
+	if this.sniffSni {
+		var name string
+		conn, name = sniffSNI(conn, this.preReadTimeout)
+		if name != "" {
+			_, port, _ := net.SplitHostPort(addr)
+			addr = net.JoinHostPort(strings.TrimSuffix(name, "."), port)
+		}
+	}
+	if this.routes().rejected(hostname(addr)) {
+		log.Infoln(remote, "rejected", addr)
+		this.denyAddr(remote, "TRANSPARENT", addr, DenyRejected)
+		return
+	}
+	if this.localDenied(addr) {
+		log.Warnln(remote, "local address denied", addr)
+		this.denyAddr(remote, "TRANSPARENT", addr, DenyLocal)
+		return
+	}
+
+	meta := this.newMeta(remote)
+	proxy, c, err := this.route(addr)
+	if err != nil {
+		log.Errorln(err)
+		this.webhook.Notify("", "no upstream available")
+		return
+	}
+	if this.directDenied(addr, proxy) {
+		log.Warnln(remote, "local address denied", addr)
+		this.denyAddr(remote, "TRANSPARENT", addr, DenyLocal)
+		return
+	}
+	meta.routed(proxy, c)
+	if this.accessLog == nil {
+		log.Infoln(proxy.Name(), remote, "TRANSPARENT", addr)
+	} else {
+		defer this.logAccess("TRANSPARENT", addr, meta)
+	}
+
+	this.tunnels.Add(conn)
+	defer this.tunnels.Remove(conn)
+	this.tuneConn(conn)
+	watch, ctx := watchClient(context.Background(), conn)
+	proxy, rConn, timeout, err := this.connect(ctx, proxy, addr, meta)
+	conn = watch.stop()
+	if err != nil {
+		return
+	}
+	this.relay(conn, rConn, proxy, addr, timeout, meta)
+}
@@ -0,0 +1,70 @@
+//go:build linux
+// +build linux
+
+package core
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"unsafe"
+
+	"github.com/juju/errors"
+	"golang.org/x/sys/unix"
+)
+
+const transparentSupported = true
+
+// SO_ORIGINAL_DST of netfilter, IP6T_SO_ORIGINAL_DST has the same value
+const soOriginalDst = 80
+
+// originalDst returns the destination a REDIRECT rule rewrote, read from
+// the conntrack entry of conn.
+func originalDst(conn net.Conn) (string, error) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.NotSupportedf("original destination of %T", conn)
+	}
+	rc, err := tcp.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	v6 := false
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.IP.To4() == nil {
+		v6 = true
+	}
+
+	var addr string
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		addr, serr = getOriginalDst(int(fd), v6)
+	})
+	if err == nil {
+		err = serr
+	}
+	return addr, errors.Annotate(err, "SO_ORIGINAL_DST")
+}
+
+// getOriginalDst reads the sockaddr through the getsockopt wrappers of
+// structures large enough to hold it, there is none for SO_ORIGINAL_DST.
+func getOriginalDst(fd int, v6 bool) (string, error) {
+	var ip net.IP
+	var port []byte
+	if v6 {
+		info, err := unix.GetsockoptIPv6MTUInfo(fd, unix.SOL_IPV6, soOriginalDst)
+		if err != nil {
+			return "", err
+		}
+		ip = net.IP(info.Addr.Addr[:])
+		port = (*[2]byte)(unsafe.Pointer(&info.Addr.Port))[:]
+	} else {
+		// a sockaddr_in: family, port and address
+		mreq, err := unix.GetsockoptIPv6Mreq(fd, unix.SOL_IP, soOriginalDst)
+		if err != nil {
+			return "", err
+		}
+		ip = net.IP(mreq.Multiaddr[4:8])
+		port = mreq.Multiaddr[2:4]
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
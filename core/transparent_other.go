@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package core
+
+import (
+	"net"
+
+	"github.com/juju/errors"
+)
+
+const transparentSupported = false
+
+func originalDst(conn net.Conn) (string, error) {
+	return "", errors.NotSupportedf("original destination")
+}
@@ -0,0 +1,167 @@
+package core
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chinaboard/coral/core/proxy"
+	"github.com/chinaboard/coral/stats"
+	log "github.com/sirupsen/logrus"
+)
+
+// keep-alive connections of plain HTTP requests through an upstream
+const (
+	upstreamMaxIdle         = 100
+	upstreamMaxIdlePerHost  = 4
+	upstreamIdleConnTimeout = 90 * time.Second
+)
+
+// transports holds a keep-alive transport for every upstream without a
+// pool of its own, so plain HTTP requests reuse their connections.
+type transports struct {
+	sync.Mutex
+	m map[proxy.Proxy]*http.Transport
+}
+
+// dialFailed is set when the transport failed to dial for its request, which
+// was therefore not sent. The transport may dial in a goroutine outliving
+// the request, so the flag is atomic.
+type dialFailed struct {
+	failed int32
+}
+
+func (f *dialFailed) set() {
+	atomic.StoreInt32(&f.failed, 1)
+}
+
+func (f *dialFailed) isSet() bool {
+	return atomic.LoadInt32(&f.failed) == 1
+}
+
+type dialFailedKey struct{}
+
+// transport returns the transport dialing through p.
+func (this *httpListener) transport(p proxy.Proxy) *http.Transport {
+	this.transports.Lock()
+	defer this.transports.Unlock()
+	if tr, ok := this.transports.m[p]; ok {
+		return tr
+	}
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := this.dialOnce(ctx, p, network, addr)
+			if f, ok := ctx.Value(dialFailedKey{}).(*dialFailed); ok && err != nil {
+				f.set()
+			}
+			return conn, err
+		},
+		MaxIdleConns:        upstreamMaxIdle,
+		MaxIdleConnsPerHost: upstreamMaxIdlePerHost,
+		IdleConnTimeout:     upstreamIdleConnTimeout,
+	}
+	if this.transports.m == nil {
+		this.transports.m = map[proxy.Proxy]*http.Transport{}
+	}
+	this.transports.m[p] = tr
+	return tr
+}
+
+// sweepTransports drops the transports of the upstreams a reload removed.
+func (this *httpListener) sweepTransports() {
+	current := map[proxy.Proxy]bool{}
+	for _, p := range this.routes().proxies {
+		current[p] = true
+	}
+	this.transports.Lock()
+	defer this.transports.Unlock()
+	for p, tr := range this.transports.m {
+		if !current[p] {
+			tr.CloseIdleConnections()
+			delete(this.transports.m, p)
+		}
+	}
+}
+
+// sweepStats forgets the statistics of the upstreams a reload removed.
+func (this *httpListener) sweepStats() {
+	current := map[string]bool{}
+	for _, p := range this.routes().proxies {
+		current[p.Name()] = true
+	}
+	stats.Global.Prune(func(name string) bool {
+		return current[name]
+	})
+}
+
+// roundTripper returns the transport sending r through *used, and adjusts r
+// for it: the upstream connection outlives this request and must not be
+// closed because the client asked to close its own.
+func (this *httpListener) roundTripper(r *http.Request, used *proxy.Proxy) http.RoundTripper {
+	r.Close = false
+	// the transport only hands over the connection of a 101 response when
+	// the request asked for the upgrade
+	if upgradeType(r.Header) == "" {
+		r.Header.Del("Connection")
+	}
+	r.Header.Del("Proxy-Connection")
+	if p, ok := (*used).(HttpTransport); ok {
+		return p.Transport()
+	}
+	return this.transport(*used)
+}
+
+// roundTrip sends r through *used, moving on to the next upstream while
+// no connection can be dialed, and stores the one that answered in *used.
+// dialed tells whether the last upstream tried got a connection, otherwise
+// the request wasn't sent.
+func (this *httpListener) roundTrip(r *http.Request, used *proxy.Proxy) (resp *http.Response, dialed bool, err error) {
+	// a transport closes the body on errors, it is still unsent after a
+	// failed dial
+	body := r.Body
+	if body != nil && body != http.NoBody {
+		body = ioutil.NopCloser(body)
+	}
+	resp, dialed, err = this.roundTripOnce(r, body, *used)
+	for tried := []proxy.Proxy{*used}; err != nil && r.Context().Err() == nil && !dialed; {
+		next := this.nextProxy(r.URL.Host, tried)
+		if next == nil {
+			break
+		}
+		log.Warnln((*used).Name(), r.Host, err, "retry through", next.Name())
+		*used = next
+		tried = append(tried, next)
+		resp, dialed, err = this.roundTripOnce(r, body, next)
+	}
+	return resp, dialed, err
+}
+
+// roundTripOnce sends r with body through p. Every attempt has its own
+// flag, a dial left running by a previous one can't set it, and the flag is
+// only read while the request is live.
+func (this *httpListener) roundTripOnce(r *http.Request, body io.ReadCloser, p proxy.Proxy) (*http.Response, bool, error) {
+	failed := &dialFailed{}
+	req := r.WithContext(context.WithValue(r.Context(), dialFailedKey{}, failed))
+	req.Body = body
+	resp, err := this.roundTripper(req, &p).RoundTrip(req)
+	dialed := err == nil || r.Context().Err() != nil || !failed.isSet()
+	return resp, dialed, err
+}
+
+// replayable tells whether r may be sent a second time once the first
+// attempt may have reached the origin, as the Go transport decides it.
+func replayable(r *http.Request) bool {
+	if r.Body != nil && r.Body != http.NoBody {
+		return false
+	}
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return r.Header.Get("Idempotency-Key") != "" || r.Header.Get("X-Idempotency-Key") != ""
+}
@@ -0,0 +1,30 @@
+package core
+
+import (
+	"net"
+	"os"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// listenUnix listens on the unix socket at path, replacing the socket file
+// of a process that didn't shut down. The file is removed when the listener
+// is closed.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.Errorf("%s exists and is not a socket", path)
+		}
+		// a socket nobody accepts on is stale
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.Errorf("%s is in use", path)
+		}
+		log.Infoln("remove stale socket", path)
+		if err := os.Remove(path); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,71 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/chinaboard/coral/core/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// upgradedConn is the connection a 101 Switching Protocols response leaves
+// open, handed over by the transport as the body. It has no deadlines, the
+// idle timeout reaps a silent one.
+type upgradedConn struct {
+	io.ReadWriteCloser
+	addr upgradeAddr
+}
+
+type upgradeAddr string
+
+func (a upgradeAddr) Network() string { return "tcp" }
+func (a upgradeAddr) String() string  { return string(a) }
+
+func (c *upgradedConn) LocalAddr() net.Addr                { return c.addr }
+func (c *upgradedConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *upgradedConn) SetDeadline(t time.Time) error      { return nil }
+func (c *upgradedConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *upgradedConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// relayUpgrade passes a 101 response on to the client and relays the
+// upgraded protocol, e.g. a websocket, in both directions like a tunnel.
+func (this *httpListener) relayUpgrade(w http.ResponseWriter, r *http.Request, resp *http.Response, p proxy.Proxy) {
+	rw, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		log.Errorln(p.Name(), r.Host, "upgrade response without connection")
+		this.fail(w, http.StatusBadGateway)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		rw.Close()
+		this.fail(w, http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		log.Errorln("hijack", err)
+		rw.Close()
+		return
+	}
+	this.tunnels.Add(conn)
+	defer this.tunnels.Remove(conn)
+
+	fmt.Fprintf(buf, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(buf)
+	buf.WriteString("\r\n")
+	if err := buf.Flush(); err != nil {
+		conn.Close()
+		rw.Close()
+		return
+	}
+	// the client may have sent the first frames along with the request
+	var lConn net.Conn = conn
+	if buf.Reader.Buffered() > 0 {
+		lConn = &peekedConn{Conn: conn, r: buf.Reader}
+	}
+	this.relay(lConn, &upgradedConn{ReadWriteCloser: rw, addr: upgradeAddr(r.Host)}, p, r.Host, 0, MetaFrom(r.Context()))
+}
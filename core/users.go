@@ -0,0 +1,147 @@
+package core
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+const proxyRealm = `Basic realm="coral"`
+
+// user is an account of proxy authentication, a non-zero port restricts it
+// to the listener on that port.
+type user struct {
+	passwd string
+	port   int
+}
+
+// loadUsers reads the accounts given inline and those in file, one
+// "user:passwd[:port]" per line.
+func loadUsers(userPasswd, file string) (map[string]user, error) {
+	users := map[string]user{}
+	if userPasswd != "" {
+		if err := addUser(users, userPasswd); err != nil {
+			return nil, errors.Annotate(err, "userPasswd")
+		}
+	}
+	if file == "" {
+		return users, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := addUser(users, line); err != nil {
+			return nil, errors.Annotatef(err, "%s line %d", file, n)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return users, nil
+}
+
+func addUser(users map[string]user, line string) error {
+	fields := strings.Split(line, ":")
+	if len(fields) < 2 || len(fields) > 3 || fields[0] == "" || fields[1] == "" {
+		return errors.NotValidf("user %q", fields[0])
+	}
+	u := user{passwd: fields[1]}
+	if len(fields) == 3 {
+		port, err := strconv.ParseUint(fields[2], 10, 16)
+		if err != nil || port == 0 {
+			return errors.NotValidf("port of user %s", fields[0])
+		}
+		u.port = int(port)
+	}
+	users[fields[0]] = u
+	return nil
+}
+
+// proxyAuth checks the Proxy-Authorization of r and answers 407 when it is
+// missing or wrong. The header is removed so it never reaches the origin.
+func (this *httpListener) proxyAuth(w http.ResponseWriter, r *http.Request) bool {
+	if len(this.users) == 0 || this.authFree(r) {
+		return true
+	}
+	name, passwd, ok := parseProxyAuth(r.Header.Get("Proxy-Authorization"))
+	r.Header.Del("Proxy-Authorization")
+	if ok && this.authUser(name, passwd, localPort(r)) {
+		return true
+	}
+	this.deny(r, r.Host, DenyUnauthenticated)
+	w.Header().Set("Proxy-Authenticate", proxyRealm)
+	http.Error(w, "Proxy Authentication Required.", http.StatusProxyAuthRequired)
+	return false
+}
+
+func (this *httpListener) authUser(name, passwd string, port int) bool {
+	u, ok := this.users[name]
+	if !ok || subtle.ConstantTimeCompare([]byte(u.passwd), []byte(passwd)) != 1 {
+		return false
+	}
+	return u.port == 0 || u.port == port
+}
+
+func parseProxyAuth(header string) (name, passwd string, ok bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	buf, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[len(prefix):]))
+	if err != nil {
+		return "", "", false
+	}
+	i := strings.IndexByte(string(buf), ':')
+	if i < 0 {
+		return "", "", false
+	}
+	return string(buf[:i]), string(buf[i+1:]), true
+}
+
+// authFree reports whether r came in on a listen address that asks for no
+// credentials.
+func (this *httpListener) authFree(r *http.Request) bool {
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, addr := range this.noAuthAddrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || port != strconv.Itoa(local.Port) {
+			continue
+		}
+		// a wildcard address accepts on every local IP
+		ip := net.ParseIP(strings.Trim(host, "[]"))
+		if host == "" || ip != nil && (ip.IsUnspecified() || ip.Equal(local.IP)) {
+			return true
+		}
+	}
+	return false
+}
+
+// localPort returns the port of the listener that accepted r.
+func localPort(r *http.Request) int {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return 0
+	}
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.Port
+	}
+	return 0
+}
@@ -0,0 +1,167 @@
+package vmess
+
+import (
+	"crypto/cipher"
+	"crypto/md5"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/sha3"
+)
+
+const maxChunkSize = 8 * 1024
+
+// chunkStream is one direction of the VMess body: length-masked AEAD
+// chunks, each sealed with a nonce made of a counter and the body IV.
+type chunkStream struct {
+	aead  cipher.AEAD
+	iv    []byte
+	count uint16
+	mask  sha3.ShakeHash
+}
+
+func newChunkStream(security byte, key, iv []byte) *chunkStream {
+	var aead cipher.AEAD
+	if security == securityChacha20Poly1305 {
+		k := make([]byte, 32)
+		t := md5.Sum(key)
+		copy(k, t[:])
+		t = md5.Sum(k[:16])
+		copy(k[16:], t[:])
+		aead, _ = chacha20poly1305.New(k)
+	} else {
+		aead = newGCM(key)
+	}
+	mask := sha3.NewShake128()
+	mask.Write(iv)
+	return &chunkStream{aead: aead, iv: iv, mask: mask}
+}
+
+func (s *chunkStream) nonce() []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	copy(nonce, s.iv)
+	binary.BigEndian.PutUint16(nonce, s.count)
+	s.count++
+	return nonce
+}
+
+func (s *chunkStream) nextMask() uint16 {
+	b := make([]byte, 2)
+	s.mask.Read(b)
+	return binary.BigEndian.Uint16(b)
+}
+
+type Conn struct {
+	net.Conn
+	writer *chunkStream
+	reader *chunkStream
+	respV  byte
+
+	respKey    []byte
+	respIV     []byte
+	headerRead bool
+	buf        []byte
+	eof        bool
+}
+
+func newConn(conn net.Conn, security byte, reqKey, reqIV, respKey, respIV []byte, respV byte) *Conn {
+	return &Conn{
+		Conn:    conn,
+		writer:  newChunkStream(security, reqKey, reqIV),
+		reader:  newChunkStream(security, respKey, respIV),
+		respV:   respV,
+		respKey: respKey,
+		respIV:  respIV,
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		size := len(b)
+		if size > maxChunkSize {
+			size = maxChunkSize
+		}
+		if err := c.writeChunk(b[:size]); err != nil {
+			return n, err
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+func (c *Conn) writeChunk(b []byte) error {
+	s := c.writer
+	chunk := make([]byte, 2, 2+len(b)+s.aead.Overhead())
+	binary.BigEndian.PutUint16(chunk, uint16(len(b)+s.aead.Overhead())^s.nextMask())
+	chunk = s.aead.Seal(chunk, s.nonce(), b, nil)
+	_, err := c.Conn.Write(chunk)
+	return err
+}
+
+// CloseWrite sends the end-of-stream chunk and half-closes the underlying
+// connection when it supports it.
+func (c *Conn) CloseWrite() error {
+	if err := c.writeChunk(nil); err != nil {
+		return err
+	}
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.buf) == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+		if len(c.buf) == 0 {
+			c.eof = true
+			return 0, io.EOF
+		}
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *Conn) readChunk() error {
+	s := c.reader
+	if !c.headerRead {
+		header, err := openResponseHeader(c.Conn, c.respKey, c.respIV)
+		if err != nil {
+			return err
+		}
+		if len(header) < 4 || header[0] != c.respV {
+			return errors.New("vmess unexpected response header")
+		}
+		c.headerRead = true
+	}
+
+	sizeBuf := make([]byte, 2)
+	if _, err := io.ReadFull(c.Conn, sizeBuf); err != nil {
+		return err
+	}
+	size := int(binary.BigEndian.Uint16(sizeBuf) ^ s.nextMask())
+	if size < s.aead.Overhead() {
+		return errors.New("vmess invalid chunk size")
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+		return err
+	}
+	plain, err := s.aead.Open(sealed[:0], s.nonce(), sealed, nil)
+	if err != nil {
+		return errors.Annotate(err, "vmess chunk")
+	}
+	c.buf = plain
+	return nil
+}
@@ -0,0 +1,85 @@
+package vmess
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+func createAuthID(cmdKey []byte, now time.Time) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, uint64(now.Unix()))
+	rand.Read(buf[8:12])
+	binary.BigEndian.PutUint32(buf[12:], crc32.ChecksumIEEE(buf[:12]))
+
+	block, _ := aes.NewCipher(kdf16(cmdKey, kdfSaltAuthIDEncryptionKey))
+	authID := make([]byte, 16)
+	block.Encrypt(authID, buf)
+	return authID
+}
+
+func newGCM(key []byte) cipher.AEAD {
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+// sealHeader encrypts the request header the way a VMess AEAD client does:
+// auth id | sealed length | connection nonce | sealed header.
+func sealHeader(cmdKey, header []byte) []byte {
+	authID := createAuthID(cmdKey, time.Now())
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(header)))
+
+	lengthAEAD := newGCM(kdf16(cmdKey, kdfSaltHeaderPayloadLengthAEADKey, string(authID), string(nonce)))
+	lengthNonce := kdf(cmdKey, kdfSaltHeaderPayloadLengthAEADIV, string(authID), string(nonce))[:12]
+
+	payloadAEAD := newGCM(kdf16(cmdKey, kdfSaltHeaderPayloadAEADKey, string(authID), string(nonce)))
+	payloadNonce := kdf(cmdKey, kdfSaltHeaderPayloadAEADIV, string(authID), string(nonce))[:12]
+
+	var buf bytes.Buffer
+	buf.Write(authID)
+	buf.Write(lengthAEAD.Seal(nil, lengthNonce, length, authID))
+	buf.Write(nonce)
+	buf.Write(payloadAEAD.Seal(nil, payloadNonce, header, authID))
+	return buf.Bytes()
+}
+
+// openResponseHeader reads the AEAD response header and returns its
+// plaintext.
+func openResponseHeader(r io.Reader, key, iv []byte) ([]byte, error) {
+	lengthAEAD := newGCM(kdf16(key, kdfSaltRespHeaderLenKey))
+	lengthNonce := kdf(iv, kdfSaltRespHeaderLenIV)[:12]
+
+	sealedLength := make([]byte, 2+lengthAEAD.Overhead())
+	if _, err := io.ReadFull(r, sealedLength); err != nil {
+		return nil, err
+	}
+	length, err := lengthAEAD.Open(nil, lengthNonce, sealedLength, nil)
+	if err != nil {
+		return nil, errors.Annotate(err, "vmess response header length")
+	}
+
+	payloadAEAD := newGCM(kdf16(key, kdfSaltRespHeaderPayloadKey))
+	payloadNonce := kdf(iv, kdfSaltRespHeaderPayloadIV)[:12]
+
+	sealed := make([]byte, int(binary.BigEndian.Uint16(length))+payloadAEAD.Overhead())
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		return nil, err
+	}
+	header, err := payloadAEAD.Open(nil, payloadNonce, sealed, nil)
+	if err != nil {
+		return nil, errors.Annotate(err, "vmess response header")
+	}
+	return header, nil
+}
@@ -0,0 +1,48 @@
+package vmess
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"hash"
+)
+
+const (
+	kdfSaltVMessAEADKDF               = "VMess AEAD KDF"
+	kdfSaltAuthIDEncryptionKey        = "AES Auth ID Encryption"
+	kdfSaltRespHeaderLenKey           = "AEAD Resp Header Len Key"
+	kdfSaltRespHeaderLenIV            = "AEAD Resp Header Len IV"
+	kdfSaltRespHeaderPayloadKey       = "AEAD Resp Header Key"
+	kdfSaltRespHeaderPayloadIV        = "AEAD Resp Header IV"
+	kdfSaltHeaderPayloadAEADKey       = "VMess Header AEAD Key"
+	kdfSaltHeaderPayloadAEADIV        = "VMess Header AEAD Nonce"
+	kdfSaltHeaderPayloadLengthAEADKey = "VMess Header AEAD Key_Length"
+	kdfSaltHeaderPayloadLengthAEADIV  = "VMess Header AEAD Nonce_Length"
+)
+
+type hmacCreator struct {
+	parent *hmacCreator
+	value  []byte
+}
+
+func (h *hmacCreator) Create() hash.Hash {
+	if h.parent == nil {
+		return hmac.New(sha256.New, h.value)
+	}
+	return hmac.New(h.parent.Create, h.value)
+}
+
+// kdf is the nested HMAC-SHA256 key derivation of the VMess AEAD header,
+// every path element wraps the previous HMAC as its hash function.
+func kdf(key []byte, path ...string) []byte {
+	creator := &hmacCreator{value: []byte(kdfSaltVMessAEADKDF)}
+	for _, v := range path {
+		creator = &hmacCreator{value: []byte(v), parent: creator}
+	}
+	h := creator.Create()
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+func kdf16(key []byte, path ...string) []byte {
+	return kdf(key, path...)[:16]
+}
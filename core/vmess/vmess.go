@@ -0,0 +1,183 @@
+package vmess
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chinaboard/coral/config"
+	"github.com/chinaboard/coral/core/proxy"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	securityAES128GCM        = 0x03
+	securityChacha20Poly1305 = 0x04
+
+	optionChunkStream  = 0x01
+	optionChunkMasking = 0x04
+
+	commandTCP = 0x01
+
+	addressIPv4   = 0x01
+	addressDomain = 0x02
+	addressIPv6   = 0x03
+
+	cmdKeySalt = "c48619fe-8f02-49e0-b9e9-edf763e17e21"
+)
+
+type VmessProxy struct {
+	name     string
+	Timeout  time.Duration
+	Address  string
+	cmdKey   []byte
+	security byte
+	Dialer   *net.Dialer
+}
+
+func New(server config.CoralServer, dialer *net.Dialer) (proxy.Proxy, error) {
+	id, err := parseUUID(server.UUID)
+	if err != nil {
+		return nil, err
+	}
+	security, err := parseSecurity(server.Security)
+	if err != nil {
+		return nil, err
+	}
+	if server.AlterID > 0 {
+		log.Warningln(server.Name, "alterId is ignored, only the AEAD header is supported")
+	}
+
+	cmdKey := md5.Sum(append(id, []byte(cmdKeySalt)...))
+	return &VmessProxy{
+		name:     server.Name,
+		Timeout:  server.ReadTimeout,
+		Address:  server.Address(),
+		cmdKey:   cmdKey[:],
+		security: security,
+		Dialer:   dialer,
+	}, nil
+}
+
+func (this *VmessProxy) Dial(network, addr string) (net.Conn, time.Duration, error) {
+	conn, err := this.Dialer.Dial("tcp", this.Address)
+	if err != nil {
+		return nil, this.Timeout, err
+	}
+	c, err := this.handshake(conn, addr)
+	if err != nil {
+		conn.Close()
+		return nil, this.Timeout, err
+	}
+	return c, this.Timeout, nil
+}
+
+func (this *VmessProxy) Name() string {
+	return this.name
+}
+
+func (this *VmessProxy) Direct() bool {
+	return false
+}
+
+func (this *VmessProxy) handshake(conn net.Conn, addr string) (*Conn, error) {
+	target, err := encodeAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]byte, 33)
+	rand.Read(keys)
+	reqIV, reqKey, respV := keys[:16], keys[16:32], keys[32]
+
+	padding := make([]byte, 1)
+	rand.Read(padding)
+	paddingLen := int(padding[0] % 16)
+
+	var header bytes.Buffer
+	header.WriteByte(1) // version
+	header.Write(reqIV)
+	header.Write(reqKey)
+	header.WriteByte(respV)
+	header.WriteByte(optionChunkStream | optionChunkMasking)
+	header.WriteByte(byte(paddingLen<<4) | this.security)
+	header.WriteByte(0) // reserved
+	header.WriteByte(commandTCP)
+	header.Write(target)
+	if paddingLen > 0 {
+		padding = make([]byte, paddingLen)
+		rand.Read(padding)
+		header.Write(padding)
+	}
+	h := fnv.New32a()
+	h.Write(header.Bytes())
+	header.Write(h.Sum(nil))
+
+	if _, err := conn.Write(sealHeader(this.cmdKey, header.Bytes())); err != nil {
+		return nil, err
+	}
+
+	respKey := sha256.Sum256(reqKey)
+	respIV := sha256.Sum256(reqIV)
+	return newConn(conn, this.security, reqKey, reqIV, respKey[:16], respIV[:16], respV), nil
+}
+
+func parseUUID(s string) ([]byte, error) {
+	id, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(id) != 16 {
+		return nil, errors.NotValidf("vmess uuid %q", s)
+	}
+	return id, nil
+}
+
+func parseSecurity(s string) (byte, error) {
+	switch strings.ToLower(s) {
+	case "", "auto", "aes-128-gcm":
+		return securityAES128GCM, nil
+	case "chacha20-poly1305":
+		return securityChacha20Poly1305, nil
+	default:
+		return 0, errors.NotSupportedf("vmess security %q", s)
+	}
+}
+
+// encodeAddress serializes addr as VMess does, port first.
+func encodeAddress(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, errors.NotValidf("port %q", portStr)
+	}
+
+	buf := make([]byte, 2, 2+1+1+len(host))
+	binary.BigEndian.PutUint16(buf, uint16(port))
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, addressIPv4)
+			buf = append(buf, ip4...)
+		} else {
+			buf = append(buf, addressIPv6)
+			buf = append(buf, ip.To16()...)
+		}
+		return buf, nil
+	}
+	if len(host) > 255 {
+		return nil, errors.NotValidf("host %q", host)
+	}
+	buf = append(buf, addressDomain, byte(len(host)))
+	buf = append(buf, host...)
+	return buf, nil
+}
@@ -0,0 +1,170 @@
+package vmess
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/chinaboard/coral/config"
+)
+
+const testUUID = "b831381d-6324-4d53-ad4f-8cda48b30811"
+
+// stubServer answers one VMess AEAD client: it checks the request header,
+// sends the response header and echoes the body upper-cased. The target of
+// the request is sent on target.
+func stubServer(ln net.Listener, cmdKey []byte, target chan<- string) error {
+	conn, err := ln.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	authID := make([]byte, 16)
+	sealedLength := make([]byte, 2+16)
+	nonce := make([]byte, 8)
+	for _, b := range [][]byte{authID, sealedLength, nonce} {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return fmt.Errorf("read header: %v", err)
+		}
+	}
+	block, _ := aes.NewCipher(kdf16(cmdKey, kdfSaltAuthIDEncryptionKey))
+	plainID := make([]byte, 16)
+	block.Decrypt(plainID, authID)
+	if crc32.ChecksumIEEE(plainID[:12]) != binary.BigEndian.Uint32(plainID[12:]) {
+		return fmt.Errorf("auth id checksum mismatch")
+	}
+	if ts := int64(binary.BigEndian.Uint64(plainID)); time.Since(time.Unix(ts, 0)) > time.Minute {
+		return fmt.Errorf("auth id too old: %d", ts)
+	}
+	lengthAEAD := newGCM(kdf16(cmdKey, kdfSaltHeaderPayloadLengthAEADKey, string(authID), string(nonce)))
+	length, err := lengthAEAD.Open(nil, kdf(cmdKey, kdfSaltHeaderPayloadLengthAEADIV, string(authID), string(nonce))[:12], sealedLength, authID)
+	if err != nil {
+		return fmt.Errorf("open header length: %v", err)
+	}
+	sealed := make([]byte, int(binary.BigEndian.Uint16(length))+16)
+	if _, err := io.ReadFull(conn, sealed); err != nil {
+		return fmt.Errorf("read header: %v", err)
+	}
+	payloadAEAD := newGCM(kdf16(cmdKey, kdfSaltHeaderPayloadAEADKey, string(authID), string(nonce)))
+	header, err := payloadAEAD.Open(nil, kdf(cmdKey, kdfSaltHeaderPayloadAEADIV, string(authID), string(nonce))[:12], sealed, authID)
+	if err != nil {
+		return fmt.Errorf("open header: %v", err)
+	}
+
+	h := fnv.New32a()
+	h.Write(header[:len(header)-4])
+	if !bytes.Equal(h.Sum(nil), header[len(header)-4:]) {
+		return fmt.Errorf("header checksum mismatch")
+	}
+	if header[0] != 1 || header[37] != commandTCP {
+		return fmt.Errorf("version %d command %d", header[0], header[37])
+	}
+	reqIV, reqKey, respV := header[1:17], header[17:33], header[33]
+	security := header[35] & 0x0f
+	port := binary.BigEndian.Uint16(header[38:40])
+	var host string
+	switch header[40] {
+	case addressIPv4:
+		host = net.IP(header[41:45]).String()
+	case addressIPv6:
+		host = net.IP(header[41:57]).String()
+	case addressDomain:
+		host = string(header[42 : 42+int(header[41])])
+	}
+	target <- net.JoinHostPort(host, strconv.Itoa(int(port)))
+
+	respKey := sha256.Sum256(reqKey)
+	respIV := sha256.Sum256(reqIV)
+	plain := []byte{respV, 0, 0, 0}
+	respLength := make([]byte, 2)
+	binary.BigEndian.PutUint16(respLength, uint16(len(plain)))
+	conn.Write(newGCM(kdf16(respKey[:16], kdfSaltRespHeaderLenKey)).Seal(nil, kdf(respIV[:16], kdfSaltRespHeaderLenIV)[:12], respLength, nil))
+	conn.Write(newGCM(kdf16(respKey[:16], kdfSaltRespHeaderPayloadKey)).Seal(nil, kdf(respIV[:16], kdfSaltRespHeaderPayloadIV)[:12], plain, nil))
+
+	// the server reads with the request keys and writes with the response
+	// keys, the reverse of a client
+	body := newConn(conn, security, respKey[:16], respIV[:16], reqKey, reqIV, respV)
+	body.headerRead = true
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("read body: %v", err)
+	}
+	body.Write(bytes.ToUpper(data))
+	return body.CloseWrite()
+}
+
+func TestHandshake(t *testing.T) {
+	for _, security := range []string{"auto", "aes-128-gcm", "chacha20-poly1305"} {
+		for _, addr := range []string{"example.com:443", "1.2.3.4:80", "[2001:db8::1]:8080"} {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			host, port, _ := net.SplitHostPort(ln.Addr().String())
+			p, err := New(config.CoralServer{Name: "vmess", Host: host, Port: port, UUID: testUUID, Security: security}, &net.Dialer{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			target := make(chan string, 1)
+			errc := make(chan error, 1)
+			go func() {
+				errc <- stubServer(ln, p.(*VmessProxy).cmdKey, target)
+			}()
+
+			conn, _, err := p.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("%s: dial: %v", security, err)
+			}
+			conn.Write([]byte("hello vmess"))
+			conn.(*Conn).CloseWrite()
+			reply, err := ioutil.ReadAll(conn)
+			if err != nil || string(reply) != "HELLO VMESS" {
+				t.Errorf("%s: reply %q, %v", security, reply, err)
+			}
+			if err := <-errc; err != nil {
+				t.Errorf("%s: stub server: %v", security, err)
+			} else if got := <-target; got != addr {
+				t.Errorf("%s: server asked for %q, want %q", security, got, addr)
+			}
+			conn.Close()
+			ln.Close()
+		}
+	}
+}
+
+func TestHandshakeWrongUUID(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	p, err := New(config.CoralServer{Name: "vmess", Host: host, Port: port, UUID: testUUID}, &net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := New(config.CoralServer{Name: "other", UUID: "00000000-0000-0000-0000-000000000001"}, &net.Dialer{})
+	errc := make(chan error, 1)
+	go func() {
+		errc <- stubServer(ln, other.(*VmessProxy).cmdKey, make(chan string, 1))
+	}()
+	conn, _, err := p.Dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := <-errc; err == nil {
+		t.Error("server accepted the header of another uuid")
+	}
+}
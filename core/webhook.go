@@ -0,0 +1,125 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	webhookQueue    = 64
+	webhookAttempts = 3
+	// the same event for the same upstream is sent at most once per interval
+	webhookInterval = time.Minute
+)
+
+// WebhookEvent is the JSON body posted to the webhook.
+type WebhookEvent struct {
+	Upstream string    `json:"upstream"`
+	Reason   string    `json:"reason"`
+	Time     time.Time `json:"time"`
+}
+
+// webhook posts upstream failures to an alerting endpoint. Events are
+// queued and sent by a single goroutine so request handling never waits,
+// and the endpoint is always reached directly.
+type webhook struct {
+	sync.Mutex
+	url    string
+	client *http.Client
+	events chan WebhookEvent
+	last   map[string]time.Time
+}
+
+func newWebhook(url string) *webhook {
+	if url == "" {
+		return nil
+	}
+	w := &webhook{
+		url: url,
+		client: &http.Client{
+			Timeout:   time.Second * 10,
+			Transport: &http.Transport{},
+		},
+		events: make(chan WebhookEvent, webhookQueue),
+		last:   map[string]time.Time{},
+	}
+	go w.run()
+	return w
+}
+
+// Notify queues an event, it is dropped when the queue is full or the same
+// event was sent recently.
+func (w *webhook) Notify(upstream, reason string) {
+	if w == nil {
+		return
+	}
+	now := time.Now()
+	key := upstream + "\x00" + reason
+	w.Lock()
+	if last, ok := w.last[key]; ok && now.Sub(last) < webhookInterval {
+		w.Unlock()
+		return
+	}
+	w.last[key] = now
+	w.Unlock()
+
+	select {
+	case w.events <- WebhookEvent{Upstream: upstream, Reason: reason, Time: now}:
+	default:
+		log.Warnln("webhook queue full, drop event", upstream, reason)
+	}
+}
+
+func (w *webhook) run() {
+	for ev := range w.events {
+		backoff := time.Second
+		for attempt := 1; ; attempt++ {
+			err := w.post(ev)
+			if err == nil {
+				break
+			}
+			if attempt == webhookAttempts {
+				log.Errorln("webhook:", err)
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (w *webhook) post(ev WebhookEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("webhook status %s", resp.Status)
+	}
+	return nil
+}
+
+// Sweep forgets events older than the rate limit interval.
+func (w *webhook) Sweep() {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	for key, last := range w.last {
+		if time.Since(last) >= webhookInterval {
+			delete(w.last, key)
+		}
+	}
+}
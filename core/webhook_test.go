@@ -0,0 +1,66 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	events := make(chan WebhookEvent, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); r.Method != "POST" || ct != "application/json" {
+			t.Errorf("%s with Content-Type %q, want a JSON POST", r.Method, ct)
+		}
+		var ev WebhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Error(err)
+		}
+		events <- ev
+	}))
+	defer receiver.Close()
+	w := newWebhook(receiver.URL)
+	defer close(w.events)
+
+	start := time.Now()
+	w.Notify("hk", "dial failed")
+	// the same event again is rate limited, others are not
+	w.Notify("hk", "dial failed")
+	w.Notify("hk", "canary stopped")
+	w.Notify("us", "dial failed")
+	want := []WebhookEvent{{Upstream: "hk", Reason: "dial failed"}, {Upstream: "hk", Reason: "canary stopped"}, {Upstream: "us", Reason: "dial failed"}}
+	for _, e := range want {
+		select {
+		case ev := <-events:
+			if ev.Upstream != e.Upstream || ev.Reason != e.Reason || ev.Time.Before(start.Add(-time.Second)) {
+				t.Errorf("got event %+v, want %+v", ev, e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event %+v not posted", e)
+		}
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("rate limited event %+v posted", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// once the interval passed, the event is sent again
+	w.Lock()
+	for key := range w.last {
+		w.last[key] = time.Now().Add(-webhookInterval)
+	}
+	w.Unlock()
+	w.Sweep()
+	w.Notify("hk", "dial failed")
+	select {
+	case ev := <-events:
+		if ev.Upstream != "hk" || ev.Reason != "dial failed" {
+			t.Errorf("got event %+v after the interval", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("event not posted again after the interval")
+	}
+}
@@ -0,0 +1,105 @@
+package resolver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/juju/errors"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// large enough for any EDNS-less UDP response
+const udpSize = 512
+
+// dnsServer speaks plain DNS over UDP or TCP, a truncated UDP response is
+// asked again over TCP.
+type dnsServer struct {
+	network string
+	addr    string
+}
+
+func (s *dnsServer) String() string {
+	return s.network + "://" + s.addr
+}
+
+func (s *dnsServer) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if s.network == "tcp" {
+		return s.exchangeTCP(ctx, query)
+	}
+	resp, err := s.exchangeUDP(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	var h dnsmessage.Parser
+	if header, err := h.Start(resp); err == nil && header.Truncated {
+		return s.exchangeTCP(ctx, query)
+	}
+	return resp, nil
+}
+
+func (s *dnsServer) exchangeUDP(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", s.addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn)
+	if _, err := conn.Write(query); err != nil {
+		return nil, errors.Trace(err)
+	}
+	buf := make([]byte, udpSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		// a response to an earlier query of the same socket is skipped
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+func (s *dnsServer) exchangeTCP(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn)
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, errors.Trace(err)
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, errors.Trace(err)
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return resp, nil
+}
+
+func setDeadline(ctx context.Context, conn net.Conn) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+	}
+}
+
+func newID() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
@@ -0,0 +1,67 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const dohMediaType = "application/dns-message"
+
+// the largest DNS message
+const dohMaxSize = 65535
+
+// doh sends queries as RFC 8484 POST requests. One client, keeping its
+// connections alive, serves every query and never goes through a proxy.
+type doh struct {
+	url    string
+	client *http.Client
+}
+
+func newDoh(url string) *doh {
+	return &doh{
+		url: url,
+		client: &http.Client{
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost: 4,
+				IdleConnTimeout:     time.Minute * 5,
+				ForceAttemptHTTP2:   true,
+			},
+		},
+	}
+}
+
+func (d *doh) String() string {
+	return d.url
+}
+
+func (d *doh) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	// RFC 8484 recommends id 0 for cache friendliness, the caller checks
+	// the id it sent so the query is left as is
+	req, err := http.NewRequest("POST", d.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, dohMaxSize))
+		return nil, errors.Errorf("doh %s: %s", d.url, resp.Status)
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, dohMaxSize))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return buf, nil
+}
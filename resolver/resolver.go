@@ -0,0 +1,265 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sync/singleflight"
+)
+
+// answers of the system resolver carry no TTL, they are kept this long
+const systemTTL = time.Minute
+
+// Exchanger sends a DNS query and returns the response, both in wire
+// format.
+type Exchanger interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+// Resolver looks up A and AAAA records through a configured DNS server and
+// caches them for their TTL. When the server can't be reached the system
+// resolver answers instead.
+type Resolver struct {
+	server  Exchanger
+	timeout time.Duration
+	entries sync.Map // host -> entry
+	flight  singleflight.Group
+}
+
+type entry struct {
+	ips     []net.IPAddr
+	expires time.Time
+}
+
+// New returns a resolver using server, "" for the system resolver only.
+func New(server string, timeout time.Duration) (*Resolver, error) {
+	r := &Resolver{timeout: timeout}
+	if server == "" {
+		return r, nil
+	}
+	ex, err := newExchanger(server)
+	if err != nil {
+		return nil, err
+	}
+	r.server = ex
+	return r, nil
+}
+
+func newExchanger(server string) (Exchanger, error) {
+	network, addr := "udp", server
+	if i := strings.Index(server, "://"); i >= 0 {
+		network, addr = server[:i], server[i+3:]
+	}
+	switch network {
+	case "https":
+		u, err := url.Parse(server)
+		if err != nil || u.Host == "" {
+			return nil, errors.NotValidf("dns server %q", server)
+		}
+		return newDoh(server), nil
+	case "udp", "tcp":
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+		}
+		if ip := net.ParseIP(hostOf(addr)); ip == nil {
+			return nil, errors.NotValidf("dns server %q, an IP address is required", server)
+		}
+		return &dnsServer{network: network, addr: addr}, nil
+	}
+	return nil, errors.NotSupportedf("dns server %q", server)
+}
+
+func hostOf(addr string) string {
+	host, _, _ := net.SplitHostPort(addr)
+	return host
+}
+
+func (r *Resolver) LookupIP(host string) ([]net.IP, error) {
+	addrs, err := r.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// LookupIPAddr returns the addresses of host, IPv4 first.
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if v, ok := r.entries.Load(host); ok && time.Now().Before(v.(entry).expires) {
+		return v.(entry).ips, nil
+	}
+	v, err, _ := r.flight.Do(host, func() (interface{}, error) {
+		ips, ttl, err := r.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		r.entries.Store(host, entry{ips: ips, expires: time.Now().Add(ttl)})
+		return ips, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]net.IPAddr), nil
+}
+
+func (r *Resolver) lookup(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	if r.server != nil {
+		ips, ttl, err := r.query(ctx, host)
+		if err == nil || isNotFound(err) {
+			return ips, ttl, err
+		}
+		log.Warnf("dns %s %s: %v, use the system resolver", r.server, host, err)
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	return ips, systemTTL, err
+}
+
+// query asks the server for the A and AAAA records of host at once.
+func (r *Resolver) query(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: "invalid name", Name: host, IsNotFound: true}
+	}
+	type result struct {
+		ips []net.IPAddr
+		ttl time.Duration
+		err error
+	}
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	results := make(chan result, len(types))
+	for _, t := range types {
+		go func(t dnsmessage.Type) {
+			ips, ttl, err := r.ask(ctx, name, t)
+			results <- result{ips, ttl, err}
+		}(t)
+	}
+
+	var (
+		ips     []net.IPAddr
+		ttl     time.Duration
+		lastErr error
+	)
+	for range types {
+		res := <-results
+		if res.err != nil {
+			lastErr = res.err
+			continue
+		}
+		ips = append(ips, res.ips...)
+		if len(res.ips) > 0 && (ttl == 0 || res.ttl < ttl) {
+			ttl = res.ttl
+		}
+	}
+	if len(ips) > 0 {
+		sortIPv4First(ips)
+		return ips, ttl, nil
+	}
+	if lastErr != nil {
+		return nil, 0, lastErr
+	}
+	return nil, 0, &net.DNSError{Err: "no such host", Name: host, Server: r.server.String(), IsNotFound: true}
+}
+
+func (r *Resolver) ask(ctx context.Context, name dnsmessage.Name, t dnsmessage.Type) ([]net.IPAddr, time.Duration, error) {
+	id := newID()
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: t, Class: dnsmessage.ClassINET}},
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	buf, err := r.server.Exchange(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(buf); err != nil {
+		return nil, 0, errors.Annotate(err, "dns response")
+	}
+	if resp.ID != id {
+		return nil, 0, errors.New("dns response id mismatch")
+	}
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name.String(), Server: r.server.String(), IsNotFound: true}
+	default:
+		return nil, 0, errors.Errorf("dns %s: %s", name, resp.RCode)
+	}
+	return answers(resp)
+}
+
+// answers returns the addresses in resp and their lowest TTL.
+func answers(resp dnsmessage.Message) ([]net.IPAddr, time.Duration, error) {
+	var (
+		ips []net.IPAddr
+		ttl uint32
+	)
+	for _, a := range resp.Answers {
+		var ip net.IP
+		switch body := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(body.AAAA[:])
+		default:
+			continue
+		}
+		ips = append(ips, net.IPAddr{IP: ip})
+		if len(ips) == 1 || a.Header.TTL < ttl {
+			ttl = a.Header.TTL
+		}
+	}
+	if ttl == 0 {
+		ttl = 1
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// Sweep removes expired entries, it is meant to be called periodically.
+func (r *Resolver) Sweep() {
+	now := time.Now()
+	r.entries.Range(func(key, value interface{}) bool {
+		if now.After(value.(entry).expires) {
+			r.entries.Delete(key)
+		}
+		return true
+	})
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+func sortIPv4First(ips []net.IPAddr) {
+	i := 0
+	for j := range ips {
+		if ips[j].IP.To4() != nil {
+			ips[i], ips[j] = ips[j], ips[i]
+			i++
+		}
+	}
+}
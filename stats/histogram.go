@@ -0,0 +1,123 @@
+package stats
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds in seconds, same as the Prometheus
+// client defaults.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// TunnelBuckets are the upper bounds in seconds for the lifetime of a
+// tunnel, which lasts from a second to hours.
+var TunnelBuckets = []float64{1, 5, 15, 60, 300, 900, 1800, 3600}
+
+const (
+	MetricDial      = "dial_seconds"
+	MetricFirstByte = "first_byte_seconds"
+	MetricTunnel    = "tunnel_seconds"
+
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+type Histogram struct {
+	sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+type HistogramSnapshot struct {
+	Metric   string    `json:"metric"`
+	Upstream string    `json:"upstream"`
+	Outcome  string    `json:"outcome"`
+	Buckets  []float64 `json:"buckets"`
+	Counts   []uint64  `json:"counts"` // cumulative, one per bucket
+	Sum      float64   `json:"sum"`
+	Count    uint64    `json:"count"`
+}
+
+type histogramKey struct {
+	metric   string
+	upstream string
+	outcome  string
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	v := d.Seconds()
+	h.Lock()
+	defer h.Unlock()
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) snapshot() (counts []uint64, sum float64, count uint64) {
+	h.Lock()
+	defer h.Unlock()
+	counts = make([]uint64, len(h.counts))
+	var acc uint64
+	for i, c := range h.counts {
+		acc += c
+		counts[i] = acc
+	}
+	return counts, h.sum, h.count
+}
+
+// Observe records a latency sample. Labels are limited to the upstream name
+// and the outcome so the number of series stays bounded.
+func (s *Stats) Observe(metric, upstream, outcome string, d time.Duration) {
+	key := histogramKey{metric: metric, upstream: upstream, outcome: outcome}
+	v, ok := s.histograms.Load(key)
+	if !ok {
+		buckets := DefaultBuckets
+		if metric == MetricTunnel {
+			buckets = TunnelBuckets
+		}
+		v, _ = s.histograms.LoadOrStore(key, NewHistogram(buckets))
+	}
+	v.(*Histogram).Observe(d)
+}
+
+func (s *Stats) histogramSnapshots() []HistogramSnapshot {
+	list := []HistogramSnapshot{}
+	s.histograms.Range(func(key, value interface{}) bool {
+		k := key.(histogramKey)
+		h := value.(*Histogram)
+		counts, sum, count := h.snapshot()
+		list = append(list, HistogramSnapshot{
+			Metric:   k.metric,
+			Upstream: k.upstream,
+			Outcome:  k.outcome,
+			Buckets:  h.buckets,
+			Counts:   counts,
+			Sum:      sum,
+			Count:    count,
+		})
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Metric != b.Metric {
+			return a.Metric < b.Metric
+		}
+		if a.Upstream != b.Upstream {
+			return a.Upstream < b.Upstream
+		}
+		return a.Outcome < b.Outcome
+	})
+	return list
+}
@@ -0,0 +1,56 @@
+package stats
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramObserve(t *testing.T) {
+	h := NewHistogram([]float64{1, 5})
+	for _, d := range []time.Duration{500 * time.Millisecond, time.Second, 3 * time.Second, 10 * time.Second} {
+		h.Observe(d)
+	}
+	counts, sum, count := h.snapshot()
+	// a sample on a bound falls in that bucket, one above every bound only
+	// in the total
+	if want := []uint64{2, 3}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("cumulative counts %v, want %v", counts, want)
+	}
+	if sum != 14.5 || count != 4 {
+		t.Errorf("sum %v and count %d, want 14.5 and 4", sum, count)
+	}
+}
+
+func TestHistogramLabels(t *testing.T) {
+	s := &Stats{}
+	s.Observe(MetricDial, "hk", OutcomeSuccess, 3*time.Millisecond)
+	s.Observe(MetricDial, "hk", OutcomeSuccess, 30*time.Millisecond)
+	s.Observe(MetricDial, `us "west"`, OutcomeFailure, 2*time.Second)
+	s.Observe(MetricTunnel, "hk", OutcomeSuccess, 10*time.Second)
+
+	var buf bytes.Buffer
+	WritePrometheus(&buf, s.Snapshot())
+	lines := strings.Split(buf.String(), "\n")
+	for _, want := range []string{
+		`coral_dial_seconds_bucket{upstream="hk",outcome="success",le="0.005"} 1`,
+		`coral_dial_seconds_bucket{upstream="hk",outcome="success",le="0.05"} 2`,
+		`coral_dial_seconds_bucket{upstream="hk",outcome="success",le="+Inf"} 2`,
+		`coral_dial_seconds_count{upstream="hk",outcome="success"} 2`,
+		`coral_dial_seconds_bucket{upstream="us \"west\"",outcome="failure",le="1"} 0`,
+		`coral_dial_seconds_bucket{upstream="us \"west\"",outcome="failure",le="2.5"} 1`,
+		`coral_dial_seconds_sum{upstream="us \"west\"",outcome="failure"} 2`,
+		// tunnels have buckets of their own
+		`coral_tunnel_seconds_bucket{upstream="hk",outcome="success",le="15"} 1`,
+		`coral_tunnel_seconds_bucket{upstream="hk",outcome="success",le="5"} 0`,
+	} {
+		if !contains(lines, want) {
+			t.Errorf("%s not exported", want)
+		}
+	}
+	if n := strings.Count(buf.String(), "# TYPE coral_dial_seconds histogram"); n != 1 {
+		t.Errorf("dial_seconds family declared %d times, want 1", n)
+	}
+}
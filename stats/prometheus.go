@@ -0,0 +1,143 @@
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PrometheusExporter serves the counters in the Prometheus text format on
+// its own address.
+type PrometheusExporter struct {
+	stats *Stats
+	srv   *http.Server
+}
+
+func NewPrometheusExporter(addr string, stats *Stats) *PrometheusExporter {
+	e := &PrometheusExporter{stats: stats}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	e.srv = &http.Server{Addr: addr, Handler: mux}
+	return e
+}
+
+func (e *PrometheusExporter) Start() {
+	go func() {
+		if err := e.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorln("metrics:", err)
+		}
+	}()
+}
+
+func (e *PrometheusExporter) Stop() error {
+	return e.srv.Close()
+}
+
+func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	WritePrometheus(w, e.stats.Snapshot())
+}
+
+// WritePrometheus writes snap in the Prometheus text exposition format.
+func WritePrometheus(out io.Writer, snap Snapshot) {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	family(w, "coral_connections_total", "counter", "Requests handled, by kind.")
+	sample(w, "coral_connections_total", labels("kind", "connect"), float64(snap.Tunnels))
+	sample(w, "coral_connections_total", labels("kind", "http"), float64(snap.Connections-snap.Tunnels))
+	family(w, "coral_connections_in_flight", "gauge", "Requests and tunnels in flight.")
+	sample(w, "coral_connections_in_flight", "", float64(snap.InFlight))
+	family(w, "coral_connections_max", "gauge", "Cap of the requests and tunnels in flight, 0 without cap.")
+	sample(w, "coral_connections_max", "", float64(snap.MaxConns))
+	family(w, "coral_errors_total", "counter", "Upstream errors.")
+	sample(w, "coral_errors_total", "", float64(snap.Errors))
+	family(w, "coral_cache_hits_total", "counter", "Routing cache hits.")
+	sample(w, "coral_cache_hits_total", "", float64(snap.CacheHits))
+	family(w, "coral_cache_misses_total", "counter", "Routing cache misses.")
+	sample(w, "coral_cache_misses_total", "", float64(snap.CacheMisses))
+	family(w, "coral_cache_lookup_failures_total", "counter", "DNS lookups failed while classifying hosts.")
+	sample(w, "coral_cache_lookup_failures_total", "", float64(snap.LookupFails))
+
+	names := make([]string, 0, len(snap.Upstreams))
+	for name := range snap.Upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	family(w, "coral_upstream_dials_total", "counter", "Dials through each upstream, by outcome.")
+	for _, name := range names {
+		u := snap.Upstreams[name]
+		sample(w, "coral_upstream_dials_total", labels("upstream", name, "outcome", OutcomeSuccess), float64(u.DialSuccesses))
+		sample(w, "coral_upstream_dials_total", labels("upstream", name, "outcome", OutcomeFailure), float64(u.DialFailures))
+	}
+	family(w, "coral_upstream_bytes_total", "counter", "Bytes transferred through each upstream.")
+	for _, name := range names {
+		sample(w, "coral_upstream_bytes_total", labels("upstream", name), float64(snap.Upstreams[name].Bytes))
+	}
+	family(w, "coral_upstream_errors_total", "counter", "Errors of each upstream.")
+	for _, name := range names {
+		sample(w, "coral_upstream_errors_total", labels("upstream", name), float64(snap.Upstreams[name].Errors))
+	}
+	family(w, "coral_upstream_active", "gauge", "Connections open through each upstream.")
+	for _, name := range names {
+		sample(w, "coral_upstream_active", labels("upstream", name), float64(snap.Upstreams[name].Active))
+	}
+	family(w, "coral_upstream_excluded_total", "counter", "Times each upstream was left out of the selection, by reason.")
+	for _, name := range names {
+		excluded := snap.Upstreams[name].Excluded
+		reasons := make([]string, 0, len(excluded))
+		for reason := range excluded {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			sample(w, "coral_upstream_excluded_total", labels("upstream", name, "reason", reason), float64(excluded[reason]))
+		}
+	}
+
+	metric := ""
+	for _, h := range snap.Histograms {
+		name := "coral_" + h.Metric
+		if name != metric {
+			family(w, name, "histogram", strings.Replace(h.Metric, "_", " ", -1)+".")
+			metric = name
+		}
+		for i, le := range h.Buckets {
+			sample(w, name+"_bucket", labels("upstream", h.Upstream, "outcome", h.Outcome, "le", strconv.FormatFloat(le, 'g', -1, 64)), float64(h.Counts[i]))
+		}
+		sample(w, name+"_bucket", labels("upstream", h.Upstream, "outcome", h.Outcome, "le", "+Inf"), float64(h.Count))
+		sample(w, name+"_sum", labels("upstream", h.Upstream, "outcome", h.Outcome), h.Sum)
+		sample(w, name+"_count", labels("upstream", h.Upstream, "outcome", h.Outcome), float64(h.Count))
+	}
+}
+
+func family(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sample(w io.Writer, name, labels string, value float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats name, value pairs as a label set.
+func labels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
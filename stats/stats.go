@@ -0,0 +1,220 @@
+package stats
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type Stats struct {
+	connections uint64
+	tunnels     uint64
+	errors      uint64
+	cacheHits   uint64
+	cacheMisses uint64
+	lookupFails uint64
+	upstreams   sync.Map
+	histograms  sync.Map
+	// func() (inUse, max int) of the connection limit, sampled by Snapshot
+	connLimit atomic.Value
+	// called with the name of each upstream Prune forgets
+	pruneMu    sync.Mutex
+	pruneHooks []func(name string)
+}
+
+type upstream struct {
+	dials         uint64
+	dialSuccesses uint64
+	dialFailures  uint64
+	bytes         uint64
+	errors        uint64
+	active        int64
+	// exclusion reason -> *uint64
+	excluded sync.Map
+}
+
+type Snapshot struct {
+	Connections uint64                      `json:"connections"`
+	Tunnels     uint64                      `json:"tunnels"`
+	Errors      uint64                      `json:"errors"`
+	CacheHits   uint64                      `json:"cacheHits"`
+	CacheMisses uint64                      `json:"cacheMisses"`
+	LookupFails uint64                      `json:"lookupFailures"`
+	Upstreams   map[string]UpstreamSnapshot `json:"upstreams"`
+	Histograms  []HistogramSnapshot         `json:"histograms"`
+	// requests and tunnels in flight and their cap, 0 when there is none
+	InFlight int `json:"inFlight"`
+	MaxConns int `json:"maxConns"`
+}
+
+type UpstreamSnapshot struct {
+	Dials         uint64 `json:"dials"`
+	DialSuccesses uint64 `json:"dialSuccesses"`
+	DialFailures  uint64 `json:"dialFailures"`
+	Bytes         uint64 `json:"bytes"`
+	Errors        uint64 `json:"errors"`
+	Active        int64  `json:"active"`
+	// times the upstream was left out of the selection, by reason
+	Excluded map[string]uint64 `json:"excluded,omitempty"`
+}
+
+var Global = &Stats{}
+
+func (s *Stats) upstream(name string) *upstream {
+	if v, ok := s.upstreams.Load(name); ok {
+		return v.(*upstream)
+	}
+	v, _ := s.upstreams.LoadOrStore(name, &upstream{})
+	return v.(*upstream)
+}
+
+func (s *Stats) AddConnection() {
+	atomic.AddUint64(&s.connections, 1)
+}
+
+// AddTunnel counts a CONNECT request, also counted by AddConnection.
+func (s *Stats) AddTunnel() {
+	atomic.AddUint64(&s.tunnels, 1)
+}
+
+func (s *Stats) AddCacheHit() {
+	atomic.AddUint64(&s.cacheHits, 1)
+}
+
+func (s *Stats) AddCacheMiss() {
+	atomic.AddUint64(&s.cacheMisses, 1)
+}
+
+func (s *Stats) AddLookupFailure() {
+	atomic.AddUint64(&s.lookupFails, 1)
+}
+
+// SetConnLimit registers the function reporting the connections in flight
+// and their cap.
+func (s *Stats) SetConnLimit(f func() (inUse, max int)) {
+	s.connLimit.Store(f)
+}
+
+func (s *Stats) AddDial(name string) {
+	atomic.AddUint64(&s.upstream(name).dials, 1)
+}
+
+// AddDialSuccess counts a dial that connected, kept apart from the dials so
+// the successes never have to be derived from two counters read at
+// different times.
+func (s *Stats) AddDialSuccess(name string) {
+	atomic.AddUint64(&s.upstream(name).dialSuccesses, 1)
+}
+
+func (s *Stats) AddDialFailure(name string) {
+	atomic.AddUint64(&s.upstream(name).dialFailures, 1)
+}
+
+func (s *Stats) AddBytes(name string, n int64) {
+	if n > 0 {
+		atomic.AddUint64(&s.upstream(name).bytes, uint64(n))
+	}
+}
+
+func (s *Stats) AddError(name string) {
+	atomic.AddUint64(&s.errors, 1)
+	atomic.AddUint64(&s.upstream(name).errors, 1)
+}
+
+// AddActive changes the number of connections currently open through an
+// upstream by delta.
+func (s *Stats) AddActive(name string, delta int64) {
+	atomic.AddInt64(&s.upstream(name).active, delta)
+}
+
+// Active returns the number of connections currently open through an
+// upstream.
+func (s *Stats) Active(name string) int64 {
+	return atomic.LoadInt64(&s.upstream(name).active)
+}
+
+// AddExclusion counts an upstream left out of the selection for reason.
+func (s *Stats) AddExclusion(name, reason string) {
+	u := s.upstream(name)
+	v, ok := u.excluded.Load(reason)
+	if !ok {
+		v, _ = u.excluded.LoadOrStore(reason, new(uint64))
+	}
+	atomic.AddUint64(v.(*uint64), 1)
+}
+
+// Prune forgets the counters and histograms of the upstreams keep rejects,
+// e.g. those a reload removed, once nothing is open through them.
+func (s *Stats) Prune(keep func(name string) bool) {
+	var pruned []string
+	s.upstreams.Range(func(key, value interface{}) bool {
+		name := key.(string)
+		if !keep(name) && atomic.LoadInt64(&value.(*upstream).active) == 0 {
+			s.upstreams.Delete(key)
+			pruned = append(pruned, name)
+		}
+		return true
+	})
+	s.histograms.Range(func(key, value interface{}) bool {
+		if name := key.(histogramKey).upstream; !keep(name) {
+			if _, ok := s.upstreams.Load(name); !ok {
+				s.histograms.Delete(key)
+			}
+		}
+		return true
+	})
+	s.pruneMu.Lock()
+	hooks := s.pruneHooks
+	s.pruneMu.Unlock()
+	for _, name := range pruned {
+		for _, f := range hooks {
+			f(name)
+		}
+	}
+}
+
+// OnPrune registers f to be called with the name of every upstream Prune
+// forgets, for exporters keeping state per upstream.
+func (s *Stats) OnPrune(f func(name string)) {
+	s.pruneMu.Lock()
+	s.pruneHooks = append(s.pruneHooks, f)
+	s.pruneMu.Unlock()
+}
+
+// Snapshot returns a consistent-enough copy of the counters, shared by every
+// exporter so they all report the same numbers.
+func (s *Stats) Snapshot() Snapshot {
+	snap := Snapshot{
+		Connections: atomic.LoadUint64(&s.connections),
+		Tunnels:     atomic.LoadUint64(&s.tunnels),
+		Errors:      atomic.LoadUint64(&s.errors),
+		CacheHits:   atomic.LoadUint64(&s.cacheHits),
+		CacheMisses: atomic.LoadUint64(&s.cacheMisses),
+		LookupFails: atomic.LoadUint64(&s.lookupFails),
+		Upstreams:   map[string]UpstreamSnapshot{},
+	}
+	if f, ok := s.connLimit.Load().(func() (int, int)); ok {
+		snap.InFlight, snap.MaxConns = f()
+	}
+	s.upstreams.Range(func(key, value interface{}) bool {
+		u := value.(*upstream)
+		us := UpstreamSnapshot{
+			Dials:         atomic.LoadUint64(&u.dials),
+			DialSuccesses: atomic.LoadUint64(&u.dialSuccesses),
+			DialFailures:  atomic.LoadUint64(&u.dialFailures),
+			Bytes:         atomic.LoadUint64(&u.bytes),
+			Errors:        atomic.LoadUint64(&u.errors),
+			Active:        atomic.LoadInt64(&u.active),
+		}
+		u.excluded.Range(func(reason, n interface{}) bool {
+			if us.Excluded == nil {
+				us.Excluded = map[string]uint64{}
+			}
+			us.Excluded[reason.(string)] = atomic.LoadUint64(n.(*uint64))
+			return true
+		})
+		snap.Upstreams[key.(string)] = us
+		return true
+	})
+	snap.Histograms = s.histogramSnapshots()
+	return snap
+}
@@ -0,0 +1,31 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrune(t *testing.T) {
+	s := &Stats{}
+	s.AddDial("kept")
+	s.AddDial("removed")
+	s.Observe(MetricDial, "removed", OutcomeSuccess, time.Millisecond)
+	s.AddActive("busy", 1)
+
+	s.Prune(func(name string) bool { return name == "kept" })
+	snap := s.Snapshot()
+	if _, ok := snap.Upstreams["kept"]; !ok {
+		t.Error("kept upstream pruned")
+	}
+	if _, ok := snap.Upstreams["removed"]; ok {
+		t.Error("removed upstream kept")
+	}
+	if _, ok := snap.Upstreams["busy"]; !ok {
+		t.Error("upstream with open connections pruned")
+	}
+	for _, h := range snap.Histograms {
+		if h.Upstream == "removed" {
+			t.Error("histogram of removed upstream kept")
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package stats
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// keep each datagram below a typical MTU so it is never fragmented
+const statsdMaxPacketSize = 1432
+
+type StatsdEmitter struct {
+	stats    *Stats
+	conn     net.Conn
+	interval time.Duration
+	done     chan struct{}
+	wg       sync.WaitGroup
+	// guards last, which Flush and the prune of an upstream both change
+	mu   sync.Mutex
+	last Snapshot
+}
+
+func NewStatsdEmitter(addr string, interval time.Duration, stats *Stats) (*StatsdEmitter, error) {
+	if interval <= 0 {
+		return nil, errors.New("invalid statsd interval")
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	e := &StatsdEmitter{
+		stats:    stats,
+		conn:     conn,
+		interval: interval,
+		done:     make(chan struct{}),
+		last:     Snapshot{Upstreams: map[string]UpstreamSnapshot{}},
+	}
+	// an upstream added again after a prune counts from zero, the counts
+	// it had before were already sent
+	stats.OnPrune(func(name string) {
+		e.mu.Lock()
+		delete(e.last.Upstreams, name)
+		e.mu.Unlock()
+	})
+	return e, nil
+}
+
+func (e *StatsdEmitter) Start() {
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				e.Flush()
+			case <-e.done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop sends the counters left once the periodic flushes ended.
+func (e *StatsdEmitter) Stop() {
+	close(e.done)
+	e.wg.Wait()
+	e.Flush()
+	e.conn.Close()
+}
+
+// Flush sends the counters accumulated since the previous flush. StatsD
+// counters are deltas, so only the difference to the last snapshot is sent,
+// the active connections are a gauge.
+func (e *StatsdEmitter) Flush() {
+	e.mu.Lock()
+	snap := e.stats.Snapshot()
+	lines := []string{
+		counter("coral.connections", snap.Connections-e.last.Connections),
+		counter("coral.tunnels", snap.Tunnels-e.last.Tunnels),
+		counter("coral.errors", snap.Errors-e.last.Errors),
+		counter("coral.cache.hits", snap.CacheHits-e.last.CacheHits),
+		counter("coral.cache.misses", snap.CacheMisses-e.last.CacheMisses),
+		counter("coral.cache.lookup_failures", snap.LookupFails-e.last.LookupFails),
+	}
+	for name, u := range snap.Upstreams {
+		prev := e.last.Upstreams[name]
+		prefix := "coral.upstream." + sanitize(name)
+		lines = append(lines,
+			counter(prefix+".dials", u.Dials-prev.Dials),
+			counter(prefix+".dial_failures", u.DialFailures-prev.DialFailures),
+			counter(prefix+".bytes", u.Bytes-prev.Bytes),
+			counter(prefix+".errors", u.Errors-prev.Errors),
+			gauge(prefix+".active", u.Active),
+		)
+		for reason, n := range u.Excluded {
+			lines = append(lines, counter(prefix+".excluded."+sanitize(reason), n-prev.Excluded[reason]))
+		}
+	}
+	e.last = snap
+	e.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+len(line)+1 > statsdMaxPacketSize {
+			e.send(buf.Bytes())
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		e.send(buf.Bytes())
+	}
+}
+
+func (e *StatsdEmitter) send(b []byte) {
+	if _, err := e.conn.Write(b); err != nil {
+		log.Debugln("statsd", err)
+	}
+}
+
+func counter(name string, value uint64) string {
+	return fmt.Sprintf("%s:%d|c", name, value)
+}
+
+func gauge(name string, value int64) string {
+	return fmt.Sprintf("%s:%d|g", name, value)
+}
+
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', ' ':
+			return '_'
+		}
+		return r
+	}, name)
+}
@@ -0,0 +1,157 @@
+package stats
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// capture returns the lines of the datagrams the listener receives until
+// none arrives for a while.
+func capture(t *testing.T, ln net.PacketConn) []string {
+	var lines []string
+	buf := make([]byte, 64<<10)
+	for {
+		ln.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := ln.ReadFrom(buf)
+		if err != nil {
+			return lines
+		}
+		if n > statsdMaxPacketSize {
+			t.Errorf("datagram of %d bytes, want at most %d", n, statsdMaxPacketSize)
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+}
+
+func contains(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+func TestStatsdEmitter(t *testing.T) {
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s := &Stats{}
+	e, err := NewStatsdEmitter(ln.LocalAddr().String(), time.Hour, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddConnection()
+	s.AddConnection()
+	s.AddCacheHit()
+	s.AddDial("hk.1")
+	s.AddBytes("hk.1", 100)
+	s.AddActive("hk.1", 3)
+	e.Flush()
+	lines := capture(t, ln)
+	for _, want := range []string{
+		"coral.connections:2|c",
+		"coral.cache.hits:1|c",
+		"coral.upstream.hk_1.dials:1|c",
+		"coral.upstream.hk_1.bytes:100|c",
+		"coral.upstream.hk_1.active:3|g",
+	} {
+		if !contains(lines, want) {
+			t.Errorf("first flush: %q not in %q", want, lines)
+		}
+	}
+
+	// counters are sent as the change since the previous flush
+	s.AddConnection()
+	s.AddBytes("hk.1", 20)
+	e.Flush()
+	lines = capture(t, ln)
+	for _, want := range []string{
+		"coral.connections:1|c",
+		"coral.cache.hits:0|c",
+		"coral.upstream.hk_1.bytes:20|c",
+	} {
+		if !contains(lines, want) {
+			t.Errorf("second flush: %q not in %q", want, lines)
+		}
+	}
+
+	// many upstreams are split over several datagrams
+	for i := 0; i < 200; i++ {
+		s.AddDial("upstream-" + strconv.Itoa(i))
+	}
+	e.Stop()
+	if lines := capture(t, ln); len(lines) < 200 {
+		t.Errorf("got %d lines of 200 upstreams", len(lines))
+	}
+}
+
+func TestStatsdAfterPrune(t *testing.T) {
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s := &Stats{}
+	e, err := NewStatsdEmitter(ln.LocalAddr().String(), time.Hour, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+	s.AddBytes("hk", 100)
+	e.Flush()
+	capture(t, ln)
+
+	// the counters of an upstream removed and added again between two
+	// flushes start over instead of wrapping around
+	s.Prune(func(string) bool { return false })
+	s.AddBytes("hk", 10)
+	e.Flush()
+	if lines := capture(t, ln); !contains(lines, "coral.upstream.hk.bytes:10|c") {
+		t.Errorf("bytes after the prune not in %q", lines)
+	}
+
+	// nor are they counted from what was sent before the prune
+	s.Prune(func(string) bool { return false })
+	s.AddBytes("hk", 150)
+	e.Flush()
+	if lines := capture(t, ln); !contains(lines, "coral.upstream.hk.bytes:150|c") {
+		t.Errorf("bytes after the second prune not in %q", lines)
+	}
+}
+
+func TestStatsdStop(t *testing.T) {
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s := &Stats{}
+	e, err := NewStatsdEmitter(ln.LocalAddr().String(), time.Millisecond, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Start()
+	s.AddConnection()
+	time.Sleep(20 * time.Millisecond)
+	s.AddConnection()
+	// the last flush must not race the ticker's, and sends what's left
+	e.Stop()
+	var sent int
+	for _, line := range capture(t, ln) {
+		if line == "coral.connections:1|c" {
+			sent++
+		}
+	}
+	if sent != 2 {
+		t.Errorf("connections sent %d times, want 2", sent)
+	}
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"strings"
+)
+
+// DomainList matches a host against a set of domains, a domain also
+// matches all of its subdomains.
+type DomainList map[string]bool
+
+func NewDomainList(domains []string) DomainList {
+	list := DomainList{}
+	for _, d := range domains {
+		d = strings.ToLower(strings.Trim(strings.TrimSpace(d), "."))
+		if d != "" {
+			list[d] = true
+		}
+	}
+	return list
+}
+
+func (l DomainList) Match(host string) bool {
+	if len(l) == 0 {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for {
+		if l[host] {
+			return true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return false
+		}
+		host = host[i+1:]
+	}
+}
+
+// DomainMap maps domains to a value, a domain also matches all of its
+// subdomains and the most specific one wins. "*.example.com" is the same
+// as "example.com", "*" matches any host no other domain does.
+type DomainMap map[string]string
+
+func NewDomainMap(domains map[string]string) DomainMap {
+	m := DomainMap{}
+	for d, v := range domains {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d != "*" {
+			d = strings.Trim(strings.TrimPrefix(d, "*."), ".")
+		}
+		if d != "" {
+			m[d] = v
+		}
+	}
+	return m
+}
+
+// Lookup returns the value of the most specific domain matching host.
+func (m DomainMap) Lookup(host string) (string, bool) {
+	if len(m) == 0 {
+		return "", false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for {
+		if v, ok := m[host]; ok {
+			return v, true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			v, ok := m["*"]
+			return v, ok
+		}
+		host = host[i+1:]
+	}
+}
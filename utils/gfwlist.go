@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"strings"
+)
+
+// ParseGfwList returns the domains of a list in the AutoProxy format of the
+// gfwlist, base64 encoded or not. A plain list of domains, one per line,
+// parses as well. Exceptions, regular expressions and rules with wildcards
+// in the host are left out.
+func ParseGfwList(data []byte) []string {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("[AutoProxy")) {
+		compact := bytes.Join(bytes.Fields(data), nil)
+		if decoded, err := base64.StdEncoding.DecodeString(string(compact)); err == nil {
+			data = decoded
+		}
+	}
+
+	var domains []string
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		domain := gfwListDomain(strings.TrimSpace(scanner.Text()))
+		if domain != "" && !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// gfwListDomain returns the domain of a rule, or "" for rules that don't
+// name one.
+func gfwListDomain(rule string) string {
+	switch {
+	case rule == "",
+		strings.HasPrefix(rule, "!"),
+		strings.HasPrefix(rule, "["),
+		strings.HasPrefix(rule, "@@"),
+		strings.HasPrefix(rule, "/"):
+		return ""
+	}
+	rule = strings.TrimLeft(rule, "|")
+	if i := strings.Index(rule, "://"); i >= 0 {
+		rule = rule[i+3:]
+	}
+	if i := strings.IndexAny(rule, "/^:?"); i >= 0 {
+		rule = rule[:i]
+	}
+	rule = strings.ToLower(strings.Trim(rule, "."))
+	if !strings.Contains(rule, ".") || strings.ContainsAny(rule, "*%") {
+		return ""
+	}
+	return rule
+}
@@ -19,6 +19,13 @@ func ShouldDirect(ip string) bool {
 			log.Errorf("error judging ip should direct: %s", ip)
 		}
 	}()
+	if parsed := net.ParseIP(strings.Trim(ip, "[]")); parsed != nil {
+		if parsed.To4() == nil {
+			return IsLocalHost(parsed.String()) || cnIPv6(parsed)
+		}
+		// IPv4-mapped IPv6 addresses are looked up as IPv4
+		ip = parsed.To4().String()
+	}
 	_, isPrivate := HostIsIP(ip)
 	if isPrivate {
 		return true
@@ -41,6 +48,36 @@ func ShouldDirect(ip string) bool {
 	return ipLong <= data.CNIPDataStart[ipIndex]+(uint32)(data.CNIPDataNum[ipIndex])
 }
 
+// CNIPv6Nets are the IPv6 allocations of the major Chinese carriers and
+// networks. The generated data covers IPv4 only, so an address of a smaller
+// Chinese network is taken as foreign.
+var CNIPv6Nets = parseCIDRs(
+	"240e::/18",      // China Telecom
+	"2408:8000::/20", // China Unicom
+	"2409:8000::/20", // China Mobile
+	"2001:da8::/32",  // CERNET
+	"240c::/28",      // CERNET2
+	"2400:3200::/32", // Alibaba
+	"2402:4e00::/32", // Tencent
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, nets[i], _ = net.ParseCIDR(cidr)
+	}
+	return nets
+}
+
+func cnIPv6(ip net.IP) bool {
+	for _, n := range CNIPv6Nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func HostIsIP(host string) (isIP, isPrivate bool) {
 	part := strings.Split(host, ".")
 	if len(part) != 4 {
@@ -0,0 +1,35 @@
+package utils
+
+import "testing"
+
+func TestShouldDirect(t *testing.T) {
+	tests := []struct {
+		ip     string
+		direct bool
+	}{
+		{"114.114.114.114", true},
+		{"223.5.5.5", true},
+		{"8.8.8.8", false},
+		{"1.1.1.1", false},
+		{"127.0.0.1", true},
+		{"192.168.1.1", true},
+		{"10.0.0.1", true},
+		{"0.0.0.0", true},
+		{"::ffff:114.114.114.114", true},
+		{"::ffff:8.8.8.8", false},
+		{"::1", true},
+		{"[::1]", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"2001:4860:4860::8888", false},
+		{"240e::1", true},
+		{"2408:8456::1", true},
+		{"2409:8000::1", true},
+		{"not an ip", false},
+	}
+	for _, tt := range tests {
+		if got := ShouldDirect(tt.ip); got != tt.direct {
+			t.Errorf("ShouldDirect(%q) = %v, want %v", tt.ip, got, tt.direct)
+		}
+	}
+}
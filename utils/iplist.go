@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"net"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// IPList matches IP addresses against a set of IPs and CIDRs.
+type IPList []*net.IPNet
+
+func ParseIPList(items []string) (IPList, error) {
+	list := IPList{}
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.Contains(item, "/") {
+			_, ipnet, err := net.ParseCIDR(item)
+			if err != nil {
+				return nil, errors.NotValidf("CIDR %q", item)
+			}
+			list = append(list, ipnet)
+			continue
+		}
+		ip := net.ParseIP(strings.Trim(item, "[]"))
+		if ip == nil {
+			return nil, errors.NotValidf("IP %q", item)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return list, nil
+}
+
+// Contains reports whether ip, an address without port, is in the list.
+func (l IPList) Contains(ip string) bool {
+	addr := net.ParseIP(strings.Trim(ip, "[]"))
+	if addr == nil {
+		return false
+	}
+	for _, ipnet := range l {
+		if ipnet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
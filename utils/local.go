@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"net"
+	"strings"
+)
+
+var localNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"::/128",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		localNets = append(localNets, n)
+	}
+}
+
+// IsLocalHost reports whether host is a loopback, private or link-local
+// address, or a name that always means this machine. Other names are not
+// resolved.
+func IsLocalHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && IsLocalIP(ip)
+}
+
+// IsLocalIP reports whether ip is a loopback, private or link-local address.
+func IsLocalIP(ip net.IP) bool {
+	for _, n := range localNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"net"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// NoProxy follows the common no_proxy conventions: "*" matches everything,
+// a domain (with or without a leading dot) matches itself and its
+// subdomains, and IPs or CIDRs match IP literal hosts. The port of an entry
+// is ignored, it matches the host on every port.
+type NoProxy struct {
+	all     bool
+	domains DomainList
+	nets    []*net.IPNet
+}
+
+func ParseNoProxy(str string) (*NoProxy, error) {
+	n := &NoProxy{domains: DomainList{}}
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		switch {
+		case item == "":
+			continue
+		case item == "*":
+			n.all = true
+		case strings.Contains(item, "/"):
+			_, ipnet, err := net.ParseCIDR(item)
+			if err != nil {
+				return nil, errors.NotValidf("noProxy entry %q", item)
+			}
+			n.nets = append(n.nets, ipnet)
+		default:
+			if host, _, err := net.SplitHostPort(item); err == nil {
+				item = host
+			}
+			if ip := net.ParseIP(strings.Trim(item, "[]")); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				n.nets = append(n.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+			n.domains[strings.ToLower(strings.Trim(item, "."))] = true
+		}
+	}
+	return n, nil
+}
+
+// Match reports whether host, with or without port, should bypass the
+// proxy.
+func (n *NoProxy) Match(host string) bool {
+	if n == nil {
+		return false
+	}
+	if n.all {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		for _, ipnet := range n.nets {
+			if ipnet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return n.domains.Match(host)
+}
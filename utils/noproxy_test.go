@@ -0,0 +1,64 @@
+package utils
+
+import "testing"
+
+func TestNoProxy(t *testing.T) {
+	n, err := ParseNoProxy("localhost, .corp.example.com,example.org:8080,10.0.0.0/8,192.168.1.1,[fd00::1]:443,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host  string
+		match bool
+	}{
+		{"localhost", true},
+		{"LOCALHOST", true},
+		// a domain matches itself and its subdomains, with a dot or not
+		{"corp.example.com", true},
+		{"a.b.corp.example.com", true},
+		{"notcorp.example.com", false},
+		{"example.com", false},
+		// the port of an entry or a host doesn't matter
+		{"example.org", true},
+		{"www.example.org:443", true},
+		{"localhost:3128", true},
+		{"10.1.2.3", true},
+		{"10.1.2.3:22", true},
+		{"11.1.2.3", false},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+		{"fd00::1", true},
+		{"[fd00::1]:80", true},
+		{"[2001:db8::5]", true},
+		{"2001:db9::5", false},
+		// an IP is matched by the IP entries only
+		{"127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := n.Match(tt.host); got != tt.match {
+			t.Errorf("Match(%q) = %v, want %v", tt.host, got, tt.match)
+		}
+	}
+}
+
+func TestNoProxyAll(t *testing.T) {
+	n, err := ParseNoProxy("example.com, *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"example.net", "8.8.8.8", "[::1]:443"} {
+		if !n.Match(host) {
+			t.Errorf("* doesn't match %s", host)
+		}
+	}
+	var none *NoProxy
+	if none.Match("localhost") {
+		t.Error("a nil list matches")
+	}
+}
+
+func TestNoProxyInvalid(t *testing.T) {
+	if _, err := ParseNoProxy("example.com,10.0.0.0/33"); err == nil {
+		t.Error("an invalid CIDR is accepted")
+	}
+}